@@ -5,20 +5,27 @@ import (
 	"context"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/base64"
 	"encoding/json"
+	"encoding/xml"
 	"errors"
 	"flag"
 	"fmt"
 	"io"
+	"io/fs"
 	"net"
 	"net/http"
 	"net/url"
 	"os"
 	"os/signal"
+	"path"
+	"path/filepath"
 	"regexp"
+	"slices"
 	"strconv"
 	"strings"
 	"syscall"
+	"text/template"
 	"time"
 )
 
@@ -40,21 +47,155 @@ const (
 // pipeline, as opposed to the `push` of an ordinary branch pipeline.
 const pipelineSourceMergeRequest = "merge_request_event"
 
+// pipelineSourceAPI is the `source` of a pipeline created through the pipelines
+// API, which is how a pipeline with --pipeline-variable is created.
+const pipelineSourceAPI = "api"
+
+// The statuses of a pipeline that passed and of one that failed.
+const (
+	pipelineStatusSuccess = "success"
+	pipelineStatusFailed  = "failed"
+)
+
 // Defaults for the HTTP behavior. They are applied where they are used, not
 // only in parseFlags, so a zero-valued Config still behaves like the tool did
 // before these flags existed.
 const (
-	defaultTimeout    = 30 * time.Second
-	defaultRetryDelay = time.Second
-	maxRetryDelay     = 30 * time.Second
+	defaultTimeout      = 30 * time.Second
+	defaultRetryDelay   = time.Second
+	maxRetryDelay       = 30 * time.Second
+	defaultPollInterval = 3 * time.Second
+)
+
+// rebaseTimeout bounds the wait for a rebase GitLab has accepted. A rebase runs
+// in Sidekiq and normally takes seconds; minutes mean it is stuck in a queue.
+const rebaseTimeout = 5 * time.Minute
+
+// defaultPipelineTimeout bounds --wait-pipeline unless --pipeline-timeout says
+// otherwise. Pipelines that run longer usually have a stuck job.
+const defaultPipelineTimeout = time.Hour
+
+// mergeabilityTimeout bounds the wait for GitLab to finish working out whether
+// an MR can be merged, and for the pipeline auto-merge is meant to wait on.
+const mergeabilityTimeout = 2 * time.Minute
+
+// errWaitTimeout is returned by poll when the condition did not come true in
+// time. Callers wrap it with what they were waiting for.
+var errWaitTimeout = errors.New("timed out")
+
+// Commands name what a run does. The empty command is the create-or-update flow
+// the tool has always run; revert opens an MR reverting a merged one, merge
+// merges an MR right away once its pre-merge gates hold, status reports
+// whether an MR could be merged without changing anything, and check holds an
+// MR to the team's own review policy.
+const (
+	commandRevert = "revert"
+	commandMerge  = "merge"
+	commandStatus = "status"
+	commandCheck  = "check"
+)
+
+// Policy modes say what the check command does with an MR that breaks the
+// policy: fail the job, or only warn about it.
+const (
+	policyFail = "fail"
+	policyWarn = "warn"
+)
+
+// Output formats of the status command.
+const (
+	formatText  = "text"
+	formatJSON  = "json"
+	formatJUnit = "junit"
+)
+
+// statusNone is what the text report of the status command shows for a field
+// with nothing in it.
+const statusNone = "none"
+
+// --missing-labels modes. Without one, labels go to GitLab as they are, and
+// GitLab creates the ones the project does not have.
+const (
+	missingLabelsFail   = "fail"
+	missingLabelsCreate = "create"
+
+	// defaultLabelColor is the color of a created label the
+	// --label-definitions file says nothing about.
+	defaultLabelColor = "#428BCA"
+)
+
+// --branch-policy-mode values: what a source branch outside the policy does.
+const (
+	branchPolicyFail    = "fail"
+	branchPolicyComment = "comment"
+)
+
+// --title-lint values: what a title outside Conventional Commits does.
+const (
+	titleLintFail = "fail"
+	titleLintWarn = "warn"
+	titleLintFix  = "fix"
+)
+
+// defaultTitleTypes are the Conventional Commits types --title-lint accepts
+// unless --title-types says otherwise: those of the Angular convention the
+// specification grew out of, which release tooling commonly knows.
+const defaultTitleTypes = "feat,fix,docs,style,refactor,perf,test,build,ci,chore,revert"
+
+// --label-mode values: how an update sets the --label and issue labels.
+const (
+	labelModeReplace = "replace"
+	labelModeMerge   = "merge"
 )
 
+// milestoneActive is the --milestone value that picks the milestone under way.
+const milestoneActive = "active"
+
+// milestoneTitlePrefix marks a --milestone value as a title, for a milestone
+// titled like a number or like active.
+const milestoneTitlePrefix = "title:"
+
+// Size labels. An MR changing fewer lines than the first of the thresholds is
+// XS, fewer than the second S, and so on; past the last it is XL.
+const (
+	sizeLabelScope        = "size::"
+	defaultSizeThresholds = "10,50,250,1000"
+	defaultSizeExclude    = "vendor/**,**/vendor/**,**/node_modules/**,**/*.lock,**/go.sum,**/package-lock.json"
+)
+
+var sizeNames = []string{"XS", "S", "M", "L", "XL"}
+
+// omittedDiffSize is the smallest size, as an index into sizeNames, of changes
+// in which GitLab left a file's diff out as too large to show: its lines
+// cannot be counted, but a file that large is no small change.
+const omittedDiffSize = 3
+
+// exitBlocked is the exit status of a status command that found the MR
+// blocked, set apart from the 1 of a run that failed.
+const exitBlocked = 2
+
+// errMRBlocked is returned by the status command when the MR cannot be merged.
+// The report has already said why, so main only turns it into exitBlocked.
+var errMRBlocked = errors.New("merge request is blocked")
+
+// errBranchMoved is returned when the source branch no longer points at the
+// commit this run processed, so merging now would merge commits nobody checked.
+var errBranchMoved = errors.New(
+	"the source branch moved since this job started, refusing to merge commits this run did not process",
+)
+
+// errNothingToCancel is returned by cancelAutoMerge when auto-merge is not set
+// on the MR, which GitLab reports with a 406.
+var errNothingToCancel = errors.New("auto-merge is not set for the MR, so there is nothing to cancel")
+
 // errShowVersion is a sentinel error returned by parseFlags when --version has
 // been handled (version printed to stdout). Callers should treat it as a clean
 // exit with status 0 rather than a real error.
 var errShowVersion = errors.New("version shown")
 
 type Config struct {
+	Command            string
+	MRIID              int
 	PrivateToken       string
 	SourceBranch       string
 	ProjectID          int
@@ -84,6 +225,59 @@ type Config struct {
 	CACert             string
 	Draft              bool
 	Ready              bool
+	CommitFiles        []string
+	CommitMessage      string
+	CreateBranchFrom   string
+	Rebase             bool
+	PollInterval       time.Duration
+	MergeTrain         bool
+	LeaveMergeTrain    bool
+	CancelAutoMerge    bool
+
+	WaitPipeline         bool
+	PipelineTimeout      time.Duration
+	PipelineVariables    []PipelineVariable
+	CancelStalePipelines bool
+	RetryFailed          bool
+	RetryJobs            []string
+
+	MergeCommitMessage  string
+	SquashCommitMessage string
+
+	Format string
+
+	RequireResolvedThreads bool
+	MinApprovals           int
+	ApproverGroup          string
+	PolicyMode             string
+
+	Approve       bool
+	ApprovePaths  []string
+	ApprovalRules []ApprovalRuleConfig
+
+	PathLabels       []PathLabel
+	SizeLabels       bool
+	SizeThresholds   []int
+	SizeExclude      []string
+	MissingLabels    string
+	LabelDefinitions []LabelDefinition
+	LabelMode        string
+
+	BranchPolicy     []BranchRule
+	BranchPolicyMode string
+
+	TitleLint       string
+	TitleTypes      []string
+	TitleFromBranch bool
+
+	// Milestone is a --milestone given by title, possibly behind
+	// milestoneTitlePrefix, or milestoneActive, until resolveMilestone turns it
+	// into MilestoneID.
+	Milestone string
+
+	// server caches what gitlabServer learned about the instance, so GET
+	// /version is asked at most once per run.
+	server *serverInfo
 }
 
 type Project struct {
@@ -92,15 +286,74 @@ type Project struct {
 	DefaultBranch string `json:"default_branch"`
 }
 
+type User struct {
+	ID       int    `json:"id"`
+	Username string `json:"username"`
+	Name     string `json:"name"`
+}
+
+// ProjectApprovalSettings are the project's rules on who may approve its MRs.
+type ProjectApprovalSettings struct {
+	MergeRequestsAuthorApproval bool `json:"merge_requests_author_approval"`
+}
+
+// Comparison is what the compare API returns for two refs: the files changed
+// from one to the other.
+type Comparison struct {
+	Diffs []FileDiff `json:"diffs"`
+}
+
+// FileDiff is the change to one file. Diff is empty when GitLab left the diff
+// out as too large; GeneratedFile is only reported by GitLab 16.9 and later.
+type FileDiff struct {
+	OldPath       string `json:"old_path"`
+	NewPath       string `json:"new_path"`
+	Diff          string `json:"diff"`
+	GeneratedFile bool   `json:"generated_file"`
+
+	// TooLarge and Collapsed mark a file whose diff GitLab leaves out, so Diff
+	// is empty however much the file changed.
+	TooLarge  bool `json:"too_large"`
+	Collapsed bool `json:"collapsed"`
+}
+
+// DiffRefs are the commits the MR's diff was worked out between.
+type DiffRefs struct {
+	HeadSHA string `json:"head_sha"`
+}
+
 type MergeRequest struct {
-	ID           int    `json:"id"`
-	IID          int    `json:"iid"`
-	Title        string `json:"title"`
-	SourceBranch string `json:"source_branch"`
-	TargetBranch string `json:"target_branch"`
-	State        string `json:"state"`
-	WebURL       string `json:"web_url"`
-	SHA          string `json:"sha"`
+	ID              int    `json:"id"`
+	IID             int    `json:"iid"`
+	Title           string `json:"title"`
+	Description     string `json:"description"`
+	SourceBranch    string `json:"source_branch"`
+	TargetBranch    string `json:"target_branch"`
+	State           string `json:"state"`
+	WebURL          string `json:"web_url"`
+	SHA             string `json:"sha"`
+	MergeCommitSHA  string `json:"merge_commit_sha"`
+	SquashCommitSHA string `json:"squash_commit_sha"`
+	Author          User   `json:"author"`
+	MergeError      string `json:"merge_error"`
+
+	// ChangesCount is the number of files the MR's diff changes, as a string
+	// because a diff cut short at GitLab's limits reads like "1000+".
+	ChangesCount string   `json:"changes_count"`
+	DiffRefs     DiffRefs `json:"diff_refs"`
+
+	MergeWhenPipelineSucceeds bool `json:"merge_when_pipeline_succeeds"`
+
+	Labels              []string  `json:"labels"`
+	DetailedMergeStatus string    `json:"detailed_merge_status"`
+	HeadPipeline        *Pipeline `json:"head_pipeline"`
+	Draft               bool      `json:"draft"`
+	HasConflicts        bool      `json:"has_conflicts"`
+
+	// Only sent when asked for with include_rebase_in_progress and
+	// include_diverged_commits_count.
+	RebaseInProgress     bool `json:"rebase_in_progress"`
+	DivergedCommitsCount int  `json:"diverged_commits_count"`
 }
 
 type Pipeline struct {
@@ -112,6 +365,43 @@ type Pipeline struct {
 	Ref    string `json:"ref"`
 }
 
+// PathLabel labels the MRs that change a path matching Pattern, a glob in
+// which ** stands for any number of directories.
+type PathLabel struct {
+	Pattern string
+	Label   string
+}
+
+// BranchRule is one form of source branch name --branch-policy allows, with the
+// message that explains it when a branch takes none of the allowed forms.
+type BranchRule struct {
+	Pattern *regexp.Regexp
+	Message string
+}
+
+// PipelineVariable is a CI/CD variable passed to a pipeline this run creates.
+type PipelineVariable struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// PipelineCreateRequest creates a pipeline through the pipelines API, the only
+// one of GitLab's pipeline endpoints that takes variables.
+type PipelineCreateRequest struct {
+	Ref       string             `json:"ref"`
+	Variables []PipelineVariable `json:"variables,omitempty"`
+}
+
+// Job is one job of a pipeline, as the pipeline jobs endpoint lists it.
+type Job struct {
+	ID           int    `json:"id"`
+	Name         string `json:"name"`
+	Stage        string `json:"stage"`
+	Status       string `json:"status"`
+	WebURL       string `json:"web_url"`
+	AllowFailure bool   `json:"allow_failure"`
+}
+
 type Issue struct {
 	ID        int      `json:"id"`
 	IID       int      `json:"iid"`
@@ -122,6 +412,29 @@ type Issue struct {
 	} `json:"milestone"`
 }
 
+// Milestone is a project or group milestone. Its dates are YYYY-MM-DD, and
+// empty when not set.
+type Milestone struct {
+	ID        int    `json:"id"`
+	Title     string `json:"title"`
+	StartDate string `json:"start_date"`
+	DueDate   string `json:"due_date"`
+}
+
+// Label is a project or group label.
+type Label struct {
+	ID   int    `json:"id"`
+	Name string `json:"name"`
+}
+
+// LabelDefinition is how --missing-labels create makes a label: an entry of
+// the --label-definitions file, and the body of the create request.
+type LabelDefinition struct {
+	Name        string `json:"name"`
+	Color       string `json:"color"`
+	Description string `json:"description,omitempty"`
+}
+
 type MRCreateRequest struct {
 	SourceBranch       string   `json:"source_branch"`
 	TargetBranch       string   `json:"target_branch"`
@@ -146,12 +459,155 @@ type MRUpdateRequest struct {
 	AllowCollaboration bool     `json:"allow_collaboration,omitempty"`
 	MilestoneID        int      `json:"milestone_id,omitempty"`
 	Labels             []string `json:"labels,omitempty"`
+	AddLabels          []string `json:"add_labels,omitempty"`
+	RemoveLabels       []string `json:"remove_labels,omitempty"`
+}
+
+type MergeTrainAddRequest struct {
+	WhenPipelineSucceeds bool   `json:"when_pipeline_succeeds"`
+	SHA                  string `json:"sha,omitempty"`
+	Squash               bool   `json:"squash"`
+}
+
+// MergeTrainCar is one MR's place on a merge train.
+type MergeTrainCar struct {
+	ID           int `json:"id"`
+	MergeRequest struct {
+		IID int `json:"iid"`
+	} `json:"merge_request"`
+	Status       string `json:"status"`
+	TargetBranch string `json:"target_branch"`
+}
+
+type BranchCreateRequest struct {
+	Branch string `json:"branch"`
+	Ref    string `json:"ref"`
+}
+
+// CommitAction is one file change in a CommitCreateRequest. Content is always
+// sent base64-encoded, so binary files go through unchanged.
+type CommitAction struct {
+	Action   string `json:"action"`
+	FilePath string `json:"file_path"`
+	Content  string `json:"content,omitempty"`
+	Encoding string `json:"encoding,omitempty"`
+}
+
+type CommitCreateRequest struct {
+	Branch        string         `json:"branch"`
+	CommitMessage string         `json:"commit_message"`
+	Actions       []CommitAction `json:"actions"`
+}
+
+type Commit struct {
+	ID          string `json:"id"`
+	WebURL      string `json:"web_url"`
+	AuthorName  string `json:"author_name"`
+	AuthorEmail string `json:"author_email"`
+}
+
+type CommitRevertRequest struct {
+	Branch string `json:"branch"`
 }
 
+// MRAcceptRequest sets auto-merge through exactly one of AutoMerge and
+// MergeWhenPipelineSucceeds, whichever the server's release expects.
+//
+// SHA pins the merge to the commit this run worked with: GitLab refuses with 409
+// when the source branch has moved on since.
 type MRAcceptRequest struct {
-	MergeWhenPipelineSucceeds bool `json:"merge_when_pipeline_succeeds"`
-	ShouldRemoveSourceBranch  bool `json:"should_remove_source_branch"`
-	Squash                    bool `json:"squash"`
+	AutoMerge                 bool   `json:"auto_merge,omitempty"`
+	MergeWhenPipelineSucceeds bool   `json:"merge_when_pipeline_succeeds,omitempty"`
+	ShouldRemoveSourceBranch  bool   `json:"should_remove_source_branch"`
+	Squash                    bool   `json:"squash"`
+	SHA                       string `json:"sha,omitempty"`
+	MergeCommitMessage        string `json:"merge_commit_message,omitempty"`
+	SquashCommitMessage       string `json:"squash_commit_message,omitempty"`
+}
+
+// ApprovalRuleConfig is one entry of the --approval-rules file: an MR-level
+// approval rule and when it applies. A rule with neither Paths nor Labels
+// applies to every MR; otherwise it applies when the MR changes a path matching
+// one of Paths or carries one of Labels.
+type ApprovalRuleConfig struct {
+	Name              string   `json:"name"`
+	ApprovalsRequired int      `json:"approvals_required"`
+	UserIDs           []int    `json:"user_ids"`
+	GroupIDs          []int    `json:"group_ids"`
+	Paths             []string `json:"paths"`
+	Labels            []string `json:"labels"`
+}
+
+// ApprovalRule is an MR's approval rule as GitLab returns it.
+type ApprovalRule struct {
+	ID                int    `json:"id"`
+	Name              string `json:"name"`
+	ApprovalsRequired int    `json:"approvals_required"`
+	Users             []User `json:"users"`
+	Groups            []struct {
+		ID int `json:"id"`
+	} `json:"groups"`
+}
+
+// ApprovalRuleRequest creates or updates an MR-level approval rule. The ID
+// lists are always sent, empty ones included, so an update can clear them.
+type ApprovalRuleRequest struct {
+	Name              string `json:"name"`
+	ApprovalsRequired int    `json:"approvals_required"`
+	UserIDs           []int  `json:"user_ids"`
+	GroupIDs          []int  `json:"group_ids"`
+}
+
+// MRApproveRequest approves an MR. SHA pins the approval to the head whose
+// changes were checked, like MRAcceptRequest's does the merge.
+type MRApproveRequest struct {
+	SHA string `json:"sha,omitempty"`
+}
+
+// MRApprovals is the approval state of an MR. Approved already accounts for
+// every approval rule; ApprovalsLeft says how far short of them the MR falls.
+type MRApprovals struct {
+	Approved          bool         `json:"approved"`
+	ApprovalsRequired int          `json:"approvals_required"`
+	ApprovalsLeft     int          `json:"approvals_left"`
+	ApprovedBy        []MRApprover `json:"approved_by"`
+}
+
+// approvedBy reports whether the user is among the MR's approvers.
+func (a *MRApprovals) approvedBy(userID int) bool {
+	for _, approver := range a.ApprovedBy {
+		if approver.User.ID == userID {
+			return true
+		}
+	}
+	return false
+}
+
+// MRApprover is one approval an MR has been given.
+type MRApprover struct {
+	User User `json:"user"`
+}
+
+// Note is a comment on an MR.
+type Note struct {
+	ID     int    `json:"id"`
+	Body   string `json:"body"`
+	System bool   `json:"system"`
+}
+
+// NoteRequest posts a comment on an MR.
+type NoteRequest struct {
+	Body string `json:"body"`
+}
+
+// Discussion is a thread on an MR. It is unresolved while one of its resolvable
+// notes is.
+type Discussion struct {
+	ID    string `json:"id"`
+	Notes []struct {
+		Resolvable bool `json:"resolvable"`
+		Resolved   bool `json:"resolved"`
+	} `json:"notes"`
 }
 
 func main() {
@@ -171,6 +627,9 @@ func main() {
 	runErr := run(ctx, config)
 	stop()
 
+	if errors.Is(runErr, errMRBlocked) {
+		os.Exit(exitBlocked)
+	}
 	if runErr != nil {
 		fmt.Fprintf(os.Stderr, "Error: %v\n", runErr)
 		os.Exit(1)
@@ -180,13 +639,40 @@ func main() {
 func parseFlags() (*Config, error) {
 	config := &Config{}
 
-	var userIDsStr, reviewerIDsStr, labelsStr string
+	var userIDsStr, reviewerIDsStr, labelsStr, commitFilesStr, pipelineVariablesFile, retryJobsStr string
+	var approvePathsStr, approvalRulesFile, sizeThresholdsStr, sizeExcludeStr string
+	var milestoneStr, labelDefinitionsFile, titleTypesStr string
+	var pipelineVariables, pathLabels, branchPolicy repeatedFlag
 	var showVersion bool
 
+	// A leading word that is not a flag names the command. It is taken off
+	// before parsing, because the flag package stops at the first non-flag
+	// argument and would leave everything after it unparsed.
+	args := os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		config.Command = args[0]
+		args = args[1:]
+	}
+
 	flag.StringVar(&config.PrivateToken, "private-token", getEnv("GITLAB_PRIVATE_TOKEN", ""), "Private GITLAB token")
 	flag.StringVar(&config.SourceBranch, "source-branch", getEnv("CI_COMMIT_REF_NAME", ""), "Source branch to merge from")
 	flag.IntVar(&config.ProjectID, "project-id", getEnvInt("CI_PROJECT_ID", 0), "GitLab project ID")
 	flag.StringVar(&config.GitLabURL, "gitlab-url", getEnv("CI_PROJECT_URL", ""), "GitLab URL")
+	flag.IntVar(&config.MRIID, "mr-iid", 0, "IID of the merge request to revert, merge or report on")
+	flag.StringVar(&config.Format, "format", formatText, "Output of the status command: text, json or junit")
+	flag.BoolVar(&config.RequireResolvedThreads, "require-resolved-threads", false,
+		"Check command: require every resolvable thread to be resolved")
+	flag.IntVar(&config.MinApprovals, "min-approvals", 0, "Check command: require at least this many approvals")
+	flag.StringVar(&config.ApproverGroup, "approver-group", "",
+		"Check command: count only approvals from members of this group (ID or full path)")
+	flag.StringVar(&config.PolicyMode, "policy-mode", policyFail,
+		"What the check command does when the policy is not met: fail or warn")
+	flag.BoolVar(&config.Approve, "approve", false,
+		"Approve the MR as the token owner, if it opened the MR and every change is under --approve-paths")
+	flag.StringVar(&approvePathsStr, "approve-paths", "",
+		"Path globs --approve allows the MR to change (comma-separated, ** for any directories)")
+	flag.StringVar(&approvalRulesFile, "approval-rules", "",
+		"JSON file of MR approval rules to apply, by changed path or label")
 	flag.StringVar(&userIDsStr, "user-id", getEnv("GITLAB_USER_ID", ""), "User IDs to assign MR to (comma-separated)")
 	flag.StringVar(&reviewerIDsStr, "reviewer-id", "", "Reviewer IDs (comma-separated)")
 	flag.BoolVar(&config.Insecure, "insecure", false, "Skip SSL verification")
@@ -207,12 +693,30 @@ func parseFlags() (*Config, error) {
 	flag.StringVar(&config.Description, "description", "", "Path to description file")
 	flag.StringVar(&config.Description, "d", "", "Path to description file (short)")
 	flag.StringVar(&config.Title, "title", "", "Custom MR title")
+	flag.StringVar(&config.TitleLint, "title-lint", "",
+		"Hold the title to Conventional Commits: fail, warn, or fix it")
+	flag.StringVar(&titleTypesStr, "title-types", defaultTitleTypes,
+		"Conventional Commits types --title-lint accepts (comma-separated)")
+	flag.BoolVar(&config.TitleFromBranch, "title-from-branch", false,
+		"Without --title, build a Conventional Commits title from a type/scope-description branch name")
 	flag.StringVar(&labelsStr, "label", getEnv("GITLAB_AUTO_MR_LABELS", ""),
 		"Labels to set on the MR (comma-separated)")
-	flag.IntVar(&config.MilestoneID, "milestone", getEnvInt("GITLAB_AUTO_MR_MILESTONE", 0),
-		"Milestone ID to set on the MR")
+	flag.StringVar(&milestoneStr, "milestone", getEnv("GITLAB_AUTO_MR_MILESTONE", ""),
+		"Milestone to set on the MR: its ID, its title (title:TITLE for one like a number), "+
+			"or active for the one whose dates cover today")
+	flag.StringVar(&config.LabelMode, "label-mode", labelModeReplace,
+		"How an update sets labels: replace the MR's labels, or merge them in, replacing values within a scope")
+	flag.StringVar(&config.MissingLabels, "missing-labels", "",
+		"What to do about labels the project does not have: fail, or create them")
+	flag.StringVar(&labelDefinitionsFile, "label-definitions", "",
+		"JSON file of colors and descriptions for the labels --missing-labels create makes")
 	flag.BoolVar(&config.Draft, "draft", false, "Mark the MR as a draft (GitLab reads the Draft: title prefix)")
 	flag.BoolVar(&config.Ready, "ready", false, "Mark the MR as ready by removing a Draft:/WIP: title prefix")
+	flag.StringVar(&commitFilesStr, "commit-file", "",
+		"Local files to commit to the source branch before opening the MR (comma-separated)")
+	flag.StringVar(&config.CommitMessage, "commit-message", "", "Commit message for --commit-file")
+	flag.StringVar(&config.CreateBranchFrom, "create-branch-from", "",
+		"Create the source branch from this ref (branch, tag or SHA) if it does not exist")
 	flag.BoolVar(&config.UseIssueName, "use-issue-name", false, "Use issue data from branch name")
 	flag.BoolVar(&config.UseIssueName, "i", false, "Use issue data from branch name (short)")
 	flag.BoolVar(&config.AllowCollaboration, "allow-collaboration", false, "Allow collaboration")
@@ -221,10 +725,52 @@ func parseFlags() (*Config, error) {
 	flag.BoolVar(&config.UpdateMR, "update-mr", false, "Update existing MR instead of creating new one")
 	flag.BoolVar(&config.CreateOnly, "create-only", false, "Only create new MR, fail if MR already exists")
 	flag.BoolVar(&config.AutoMerge, "auto-merge", false, "Enable merge when pipeline succeeds (auto-merge)")
+	flag.BoolVar(&config.MergeTrain, "merge-train", false,
+		"Add the MR to the merge train, once its pipeline succeeds")
+	flag.BoolVar(&config.LeaveMergeTrain, "leave-merge-train", false,
+		"Take the MR off the merge train, or cancel its pending addition")
+	flag.BoolVar(&config.CancelAutoMerge, "cancel-auto-merge", false,
+		"Cancel auto-merge for the MR, if it is set")
+	flag.StringVar(&config.MergeCommitMessage, "merge-commit-message", "",
+		"Template for the merge commit message, used by --auto-merge and the merge command")
+	flag.StringVar(&config.SquashCommitMessage, "squash-commit-message", "",
+		"Template for the squash commit message, used by --auto-merge and the merge command")
 	flag.BoolVar(&config.ForcePipeline, "force-pipeline", false,
 		"With --trigger-pipeline, create a pipeline even if one exists for the same commit")
 	flag.BoolVar(&config.TriggerPipeline, "trigger-pipeline", false,
 		"Create a merge request pipeline for the MR, whether it was created or updated")
+	flag.BoolVar(&config.WaitPipeline, "wait-pipeline", false,
+		"With --trigger-pipeline, wait for the MR pipeline to finish and fail if it did not succeed")
+	flag.DurationVar(&config.PipelineTimeout, "pipeline-timeout",
+		getEnvDuration("GITLAB_AUTO_MR_PIPELINE_TIMEOUT", defaultPipelineTimeout),
+		"How long --wait-pipeline waits for the pipeline to finish")
+	flag.BoolVar(&config.CancelStalePipelines, "cancel-stale-pipelines", false,
+		"With --trigger-pipeline, cancel the MR's older pipelines still running for previous commits")
+	flag.BoolVar(&config.RetryFailed, "retry-failed", false,
+		"With --trigger-pipeline, retry the failed jobs of a failed pipeline for the commit instead of skipping it")
+	flag.StringVar(&retryJobsStr, "retry-job", "",
+		"With --retry-failed, retry only failed jobs whose names match these patterns (comma-separated, * wildcard)")
+	flag.Var(&pathLabels, "path-label",
+		"GLOB=LABEL: add LABEL when the MR changes a path matching GLOB, ** for any directories (repeatable)")
+	flag.Var(&branchPolicy, "branch-policy",
+		"REGEX=MESSAGE: a form source branch names may take, explained by MESSAGE (repeatable)")
+	flag.StringVar(&config.BranchPolicyMode, "branch-policy-mode", branchPolicyFail,
+		"What a branch outside --branch-policy does: fail the run, or comment on its open MR")
+	flag.BoolVar(&config.SizeLabels, "size-labels", false,
+		"Label the MR size::XS to size::XL by the number of lines it changes")
+	flag.StringVar(&sizeThresholdsStr, "size-thresholds", defaultSizeThresholds,
+		"Changed lines at which --size-labels moves up from XS, S, M and L (four increasing numbers)")
+	flag.StringVar(&sizeExcludeStr, "size-exclude", defaultSizeExclude,
+		"Globs of generated or vendored paths --size-labels does not count (comma-separated)")
+	flag.Var(&pipelineVariables, "pipeline-variable",
+		"With --trigger-pipeline, a KEY=VALUE variable for the pipeline (repeatable)")
+	flag.StringVar(&pipelineVariablesFile, "pipeline-variables-file", "",
+		"With --trigger-pipeline, a file of KEY=VALUE variables for the pipeline, one per line")
+	flag.BoolVar(&config.Rebase, "rebase", false,
+		"Rebase the MR onto the target branch before triggering the pipeline and auto-merge")
+	flag.DurationVar(&config.PollInterval, "poll-interval",
+		getEnvDuration("GITLAB_AUTO_MR_POLL_INTERVAL", defaultPollInterval),
+		"Delay between checks while waiting on GitLab")
 	flag.DurationVar(&config.Timeout, "timeout", getEnvDuration("GITLAB_AUTO_MR_TIMEOUT", defaultTimeout),
 		"Timeout for a single GitLab API request")
 	flag.IntVar(&config.Retries, "retries", getEnvInt("GITLAB_AUTO_MR_RETRIES", 2),
@@ -235,38 +781,21 @@ func parseFlags() (*Config, error) {
 	flag.BoolVar(&showVersion, "version", false, "Show version information and exit")
 	flag.BoolVar(&showVersion, "v", false, "Show version information and exit (short)")
 
-	flag.Parse()
+	if err := flag.CommandLine.Parse(args); err != nil {
+		return nil, err
+	}
 
 	if showVersion {
 		fmt.Println(versionInfo())
 		return nil, errShowVersion
 	}
 
-	// Validate required fields
-	if config.PrivateToken == "" {
-		return nil, fmt.Errorf("--private-token is required")
-	}
-	if config.SourceBranch == "" {
-		return nil, fmt.Errorf("--source-branch is required")
-	}
-	if config.ProjectID == 0 {
-		return nil, fmt.Errorf("--project-id is required")
-	}
-	if config.GitLabURL == "" {
-		return nil, fmt.Errorf("--gitlab-url is required")
-	}
-	if userIDsStr == "" {
-		return nil, fmt.Errorf("--user-id is required")
+	if err := checkRequiredFlags(config, userIDsStr); err != nil {
+		return nil, err
 	}
 
-	if config.Timeout <= 0 {
-		return nil, fmt.Errorf("--timeout must be positive, got %s", config.Timeout)
-	}
-	if config.Retries < 0 {
-		return nil, fmt.Errorf("--retries must not be negative, got %d", config.Retries)
-	}
-	if config.RetryDelay < 0 {
-		return nil, fmt.Errorf("--retry-delay must not be negative, got %s", config.RetryDelay)
+	if err := checkFlagRanges(config); err != nil {
+		return nil, err
 	}
 
 	// Parse user IDs
@@ -275,9 +804,26 @@ func parseFlags() (*Config, error) {
 		config.ReviewerIDs = parseIntSlice(reviewerIDsStr)
 	}
 	config.Labels = parseStringSlice(labelsStr)
+	config.CommitFiles = parseStringSlice(commitFilesStr)
+	config.RetryJobs = parseStringSlice(retryJobsStr)
+	config.TitleTypes = parseStringSlice(titleTypesStr)
+
+	variables, err := loadPipelineVariables(pipelineVariablesFile, pipelineVariables)
+	if err != nil {
+		return nil, err
+	}
+	config.PipelineVariables = variables
+
+	if err := parseRuleFlags(config, approvePathsStr, approvalRulesFile, branchPolicy); err != nil {
+		return nil, err
+	}
+	err = parseLabelFlags(config, pathLabels, sizeThresholdsStr, sizeExcludeStr, labelDefinitionsFile)
+	if err != nil {
+		return nil, err
+	}
 
-	if config.MilestoneID < 0 {
-		return nil, fmt.Errorf("--milestone must not be negative, got %d", config.MilestoneID)
+	if err := parseMilestone(config, milestoneStr); err != nil {
+		return nil, err
 	}
 
 	// Clean GitLab URL if it contains full project URL
@@ -292,751 +838,3891 @@ func parseFlags() (*Config, error) {
 	return config, nil
 }
 
-func isDraftPrefix(prefix string) bool {
-	lower := strings.ToLower(strings.TrimSpace(prefix))
-	return lower == draftPrefix || lower == wipPrefix
+// checkFlagRanges rejects numeric flags outside the range they make sense in.
+func checkFlagRanges(config *Config) error {
+	if config.Timeout <= 0 {
+		return fmt.Errorf("--timeout must be positive, got %s", config.Timeout)
+	}
+	if config.Retries < 0 {
+		return fmt.Errorf("--retries must not be negative, got %d", config.Retries)
+	}
+	if config.RetryDelay < 0 {
+		return fmt.Errorf("--retry-delay must not be negative, got %s", config.RetryDelay)
+	}
+	if config.PollInterval <= 0 {
+		return fmt.Errorf("--poll-interval must be positive, got %s", config.PollInterval)
+	}
+	if config.PipelineTimeout <= 0 {
+		return fmt.Errorf("--pipeline-timeout must be positive, got %s", config.PipelineTimeout)
+	}
+	if config.MinApprovals < 0 {
+		return fmt.Errorf("--min-approvals must not be negative, got %d", config.MinApprovals)
+	}
+	return nil
 }
 
-func validateConfig(config *Config) error {
-	if config.CACert != "" && config.Insecure {
-		return fmt.Errorf(
-			"--ca-cert cannot be used with --insecure: " +
-				"--insecure disables verification entirely, which would make the CA pointless",
-		)
+// checkRequiredFlags rejects a run that is missing a flag its command needs. A
+// revert takes its branches and its assignee from the MR being reverted, so it
+// needs the MR's IID instead of --source-branch and --user-id. A merge, a
+// status report or a policy check assigns nobody, and finds its MR by IID or
+// else by source branch.
+func checkRequiredFlags(config *Config, userIDsStr string) error {
+	switch config.Command {
+	case "", commandRevert, commandMerge, commandStatus, commandCheck:
+	default:
+		return fmt.Errorf("unknown command %q", config.Command)
 	}
 
-	if config.ForcePipeline && !config.TriggerPipeline {
-		return fmt.Errorf("--force-pipeline has no effect without --trigger-pipeline")
-	}
+	needsSourceBranch := config.Command == "" || (actsOnExistingMR(config.Command) && config.MRIID <= 0)
 
-	if config.Draft && config.Ready {
-		return fmt.Errorf("--draft cannot be used with --ready: they ask for opposite states")
+	if config.PrivateToken == "" {
+		return fmt.Errorf("--private-token is required")
+	}
+	if config.SourceBranch == "" && needsSourceBranch {
+		return fmt.Errorf("--source-branch is required")
+	}
+	if config.ProjectID == 0 {
+		return fmt.Errorf("--project-id is required")
+	}
+	if config.GitLabURL == "" {
+		return fmt.Errorf("--gitlab-url is required")
 	}
 
-	if config.AutoMerge && config.Draft {
-		return fmt.Errorf("--auto-merge cannot be used with --draft: " +
-			"GitLab does not allow auto-merge for draft merge requests")
+	if config.Command == commandRevert {
+		if config.MRIID <= 0 {
+			return fmt.Errorf("--mr-iid is required for the %s command", commandRevert)
+		}
+		return nil
 	}
 
-	if config.AutoMerge && config.MRExists {
-		return fmt.Errorf("--auto-merge cannot be used with --mr-exists (dry run mode)")
+	if actsOnExistingMR(config.Command) {
+		return nil
 	}
 
-	if config.AutoMerge && !config.Ready && isDraftPrefix(config.CommitPrefix) {
-		return fmt.Errorf(
-			"--auto-merge cannot be used with --commit-prefix %q: "+
-				"GitLab does not allow auto-merge for draft merge requests",
-			config.CommitPrefix,
-		)
+	if userIDsStr == "" {
+		return fmt.Errorf("--user-id is required")
 	}
 
 	return nil
 }
 
-func checkMRExists(config *Config, existingMR *MergeRequest) {
-	if existingMR == nil {
-		fmt.Printf(
-			"Merge request does not exist for this branch %s to %s, "+
-				"run without flag '--mr-exists' to open merge request.\n",
-			config.SourceBranch, config.TargetBranch)
-	} else {
-		fmt.Printf("Merge request exists: %s (IID: %d)\n",
-			existingMR.Title, existingMR.IID)
-		printMRURL(existingMR)
-	}
+// actsOnExistingMR reports whether the command works on an MR that is already
+// open, found with targetMRIID, rather than on one the run creates.
+func actsOnExistingMR(command string) bool {
+	return command == commandMerge || command == commandStatus || command == commandCheck
 }
 
-func run(ctx context.Context, config *Config) error {
-	if err := validateConfig(config); err != nil {
+func isDraftPrefix(prefix string) bool {
+	lower := strings.ToLower(strings.TrimSpace(prefix))
+	return lower == draftPrefix || lower == wipPrefix
+}
+
+func validateConfig(config *Config) error {
+	if err := validateTLSFlags(config); err != nil {
 		return err
 	}
 
-	client, err := createHTTPClient(config)
-	if err != nil {
+	if err := validatePipelineFlags(config); err != nil {
 		return err
 	}
 
-	project, err := getProject(ctx, client, config)
-	if err != nil {
-		return fmt.Errorf("unable to get project %d: %w", config.ProjectID, err)
+	if config.Draft && config.Ready {
+		return fmt.Errorf("--draft cannot be used with --ready: they ask for opposite states")
 	}
 
-	if config.TargetBranch == "" {
-		config.TargetBranch = project.DefaultBranch
+	if config.Rebase && config.MRExists {
+		return fmt.Errorf("--rebase cannot be used with --mr-exists (dry run mode)")
 	}
 
-	if err := validateMR(config.SourceBranch, config.TargetBranch); err != nil {
+	if err := validateCommand(config); err != nil {
 		return err
 	}
 
-	existingMR, err := getExistingMR(ctx, client, config)
-	if err != nil {
-		return fmt.Errorf("failed to check if MR exists: %w", err)
+	if err := validatePolicyFlags(config); err != nil {
+		return err
 	}
 
-	if config.MRExists {
-		checkMRExists(config, existingMR)
-		return nil
+	if err := validateBranchPolicy(config); err != nil {
+		return err
 	}
 
-	if err := checkMRMode(config, existingMR); err != nil {
+	if err := validateTitleFlags(config); err != nil {
 		return err
 	}
 
-	title := mrTitle(config, existingMR)
-	description := getDescriptionData(config.Description)
-
-	mr, err := handleMR(ctx, client, config, existingMR, title, description)
-	if err != nil {
+	if err := validateApproveFlags(config); err != nil {
 		return err
 	}
-	if mr == nil {
-		// Defensive: every handleMR branch returns an MR on success.
-		mr = &MergeRequest{}
+
+	if err := validateLabelFlags(config); err != nil {
+		return err
 	}
 
-	if config.TriggerPipeline {
-		if err := triggerMRPipeline(ctx, client, config, mr); err != nil {
-			return fmt.Errorf("failed to trigger merge request pipeline: %w", err)
-		}
+	if err := validateAutoMerge(config); err != nil {
+		return err
 	}
 
-	if config.AutoMerge {
-		return enableAutoMerge(ctx, client, config, mr.IID)
+	if err := validateCommitMessageTemplates(config); err != nil {
+		return err
 	}
 
-	return nil
+	return validateCommitFiles(config)
 }
 
-// checkMRMode rejects the two combinations where the mode the user asked for
-// contradicts what is actually on the server.
-func checkMRMode(config *Config, existingMR *MergeRequest) error {
-	if config.CreateOnly && existingMR != nil {
+// validateTLSFlags rejects --ca-cert together with --insecure.
+func validateTLSFlags(config *Config) error {
+	if config.CACert != "" && config.Insecure {
 		return fmt.Errorf(
-			"merge request already exists for this branch %s to %s, "+
-				"cannot create new MR in create-only mode",
-			config.SourceBranch, config.TargetBranch,
+			"--ca-cert cannot be used with --insecure: " +
+				"--insecure disables verification entirely, which would make the CA pointless",
 		)
 	}
+	return nil
+}
 
-	if config.UpdateMR && existingMR == nil {
-		return fmt.Errorf(
-			"merge request does not exist for this branch %s to %s, "+
-				"cannot update non-existent MR",
-			config.SourceBranch, config.TargetBranch,
-		)
+// validateCommand rejects the flags a command has no use for: the merge
+// command merges on its own terms and the status and check commands change
+// nothing, so none of them takes a merge action, and only the status command
+// has a --format.
+func validateCommand(config *Config) error {
+	actions := mergeActionFlags(config)
+
+	switch {
+	case config.Command == commandMerge && len(actions) > 0:
+		return fmt.Errorf("the %s command merges right away, it cannot be used with %s", commandMerge, actions[0])
+	case (config.Command == commandStatus || config.Command == commandCheck) && len(actions) > 0:
+		return fmt.Errorf("the %s command only reads the MR, it cannot be used with %s", config.Command, actions[0])
+	}
+
+	if modes := mrModeFlags(config); config.Command == commandRevert && len(modes) > 0 {
+		return fmt.Errorf("the %s command opens an MR from a branch of its own, it cannot be used with %s",
+			commandRevert, modes[0])
+	}
+
+	switch config.Format {
+	case "", formatText:
+		return nil
+	case formatJSON, formatJUnit:
+		if config.Command != commandStatus {
+			return fmt.Errorf("--format %s only applies to the %s command", config.Format, commandStatus)
+		}
+		return nil
+	}
+
+	return fmt.Errorf("unknown --format %q, want %s, %s or %s", config.Format, formatText, formatJSON, formatJUnit)
+}
+
+// policyFlags lists the policies set for the check command, by flag name.
+func policyFlags(config *Config) []string {
+	var set []string
+	if config.RequireResolvedThreads {
+		set = append(set, "--require-resolved-threads")
+	}
+	if config.MinApprovals > 0 {
+		set = append(set, "--min-approvals")
+	}
+	if config.ApproverGroup != "" {
+		set = append(set, "--approver-group")
+	}
+	return set
+}
+
+// validatePolicyFlags keeps the policy flags to the check command, where at
+// least one of them is needed: a check with no policy would pass every MR.
+func validatePolicyFlags(config *Config) error {
+	policies := policyFlags(config)
+
+	if config.Command != commandCheck {
+		if len(policies) > 0 {
+			return fmt.Errorf("%s only applies to the %s command", policies[0], commandCheck)
+		}
+		return nil
+	}
+
+	if len(policies) == 0 {
+		return fmt.Errorf("the %s command needs at least one of --require-resolved-threads, --min-approvals "+
+			"or --approver-group", commandCheck)
+	}
+
+	switch config.PolicyMode {
+	case "", policyFail, policyWarn:
+		return nil
+	}
+	return fmt.Errorf("unknown --policy-mode %q, want %s or %s", config.PolicyMode, policyFail, policyWarn)
+}
+
+// validateBranchPolicy keeps --branch-policy to runs that create or update an
+// MR: the other commands act on MRs that are already open. Commenting is left
+// out of dry runs, which must not change anything.
+func validateBranchPolicy(config *Config) error {
+	switch config.BranchPolicyMode {
+	case "", branchPolicyFail, branchPolicyComment:
+	default:
+		return fmt.Errorf("unknown --branch-policy-mode %q, want %s or %s",
+			config.BranchPolicyMode, branchPolicyFail, branchPolicyComment)
+	}
+
+	if len(config.BranchPolicy) == 0 {
+		if config.BranchPolicyMode == branchPolicyComment {
+			return fmt.Errorf("--branch-policy-mode has no effect without --branch-policy")
+		}
+		return nil
+	}
+
+	if config.Command != "" {
+		return fmt.Errorf("--branch-policy cannot be used with the %s command", config.Command)
+	}
+	if config.MRExists && config.BranchPolicyMode == branchPolicyComment {
+		return fmt.Errorf("--branch-policy-mode %s cannot be used with --mr-exists (dry run mode)", branchPolicyComment)
 	}
 
 	return nil
 }
 
-func handleMR(
-	ctx context.Context, client *http.Client, config *Config,
-	existingMR *MergeRequest, title, description string,
-) (*MergeRequest, error) {
+// validateTitleFlags checks the Conventional Commits title flags. They apply
+// where this run sets a title: creating or updating an MR, and revert, whose
+// "Revert: " title --title-lint fix turns into a revert commit.
+func validateTitleFlags(config *Config) error {
+	switch config.TitleLint {
+	case "", titleLintFail, titleLintWarn, titleLintFix:
+	default:
+		return fmt.Errorf("unknown --title-lint %q, want %s, %s or %s",
+			config.TitleLint, titleLintFail, titleLintWarn, titleLintFix)
+	}
+
+	if config.TitleLint != "" && config.Command != "" && config.Command != commandRevert {
+		return fmt.Errorf("--title-lint cannot be used with the %s command", config.Command)
+	}
+
+	for _, titleType := range config.TitleTypes {
+		if !conventionalType.MatchString(titleType) {
+			return fmt.Errorf("invalid --title-types entry %q, want lowercase letters", titleType)
+		}
+	}
+
+	if !config.TitleFromBranch {
+		return nil
+	}
+	if config.Command != "" {
+		return fmt.Errorf("--title-from-branch cannot be used with the %s command", config.Command)
+	}
+	if config.Title != "" {
+		return fmt.Errorf("--title-from-branch cannot be used with --title, which already sets the title")
+	}
+
+	return nil
+}
+
+// validateApproveFlags keeps --approve and --approval-rules to runs that create
+// or update an MR, and makes --approve come with the allowlist that guards it.
+func validateApproveFlags(config *Config) error {
+	if len(config.ApprovalRules) > 0 && config.Command != "" {
+		return fmt.Errorf("--approval-rules cannot be used with the %s command", config.Command)
+	}
+
+	if !config.Approve {
+		if len(config.ApprovePaths) > 0 {
+			return fmt.Errorf("--approve-paths has no effect without --approve")
+		}
+		return nil
+	}
+
+	if config.Command != "" {
+		return fmt.Errorf("--approve cannot be used with the %s command", config.Command)
+	}
+	if config.MRExists {
+		return fmt.Errorf("--approve cannot be used with --mr-exists (dry run mode)")
+	}
+	if len(config.ApprovePaths) == 0 {
+		return fmt.Errorf("--approve needs --approve-paths: only MRs whose changes are all allowed are approved")
+	}
+
+	return nil
+}
+
+// validateLabelFlags checks the label modes, and that --label-definitions comes
+// with the mode that uses it.
+func validateLabelFlags(config *Config) error {
+	switch config.MissingLabels {
+	case "", missingLabelsFail, missingLabelsCreate:
+	default:
+		return fmt.Errorf("unknown --missing-labels %q, want %s or %s",
+			config.MissingLabels, missingLabelsFail, missingLabelsCreate)
+	}
+
+	switch config.LabelMode {
+	case "", labelModeReplace, labelModeMerge:
+	default:
+		return fmt.Errorf("unknown --label-mode %q, want %s or %s", config.LabelMode, labelModeReplace, labelModeMerge)
+	}
+
+	if len(config.LabelDefinitions) > 0 && config.MissingLabels != missingLabelsCreate {
+		return fmt.Errorf("--label-definitions has no effect without --missing-labels %s", missingLabelsCreate)
+	}
+
+	return nil
+}
+
+// validatePipelineFlags rejects the pipeline options that only refine
+// --trigger-pipeline when it is not given.
+func validatePipelineFlags(config *Config) error {
+	if config.ForcePipeline && !config.TriggerPipeline {
+		return fmt.Errorf("--force-pipeline has no effect without --trigger-pipeline")
+	}
+
+	if config.WaitPipeline && !config.TriggerPipeline {
+		return fmt.Errorf("--wait-pipeline has no effect without --trigger-pipeline")
+	}
+
+	if config.CancelStalePipelines && !config.TriggerPipeline {
+		return fmt.Errorf("--cancel-stale-pipelines has no effect without --trigger-pipeline")
+	}
+
+	if len(config.PipelineVariables) > 0 && !config.TriggerPipeline {
+		return fmt.Errorf("--pipeline-variable has no effect without --trigger-pipeline")
+	}
+
+	return validateRetryFlags(config)
+}
+
+// validateRetryFlags checks --retry-failed and --retry-job. --force-pipeline
+// creates a pipeline whatever exists for the commit, which leaves no failed one
+// to retry.
+func validateRetryFlags(config *Config) error {
+	if config.RetryFailed && !config.TriggerPipeline {
+		return fmt.Errorf("--retry-failed has no effect without --trigger-pipeline")
+	}
+
+	if config.RetryFailed && config.ForcePipeline {
+		return fmt.Errorf("--retry-failed cannot be used with --force-pipeline: " +
+			"--force-pipeline creates a new pipeline instead of retrying the failed one")
+	}
+
+	if len(config.RetryJobs) > 0 && !config.RetryFailed {
+		return fmt.Errorf("--retry-job has no effect without --retry-failed")
+	}
+
+	return nil
+}
+
+// validateAutoMerge rejects --auto-merge and --merge-train where GitLab would
+// refuse them anyway, or where the run is not going to touch the MR at all.
+func validateAutoMerge(config *Config) error {
+	if config.AutoMerge && config.MergeTrain {
+		return fmt.Errorf("--auto-merge cannot be used with --merge-train: " +
+			"on a project with merge trains, auto-merge already joins the train")
+	}
+
+	actions := mergeActionFlags(config)
 	switch {
-	case existingMR != nil && !config.UpdateMR:
-		if config.AutoMerge {
-			fmt.Printf(
-				"Merge request already exists: %s (IID: %d), enabling auto-merge.\n",
-				existingMR.Title, existingMR.IID,
-			)
-		} else {
-			fmt.Printf(
-				"Merge request already exists: %s (IID: %d). "+
-					"Use --update-mr flag to update it.\n",
-				existingMR.Title, existingMR.IID,
-			)
+	case len(actions) == 0:
+		return nil
+	case len(actions) > 1:
+		return fmt.Errorf("%s cannot be used with %s: they ask for different things to happen to the merge",
+			actions[1], actions[0])
+	case config.MRExists:
+		return fmt.Errorf("%s cannot be used with --mr-exists (dry run mode)", actions[0])
+	case !config.AutoMerge && !config.MergeTrain:
+		return nil
+	}
+
+	mergeFlag := actions[0]
+
+	if config.Draft {
+		return fmt.Errorf("%s cannot be used with --draft: "+
+			"GitLab does not allow auto-merge for draft merge requests", mergeFlag)
+	}
+
+	if !config.Ready && isDraftPrefix(config.CommitPrefix) {
+		return fmt.Errorf(
+			"%s cannot be used with --commit-prefix %q: "+
+				"GitLab does not allow auto-merge for draft merge requests",
+			mergeFlag, config.CommitPrefix,
+		)
+	}
+
+	return nil
+}
+
+// mergeActionFlags returns the flags given among those that decide what happens
+// to the MR's merge. A run can act on the merge in one way only.
+func mergeActionFlags(config *Config) []string {
+	var actions []string
+	for _, action := range []struct {
+		flag string
+		set  bool
+	}{
+		{"--auto-merge", config.AutoMerge},
+		{"--merge-train", config.MergeTrain},
+		{"--leave-merge-train", config.LeaveMergeTrain},
+		{"--cancel-auto-merge", config.CancelAutoMerge},
+	} {
+		if action.set {
+			actions = append(actions, action.flag)
+		}
+	}
+	return actions
+}
+
+// mrModeFlags lists the flags given that only make sense for the MR of the
+// source branch: those choosing between creating and updating it, and those
+// preparing the branch.
+func mrModeFlags(config *Config) []string {
+	var modes []string
+	for _, mode := range []struct {
+		flag string
+		set  bool
+	}{
+		{"--update-mr", config.UpdateMR},
+		{"--create-only", config.CreateOnly},
+		{"--mr-exists", config.MRExists},
+		{"--use-issue-name", config.UseIssueName},
+		{"--commit-file", len(config.CommitFiles) > 0},
+		{"--create-branch-from", config.CreateBranchFrom != ""},
+	} {
+		if mode.set {
+			modes = append(modes, mode.flag)
+		}
+	}
+	return modes
+}
+
+// validateCommitMessageTemplates parses both commit message templates, so a
+// syntax error fails the run before anything is sent rather than at the merge,
+// after the MR has been created or updated. They are not executed here: what
+// a template may do with the data, such as index .CoAuthors, depends on data
+// only the merge has.
+func validateCommitMessageTemplates(config *Config) error {
+	// In flag order, so that with both templates broken the same one is
+	// reported on every run.
+	for _, message := range []struct {
+		flag string
+		text string
+	}{
+		{"--merge-commit-message", config.MergeCommitMessage},
+		{"--squash-commit-message", config.SquashCommitMessage},
+	} {
+		if _, err := parseCommitMessage(message.flag, message.text); err != nil {
+			return err
 		}
+	}
+	return nil
+}
+
+// validateCommitFiles checks --commit-file before anything is sent. The paths
+// are used both to read the local file and as its path in the repository, so
+// one that leaves the working directory has no sensible meaning in either.
+func validateCommitFiles(config *Config) error {
+	if len(config.CommitFiles) == 0 {
+		return nil
+	}
+
+	if config.CommitMessage == "" {
+		return fmt.Errorf("--commit-message is required with --commit-file")
+	}
+
+	if config.MRExists {
+		return fmt.Errorf("--commit-file cannot be used with --mr-exists (dry run mode)")
+	}
+
+	for _, file := range config.CommitFiles {
+		clean := path.Clean(filepath.ToSlash(file))
+		if path.IsAbs(clean) || clean == ".." || strings.HasPrefix(clean, "../") {
+			return fmt.Errorf("--commit-file %q must be a path inside the working directory", file)
+		}
+	}
+
+	return nil
+}
+
+func checkMRExists(config *Config, existingMR *MergeRequest) {
+	if existingMR == nil {
+		fmt.Printf(
+			"Merge request does not exist for this branch %s to %s, "+
+				"run without flag '--mr-exists' to open merge request.\n",
+			config.SourceBranch, config.TargetBranch)
+	} else {
+		fmt.Printf("Merge request exists: %s (IID: %d)\n",
+			existingMR.Title, existingMR.IID)
 		printMRURL(existingMR)
-		return existingMR, nil
+	}
+}
 
-	case existingMR != nil:
-		return handleUpdateMR(ctx, client, config, existingMR, title, description)
+func run(ctx context.Context, config *Config) error {
+	if err := validateConfig(config); err != nil {
+		return err
+	}
 
-	default:
-		return handleCreateMR(ctx, client, config, title, description)
+	client, err := createHTTPClient(config)
+	if err != nil {
+		return err
+	}
+
+	switch config.Command {
+	case commandRevert:
+		return runRevert(ctx, client, config)
+	case commandMerge:
+		return runMerge(ctx, client, config)
+	case commandStatus:
+		return runStatus(ctx, client, config)
+	case commandCheck:
+		return runCheck(ctx, client, config)
 	}
+
+	return runMR(ctx, client, config)
 }
 
-func handleUpdateMR(
-	ctx context.Context, client *http.Client, config *Config,
-	existingMR *MergeRequest, title, description string,
-) (*MergeRequest, error) {
-	updateRequest := &MRUpdateRequest{
-		Title:              title,
-		Description:        description,
-		AssigneeIDs:        config.UserIDs,
-		ReviewerIDs:        config.ReviewerIDs,
-		RemoveSourceBranch: boolPtr(config.RemoveBranch),
-		Squash:             boolPtr(config.SquashCommits),
-		AllowCollaboration: config.AllowCollaboration,
+// resolveTargetBranch falls back to the project's default branch when no target
+// was given, and rejects a target that is the source branch itself.
+func resolveTargetBranch(ctx context.Context, client *http.Client, config *Config) error {
+	project, err := getProject(ctx, client, config)
+	if err != nil {
+		return fmt.Errorf("unable to get project %d: %w", config.ProjectID, err)
+	}
+
+	if config.TargetBranch == "" {
+		config.TargetBranch = project.DefaultBranch
+	}
+
+	return validateMR(config.SourceBranch, config.TargetBranch)
+}
+
+// runMR is the default command: it creates the MR for the source branch, or
+// reports or updates the one that is already open.
+func runMR(ctx context.Context, client *http.Client, config *Config) error {
+	if err := resolveTargetBranch(ctx, client, config); err != nil {
+		return err
+	}
+
+	if err := enforceBranchPolicy(ctx, client, config); err != nil {
+		return err
+	}
+
+	existingMR, err := getExistingMR(ctx, client, config)
+	if err != nil {
+		return fmt.Errorf("failed to check if MR exists: %w", err)
+	}
+
+	if config.MRExists {
+		checkMRExists(config, existingMR)
+		return nil
+	}
+
+	if err := checkMRMode(config, existingMR); err != nil {
+		return err
+	}
+
+	// Only once the run is known to go ahead: a commit pushed for a run that
+	// then fails its mode check would stay on the branch all the same.
+	if len(config.CommitFiles) > 0 {
+		if err := commitFiles(ctx, client, config); err != nil {
+			return fmt.Errorf("failed to commit files: %w", err)
+		}
+	}
+
+	// An open MR means the branch exists, and --commit-file has already made
+	// sure of it; only a new MR from an unchecked branch needs the preflight.
+	if existingMR == nil && len(config.CommitFiles) == 0 {
+		if err := checkSourceBranch(ctx, client, config); err != nil {
+			return err
+		}
+	}
+
+	title, err := checkTitle(config, mrTitle(config, existingMR))
+	if err != nil {
+		return err
+	}
+	description := getDescriptionData(config.Description)
+
+	mr, err := handleMR(ctx, client, config, existingMR, title, description)
+	if err != nil {
+		return err
+	}
+	if mr == nil {
+		// Defensive: every handleMR branch returns an MR on success.
+		mr = &MergeRequest{}
+	}
+
+	return applyMRActions(ctx, client, config, mr)
+}
+
+// applyMRActions runs the optional steps that act on an MR once this run has
+// created, updated or found it. The rebase comes first: it moves the head
+// commit, and both the pipeline and auto-merge should act on the moved one.
+// A pipeline waited for and failed ends the run before auto-merge is touched.
+func applyMRActions(ctx context.Context, client *http.Client, config *Config, mr *MergeRequest) error {
+	if config.Rebase {
+		if err := rebaseMR(ctx, client, config, mr); err != nil {
+			return fmt.Errorf("failed to rebase merge request: %w", err)
+		}
+	}
+
+	// After the rebase, whose new head is the one to approve, and before the
+	// merge actions, which may need the approval.
+	if err := applyApprovalActions(ctx, client, config, mr); err != nil {
+		return err
+	}
+
+	if config.TriggerPipeline {
+		if err := applyPipelineActions(ctx, client, config, mr); err != nil {
+			return err
+		}
+	}
+
+	switch {
+	case config.AutoMerge:
+		return enableAutoMerge(ctx, client, config, mr)
+	case config.MergeTrain:
+		return addToMergeTrain(ctx, client, config, mr)
+	case config.LeaveMergeTrain:
+		return leaveMergeTrain(ctx, client, config, mr)
+	case config.CancelAutoMerge:
+		return disableAutoMerge(ctx, client, config, mr)
+	}
+
+	return nil
+}
+
+// runRevert opens an MR that undoes a merged one. The commit the merge left on
+// the target branch is reverted onto a new branch, and that branch is proposed
+// back to the same target, assigned to whoever wrote the original change.
+//
+// The title goes through mrTitle like any other, so --commit-prefix, --draft
+// and --ready apply; only its default changes to "Revert: <original title>".
+func runRevert(ctx context.Context, client *http.Client, config *Config) error {
+	original, err := getMR(ctx, client, config, config.MRIID, nil)
+	if err != nil {
+		return fmt.Errorf("unable to get merge request !%d: %w", config.MRIID, err)
+	}
+
+	sha, err := revertTarget(original)
+	if err != nil {
+		return err
+	}
+
+	branch, err := revertBranch(ctx, client, config, sha)
+	if err != nil {
+		return err
+	}
+	if err := createBranch(ctx, client, config, branch, original.TargetBranch); err != nil {
+		return fmt.Errorf("unable to create branch %s: %w", branch, err)
+	}
+
+	if err := revertCommit(ctx, client, config, sha, branch); err != nil {
+		// The branch holds nothing but the target at this point. Leaving it
+		// behind would only make the next attempt fail on "already exists".
+		if delErr := deleteBranch(ctx, client, config, branch); delErr != nil {
+			fmt.Fprintf(os.Stderr, "Warning: could not delete branch %s: %v\n", branch, delErr)
+		}
+		return fmt.Errorf("unable to revert commit %s: %w", shortSHA(sha), err)
+	}
+
+	fmt.Printf("Reverted commit %s of MR !%d onto branch %s\n", shortSHA(sha), original.IID, branch)
+
+	config.SourceBranch = branch
+	config.TargetBranch = original.TargetBranch
+	config.UserIDs = nil
+	if original.Author.ID != 0 {
+		config.UserIDs = []int{original.Author.ID}
+	}
+	if config.Title == "" {
+		config.Title = "Revert: " + stripDraftMarker(original.Title)
+	}
+
+	title, err := checkTitle(config, mrTitle(config, nil))
+	if err != nil {
+		return err
+	}
+	description := revertDescription(original, getDescriptionData(config.Description))
+
+	mr, err := handleCreateMR(ctx, client, config, title, description)
+	if err != nil {
+		return err
+	}
+
+	return applyMRActions(ctx, client, config, mr)
+}
+
+// revertTarget picks the commit whose revert undoes the whole MR. A merge commit
+// carries the complete change, and so does the squash commit of a fast-forward
+// merge; a fast-forward of several commits leaves no single commit to revert.
+func revertTarget(mr *MergeRequest) (string, error) {
+	if mr.State != "merged" {
+		return "", fmt.Errorf("merge request !%d is %s, only a merged MR can be reverted", mr.IID, mr.State)
+	}
+
+	switch {
+	case mr.MergeCommitSHA != "":
+		return mr.MergeCommitSHA, nil
+	case mr.SquashCommitSHA != "":
+		return mr.SquashCommitSHA, nil
+	}
+
+	return "", fmt.Errorf(
+		"merge request !%d was fast-forwarded without squashing, so there is no single commit to revert",
+		mr.IID,
+	)
+}
+
+// maxRevertBranches bounds the search for a free revert branch name.
+const maxRevertBranches = 20
+
+// revertBranch names the branch the revert goes onto: revert-<short sha>, or
+// with a -2, -3 and so on appended when an earlier revert of the same commit
+// left that name taken, for example once its MR was closed unmerged. The
+// existing branch is not reused, since it may carry more than the revert.
+func revertBranch(ctx context.Context, client *http.Client, config *Config, sha string) (string, error) {
+	base := "revert-" + shortSHA(sha)
+	for i := 1; i <= maxRevertBranches; i++ {
+		branch := base
+		if i > 1 {
+			branch = fmt.Sprintf("%s-%d", base, i)
+		}
+
+		exists, err := branchExists(ctx, client, config, branch)
+		if err != nil {
+			return "", fmt.Errorf("unable to check branch %s: %w", branch, err)
+		}
+		if !exists {
+			return branch, nil
+		}
+	}
+
+	return "", fmt.Errorf("branches %s to %s-%d all exist already, delete the ones no longer needed",
+		base, base, maxRevertBranches)
+}
+
+// revertDescription links the revert back to the MR it undoes. GitLab renders
+// !IID as a link on its own; the URL is there for wherever else it is read.
+// A --description file, when given, follows the link.
+func revertDescription(original *MergeRequest, extra string) string {
+	description := fmt.Sprintf("This reverts merge request !%d%s", original.IID, urlSuffix(original.WebURL))
+	if extra == "" {
+		return description
+	}
+	return description + "\n\n" + extra
+}
+
+// runMerge merges an MR right away, but only when every pre-merge gate holds:
+// a successful pipeline for its head commit, the approvals it needs, no
+// unresolved threads and no conflicts. The gates are printed as a checklist
+// either way, and a run that fails them names the ones it failed.
+//
+// The merge is pinned to the head the gates were checked at, so a push that
+// lands in between is refused rather than merged unchecked.
+func runMerge(ctx context.Context, client *http.Client, config *Config) error {
+	iid, err := targetMRIID(ctx, client, config)
+	if err != nil {
+		return err
+	}
+
+	mr, err := settledMR(ctx, client, config, iid)
+	if err != nil {
+		return err
+	}
+
+	approvals, err := getApprovals(ctx, client, config, mr.IID)
+	if err != nil {
+		return fmt.Errorf("unable to get the approvals of merge request !%d: %w", mr.IID, err)
+	}
+
+	unresolved, err := countUnresolvedThreads(ctx, client, config, mr.IID)
+	if err != nil {
+		return fmt.Errorf("unable to get the threads of merge request !%d: %w", mr.IID, err)
+	}
+
+	if unmet := printMergeChecks(os.Stdout, mr, mergeChecks(mr, approvals, unresolved)); len(unmet) > 0 {
+		return fmt.Errorf("merge request !%d not merged, conditions not met: %s", mr.IID, strings.Join(unmet, "; "))
+	}
+
+	commit, err := mergeMR(ctx, client, config, mr)
+	if err != nil {
+		return fmt.Errorf("failed to merge merge request !%d: %w", mr.IID, err)
+	}
+
+	fmt.Printf("Merged MR !%d into %s as commit %s\n", mr.IID, mr.TargetBranch, shortSHA(commit))
+	printMRURL(mr)
+	return nil
+}
+
+// targetMRIID finds the MR the merge and status commands act on: the one
+// --mr-iid names, or else the open MR from the source branch to the target.
+func targetMRIID(ctx context.Context, client *http.Client, config *Config) (int, error) {
+	if config.MRIID > 0 {
+		return config.MRIID, nil
+	}
+
+	if err := resolveTargetBranch(ctx, client, config); err != nil {
+		return 0, err
+	}
+
+	existingMR, err := getExistingMR(ctx, client, config)
+	if err != nil {
+		return 0, fmt.Errorf("failed to check if MR exists: %w", err)
+	}
+	if existingMR == nil {
+		return 0, fmt.Errorf("no open merge request from %s to %s", config.SourceBranch, config.TargetBranch)
+	}
+
+	return existingMR.IID, nil
+}
+
+// settledMR reads the MR once GitLab has finished working out whether it can be
+// merged. Until then has_conflicts may still describe an older head.
+func settledMR(ctx context.Context, client *http.Client, config *Config, mrIID int) (*MergeRequest, error) {
+	var mr *MergeRequest
+
+	err := poll(ctx, pollInterval(config), mergeabilityTimeout, func() (bool, error) {
+		var err error
+		mr, err = getMR(ctx, client, config, mrIID, nil)
+		if err != nil {
+			return false, err
+		}
+		return !pendingMergeStatuses[mr.DetailedMergeStatus], nil
+	})
+	if errors.Is(err, errWaitTimeout) {
+		return nil, fmt.Errorf("GitLab is still checking whether merge request !%d can be merged after %s",
+			mrIID, mergeabilityTimeout)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to get merge request !%d: %w", mrIID, err)
+	}
+
+	return mr, nil
+}
+
+// mergeCheck is one pre-merge gate of the merge command and how it came out.
+type mergeCheck struct {
+	name   string
+	passed bool
+	detail string
+}
+
+// mergeChecks evaluates the merge command's gates against the MR as it is now,
+// with unresolved the count of its threads still open.
+func mergeChecks(mr *MergeRequest, approvals *MRApprovals, unresolved int) []mergeCheck {
+	open := mergeCheck{name: "is open", passed: mr.State == "opened"}
+	if !open.passed {
+		open.detail = "it is " + mr.State
+	}
+
+	approved := mergeCheck{name: "is approved", passed: approvals.Approved}
+	if !approved.passed && approvals.ApprovalsLeft > 0 {
+		approved.detail = fmt.Sprintf("%d more approval(s) required", approvals.ApprovalsLeft)
+	}
+
+	return []mergeCheck{
+		open,
+		{name: "is not a draft", passed: !mr.Draft},
+		pipelineCheck(mr),
+		approved,
+		threadsCheck(unresolved),
+		{name: "has no conflicts with " + mr.TargetBranch, passed: !mr.HasConflicts},
+	}
+}
+
+// threadsCheck passes when no thread is left unresolved. It goes by the threads
+// themselves: GitLab's blocking_discussions_resolved is true whenever the
+// project does not require threads to be resolved, open ones or not.
+func threadsCheck(unresolved int) mergeCheck {
+	check := mergeCheck{name: "has no unresolved threads", passed: unresolved == 0}
+	if unresolved > 0 {
+		check.detail = fmt.Sprintf("%d unresolved", unresolved)
+	}
+	return check
+}
+
+// pipelineCheck passes when the MR's head pipeline ran for its head commit and
+// succeeded. A pipeline for an older commit says nothing about the commits that
+// would be merged, however it ended.
+func pipelineCheck(mr *MergeRequest) mergeCheck {
+	check := mergeCheck{name: "pipeline succeeded for " + shortSHA(mr.SHA)}
+
+	pipeline := mr.HeadPipeline
+	switch {
+	case pipeline == nil:
+		check.detail = "no pipeline has run for it"
+	case pipeline.SHA != "" && pipeline.SHA != mr.SHA:
+		check.detail = fmt.Sprintf("the latest pipeline, %d, ran for %s", pipeline.ID, shortSHA(pipeline.SHA))
+	default:
+		check.passed = pipeline.Status == pipelineStatusSuccess
+		check.detail = fmt.Sprintf("pipeline %d: %s", pipeline.ID, pipeline.Status)
+	}
+
+	return check
+}
+
+// checkLine is how a gate reads in a report: its name, then its detail if it
+// has one.
+func checkLine(check mergeCheck) string {
+	if check.detail == "" {
+		return check.name
+	}
+	return check.name + " (" + check.detail + ")"
+}
+
+// printMergeChecks prints the gates to w as a checklist and returns the ones
+// that failed, each with its detail.
+func printMergeChecks(w io.Writer, mr *MergeRequest, checks []mergeCheck) []string {
+	return printChecks(w, fmt.Sprintf("Merge conditions for MR !%d%s:", mr.IID, shaSuffix(mr.SHA)), checks)
+}
+
+// printChecks prints checks to w as a checklist under header and returns the
+// ones that failed, each with its detail.
+func printChecks(w io.Writer, header string, checks []mergeCheck) []string {
+	var unmet []string
+
+	fmt.Fprintln(w, header)
+	for _, check := range checks {
+		line := checkLine(check)
+
+		mark := "x"
+		if !check.passed {
+			mark = " "
+			unmet = append(unmet, line)
+		}
+		fmt.Fprintf(w, "  [%s] %s\n", mark, line)
+	}
+
+	return unmet
+}
+
+// mrStatus is what the status command reports about an MR. Blockers lists the
+// gates it fails; Mergeable is true when there are none.
+type mrStatus struct {
+	IID                 int      `json:"iid"`
+	Title               string   `json:"title"`
+	WebURL              string   `json:"web_url"`
+	SHA                 string   `json:"sha"`
+	Mergeable           bool     `json:"mergeable"`
+	Blockers            []string `json:"blockers"`
+	Draft               bool     `json:"draft"`
+	DetailedMergeStatus string   `json:"detailed_merge_status"`
+	PipelineID          int      `json:"pipeline_id,omitempty"`
+	PipelineStatus      string   `json:"pipeline_status"`
+	ApprovalsGiven      int      `json:"approvals_given"`
+	ApprovalsRequired   int      `json:"approvals_required"`
+	UnresolvedThreads   int      `json:"unresolved_threads"`
+	HasConflicts        bool     `json:"has_conflicts"`
+	Labels              []string `json:"labels"`
+
+	mr     *MergeRequest
+	checks []mergeCheck
+}
+
+// runStatus reports whether an MR could be merged right now, changing nothing.
+// The gates are the merge command's, plus GitLab's own detailed_merge_status so
+// that project settings the tool does not know about are still heard. A
+// blocked MR makes the run exit with exitBlocked, so a gating job fails on it
+// and tells it apart from a run that could not find out.
+func runStatus(ctx context.Context, client *http.Client, config *Config) error {
+	iid, err := targetMRIID(ctx, client, config)
+	if err != nil {
+		return err
+	}
+
+	mr, err := settledMR(ctx, client, config, iid)
+	if err != nil {
+		return err
+	}
+
+	approvals, err := getApprovals(ctx, client, config, mr.IID)
+	if err != nil {
+		return fmt.Errorf("unable to get the approvals of merge request !%d: %w", mr.IID, err)
+	}
+
+	unresolved, err := countUnresolvedThreads(ctx, client, config, mr.IID)
+	if err != nil {
+		return fmt.Errorf("unable to get the threads of merge request !%d: %w", mr.IID, err)
+	}
+
+	status := newMRStatus(mr, approvals, unresolved)
+	if err := writeStatus(os.Stdout, config.Format, status); err != nil {
+		return err
+	}
+
+	if !status.Mergeable {
+		return errMRBlocked
+	}
+	return nil
+}
+
+// newMRStatus puts the status report together from what GitLab returned.
+func newMRStatus(mr *MergeRequest, approvals *MRApprovals, unresolved int) *mrStatus {
+	status := &mrStatus{
+		IID:                 mr.IID,
+		Title:               mr.Title,
+		WebURL:              mr.WebURL,
+		SHA:                 mr.SHA,
+		Blockers:            []string{},
+		Draft:               mr.Draft,
+		DetailedMergeStatus: mr.DetailedMergeStatus,
+		ApprovalsGiven:      len(approvals.ApprovedBy),
+		ApprovalsRequired:   approvals.ApprovalsRequired,
+		UnresolvedThreads:   unresolved,
+		HasConflicts:        mr.HasConflicts,
+		Labels:              mr.Labels,
+		mr:                  mr,
+		checks:              append(mergeChecks(mr, approvals, unresolved), mergeStatusCheck(mr)),
+	}
+	if status.Labels == nil {
+		status.Labels = []string{}
+	}
+	if mr.HeadPipeline != nil {
+		status.PipelineID = mr.HeadPipeline.ID
+		status.PipelineStatus = mr.HeadPipeline.Status
+	}
+
+	for _, check := range status.checks {
+		if !check.passed {
+			status.Blockers = append(status.Blockers, checkLine(check))
+		}
+	}
+	status.Mergeable = len(status.Blockers) == 0
+
+	return status
+}
+
+// mergeStatusCheck passes when GitLab itself would merge the MR. GitLab
+// releases before 15.6 report no detailed_merge_status, and the check passes
+// there rather than block every MR.
+func mergeStatusCheck(mr *MergeRequest) mergeCheck {
+	check := mergeCheck{name: "GitLab reports it mergeable"}
+
+	switch status := mr.DetailedMergeStatus; status {
+	case "", "mergeable":
+		check.passed = true
+	default:
+		check.detail = status
+		if reason, ok := mergeBlockers[status]; ok {
+			check.detail = reason + ", status: " + status
+		}
+	}
+
+	return check
+}
+
+// writeStatus writes the report to w in the given --format.
+func writeStatus(w io.Writer, format string, status *mrStatus) error {
+	switch format {
+	case formatJSON:
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(status)
+	case formatJUnit:
+		return writeStatusJUnit(w, status)
+	}
+
+	writeStatusText(w, status)
+	return nil
+}
+
+func writeStatusText(w io.Writer, status *mrStatus) {
+	yesNo := map[bool]string{true: "yes", false: "no"}
+
+	pipeline := statusNone
+	if status.PipelineID != 0 {
+		pipeline = fmt.Sprintf("%d, %s", status.PipelineID, status.PipelineStatus)
+	}
+	labels := statusNone
+	if len(status.Labels) > 0 {
+		labels = strings.Join(status.Labels, ", ")
+	}
+	mergeStatus := status.DetailedMergeStatus
+	if mergeStatus == "" {
+		mergeStatus = "not reported"
+	}
+
+	fmt.Fprintf(w, "MR !%d: %s\n", status.IID, status.Title)
+	if status.WebURL != "" {
+		fmt.Fprintf(w, "  URL: %s\n", status.WebURL)
+	}
+	fmt.Fprintf(w, "  Draft: %s\n", yesNo[status.Draft])
+	fmt.Fprintf(w, "  Merge status: %s\n", mergeStatus)
+	fmt.Fprintf(w, "  Pipeline: %s\n", pipeline)
+	fmt.Fprintf(w, "  Approvals: %d given, %d required\n", status.ApprovalsGiven, status.ApprovalsRequired)
+	fmt.Fprintf(w, "  Unresolved threads: %d\n", status.UnresolvedThreads)
+	fmt.Fprintf(w, "  Conflicts: %s\n", yesNo[status.HasConflicts])
+	fmt.Fprintf(w, "  Labels: %s\n", labels)
+
+	printMergeChecks(w, status.mr, status.checks)
+
+	if status.Mergeable {
+		fmt.Fprintf(w, "MR !%d is mergeable\n", status.IID)
+	} else {
+		fmt.Fprintf(w, "MR !%d is blocked: %s\n", status.IID, strings.Join(status.Blockers, "; "))
+	}
+}
+
+// runCheck holds an MR to the policy its flags set: resolved threads, a number
+// of approvals, approvals from a given group. These are the team's rules rather
+// than the project's, so GitLab may well let the MR merge without them; the
+// check is meant for a pipeline job that makes them count. In warn mode an MR
+// that breaks the policy is only warned about, for trying a policy out before
+// enforcing it.
+func runCheck(ctx context.Context, client *http.Client, config *Config) error {
+	iid, err := targetMRIID(ctx, client, config)
+	if err != nil {
+		return err
+	}
+
+	checks, err := policyChecks(ctx, client, config, iid)
+	if err != nil {
+		return err
+	}
+
+	unmet := printChecks(os.Stdout, fmt.Sprintf("Policy checks for MR !%d:", iid), checks)
+	if len(unmet) == 0 {
+		return nil
+	}
+
+	if config.PolicyMode == policyWarn {
+		for _, line := range unmet {
+			fmt.Fprintf(os.Stderr, "Warning: MR !%d does not meet the policy: %s\n", iid, line)
+		}
+		return nil
+	}
+
+	return fmt.Errorf("merge request !%d does not meet the policy: %s", iid, strings.Join(unmet, "; "))
+}
+
+// policyChecks evaluates the policies the flags set, reading only what they
+// need.
+func policyChecks(ctx context.Context, client *http.Client, config *Config, mrIID int) ([]mergeCheck, error) {
+	var checks []mergeCheck
+
+	if config.RequireResolvedThreads {
+		unresolved, err := countUnresolvedThreads(ctx, client, config, mrIID)
+		if err != nil {
+			return nil, fmt.Errorf("unable to get the threads of merge request !%d: %w", mrIID, err)
+		}
+
+		checks = append(checks, threadsCheck(unresolved))
+	}
+
+	if config.MinApprovals > 0 || config.ApproverGroup != "" {
+		check, err := approvalsCheck(ctx, client, config, mrIID)
+		if err != nil {
+			return nil, err
+		}
+		checks = append(checks, check)
+	}
+
+	return checks, nil
+}
+
+// approvalsCheck passes when the MR has --min-approvals approvals, counting
+// only those from members of --approver-group when it is set. A group with no
+// minimum asks for one approval from it. The approvals left out are named, so
+// an approval that did not count is not a mystery.
+func approvalsCheck(ctx context.Context, client *http.Client, config *Config, mrIID int) (mergeCheck, error) {
+	approvals, err := getApprovals(ctx, client, config, mrIID)
+	if err != nil {
+		return mergeCheck{}, fmt.Errorf("unable to get the approvals of merge request !%d: %w", mrIID, err)
+	}
+
+	if config.ApproverGroup != "" {
+		if err := checkGroupExists(ctx, client, config, config.ApproverGroup); err != nil {
+			return mergeCheck{}, err
+		}
+	}
+
+	required := max(config.MinApprovals, 1)
+	check := mergeCheck{name: fmt.Sprintf("has at least %d approval(s)", required)}
+
+	var outsiders []string
+	counted := 0
+	for _, approver := range approvals.ApprovedBy {
+		if config.ApproverGroup == "" {
+			counted++
+			continue
+		}
+
+		member, err := isGroupMember(ctx, client, config, config.ApproverGroup, approver.User.ID)
+		if err != nil {
+			return mergeCheck{}, fmt.Errorf("unable to check whether %s is a member of group %s: %w",
+				approver.User.Username, config.ApproverGroup, err)
+		}
+		if member {
+			counted++
+		} else {
+			outsiders = append(outsiders, approver.User.Username)
+		}
+	}
+
+	if config.ApproverGroup != "" {
+		check.name += " from members of group " + config.ApproverGroup
+	}
+	check.passed = counted >= required
+	check.detail = fmt.Sprintf("%d given", counted)
+	if len(outsiders) > 0 {
+		check.detail += ", not counted from outside the group: " + strings.Join(outsiders, ", ")
+	}
+
+	return check, nil
+}
+
+// junitTestSuite is the JUnit report of the status command: a test case per
+// gate, failed when the gate is, so GitLab lists the blockers in the MR widget.
+type junitTestSuite struct {
+	XMLName   xml.Name        `xml:"testsuite"`
+	Name      string          `xml:"name,attr"`
+	Tests     int             `xml:"tests,attr"`
+	Failures  int             `xml:"failures,attr"`
+	TestCases []junitTestCase `xml:"testcase"`
+}
+
+type junitTestCase struct {
+	ClassName string        `xml:"classname,attr"`
+	Name      string        `xml:"name,attr"`
+	Failure   *junitFailure `xml:"failure,omitempty"`
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Text    string `xml:",chardata"`
+}
+
+func writeStatusJUnit(w io.Writer, status *mrStatus) error {
+	suite := junitTestSuite{
+		Name:  fmt.Sprintf("merge request !%d", status.IID),
+		Tests: len(status.checks),
+	}
+
+	for _, check := range status.checks {
+		testCase := junitTestCase{ClassName: "gitlab-auto-mr.status", Name: check.name}
+		if !check.passed {
+			suite.Failures++
+			testCase.Failure = &junitFailure{Message: checkLine(check), Text: status.WebURL}
+		}
+		suite.TestCases = append(suite.TestCases, testCase)
+	}
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	encoder := xml.NewEncoder(w)
+	encoder.Indent("", "  ")
+	if err := encoder.Encode(suite); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+// mergeMR merges the MR now, pinned to mr.SHA, and returns the commit the merge
+// left on the target branch.
+func mergeMR(ctx context.Context, client *http.Client, config *Config, mr *MergeRequest) (string, error) {
+	request := &MRAcceptRequest{
+		ShouldRemoveSourceBranch: config.RemoveBranch,
+		Squash:                   config.SquashCommits,
+		SHA:                      mr.SHA,
+	}
+
+	var err error
+	request.MergeCommitMessage, request.SquashCommitMessage, err = commitMessages(ctx, client, config, mr.IID)
+	if err != nil {
+		return "", err
+	}
+
+	body, err := putMerge(ctx, client, config, mr.IID, request)
+	if err != nil {
+		return "", err
+	}
+
+	// The merge has happened whatever the body says; it only tells which
+	// commit to report. A fast-forward leaves the head itself on the target.
+	var merged MergeRequest
+	if err := json.Unmarshal(body, &merged); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: merge request merged but response could not be read: %v\n", err)
+	}
+
+	switch {
+	case merged.MergeCommitSHA != "":
+		return merged.MergeCommitSHA, nil
+	case merged.SquashCommitSHA != "":
+		return merged.SquashCommitSHA, nil
+	}
+	return mr.SHA, nil
+}
+
+// commitFiles pushes the --commit-file changes to the source branch as a single
+// commit, creating the branch first if it does not exist yet — from
+// --create-branch-from when given, from the target branch otherwise.
+// This is what lets a CI job that produced the changes open the MR without git
+// credentials of its own.
+//
+// Each file is compared with the branch before it is committed: a file that is
+// missing locally is deleted, one that is new is created, and one whose content
+// already matches is left out. A re-run with nothing new therefore adds no empty
+// commit, and no commit at all when every file is unchanged.
+func commitFiles(ctx context.Context, client *http.Client, config *Config) error {
+	ref := config.CreateBranchFrom
+	if ref == "" {
+		ref = config.TargetBranch
+	}
+
+	created, err := ensureBranch(ctx, client, config, config.SourceBranch, ref)
+	if err != nil {
+		return err
+	}
+	if created {
+		fmt.Printf("Created branch %s from %s\n", config.SourceBranch, ref)
+	}
+
+	actions := make([]CommitAction, 0, len(config.CommitFiles))
+	for _, file := range config.CommitFiles {
+		action, err := fileAction(ctx, client, config, file)
+		if err != nil {
+			return err
+		}
+		if action != nil {
+			actions = append(actions, *action)
+		}
+	}
+
+	if len(actions) == 0 {
+		fmt.Printf("No file changes to commit, %s is already up to date\n", config.SourceBranch)
+		return nil
+	}
+
+	commit, err := createCommit(ctx, client, config, &CommitCreateRequest{
+		Branch:        config.SourceBranch,
+		CommitMessage: config.CommitMessage,
+		Actions:       actions,
+	})
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Committed %d file change(s) to %s (commit %s)%s\n",
+		len(actions), config.SourceBranch, shortSHA(commit.ID), urlSuffix(commit.WebURL))
+	return nil
+}
+
+// checkSourceBranch makes sure the source branch exists before an MR is opened
+// from it. Without the check GitLab answers POST /merge_requests for a missing
+// branch with a 4xx that does not say which branch is the problem. With
+// --create-branch-from the branch is created instead of reported.
+func checkSourceBranch(ctx context.Context, client *http.Client, config *Config) error {
+	if config.CreateBranchFrom != "" {
+		created, err := ensureBranch(ctx, client, config, config.SourceBranch, config.CreateBranchFrom)
+		if err != nil {
+			return err
+		}
+		if created {
+			fmt.Printf("Created branch %s from %s\n", config.SourceBranch, config.CreateBranchFrom)
+		}
+		return nil
+	}
+
+	exists, err := branchExists(ctx, client, config, config.SourceBranch)
+	if err != nil {
+		return fmt.Errorf("unable to check branch %s: %w", config.SourceBranch, err)
+	}
+	if !exists {
+		return fmt.Errorf(
+			"source branch %s does not exist in project %d, "+
+				"push it first or pass --create-branch-from <ref> to create it",
+			config.SourceBranch, config.ProjectID,
+		)
+	}
+
+	return nil
+}
+
+// fileAction works out what committing one local file means for the source
+// branch, returning nil when the branch already has it as it is.
+func fileAction(ctx context.Context, client *http.Client, config *Config, file string) (*CommitAction, error) {
+	repoPath := path.Clean(filepath.ToSlash(file))
+
+	// #nosec G304 -- the path comes from the caller's own --commit-file flag and the
+	// tool runs with the caller's rights, so there is no privilege boundary here.
+	local, err := os.ReadFile(file)
+	localExists := err == nil
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("unable to read %s: %w", file, err)
+	}
+
+	remote, remoteExists, err := getRawFile(ctx, client, config, repoPath, config.SourceBranch)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read %s from %s: %w", repoPath, config.SourceBranch, err)
+	}
+
+	switch {
+	case !localExists && !remoteExists:
+		return nil, nil
+	case !localExists:
+		return &CommitAction{Action: "delete", FilePath: repoPath}, nil
+	case remoteExists && bytes.Equal(local, remote):
+		return nil, nil
+	}
+
+	action := "create"
+	if remoteExists {
+		action = "update"
+	}
+
+	return &CommitAction{
+		Action:   action,
+		FilePath: repoPath,
+		Content:  base64.StdEncoding.EncodeToString(local),
+		Encoding: "base64",
+	}, nil
+}
+
+// checkMRMode rejects the two combinations where the mode the user asked for
+// contradicts what is actually on the server.
+func checkMRMode(config *Config, existingMR *MergeRequest) error {
+	if config.CreateOnly && existingMR != nil {
+		return fmt.Errorf(
+			"merge request already exists for this branch %s to %s, "+
+				"cannot create new MR in create-only mode",
+			config.SourceBranch, config.TargetBranch,
+		)
+	}
+
+	if config.UpdateMR && existingMR == nil {
+		return fmt.Errorf(
+			"merge request does not exist for this branch %s to %s, "+
+				"cannot update non-existent MR",
+			config.SourceBranch, config.TargetBranch,
+		)
+	}
+
+	return nil
+}
+
+func handleMR(
+	ctx context.Context, client *http.Client, config *Config,
+	existingMR *MergeRequest, title, description string,
+) (*MergeRequest, error) {
+	switch {
+	case existingMR != nil && !config.UpdateMR:
+		if config.AutoMerge {
+			fmt.Printf(
+				"Merge request already exists: %s (IID: %d), enabling auto-merge.\n",
+				existingMR.Title, existingMR.IID,
+			)
+		} else {
+			fmt.Printf(
+				"Merge request already exists: %s (IID: %d). "+
+					"Use --update-mr flag to update it.\n",
+				existingMR.Title, existingMR.IID,
+			)
+		}
+		printMRURL(existingMR)
+		return existingMR, nil
+
+	case existingMR != nil:
+		return handleUpdateMR(ctx, client, config, existingMR, title, description)
+
+	default:
+		return handleCreateMR(ctx, client, config, title, description)
+	}
+}
+
+func handleUpdateMR(
+	ctx context.Context, client *http.Client, config *Config,
+	existingMR *MergeRequest, title, description string,
+) (*MergeRequest, error) {
+	updateRequest := &MRUpdateRequest{
+		Title:              title,
+		Description:        description,
+		AssigneeIDs:        config.UserIDs,
+		ReviewerIDs:        config.ReviewerIDs,
+		RemoveSourceBranch: boolPtr(config.RemoveBranch),
+		Squash:             boolPtr(config.SquashCommits),
+		AllowCollaboration: config.AllowCollaboration,
+	}
+
+	if err := setUpdateMetadata(ctx, client, config, existingMR, updateRequest); err != nil {
+		return nil, err
+	}
+
+	if err := updateMR(ctx, client, config, existingMR.IID, updateRequest); err != nil {
+		return nil, fmt.Errorf("failed to update MR: %w", err)
+	}
+
+	fmt.Printf("Updated existing MR %s (IID: %d)\n", title, existingMR.IID)
+	printMRURL(existingMR)
+
+	// GitLab leaves auto-merge set on an MR that goes back to draft, ready to
+	// merge as soon as someone marks it ready again. --draft is meant to stop
+	// the merge, so the pending one is withdrawn. A draft --commit-prefix, the
+	// default, is not: it is on every plain update, asked for or not.
+	if existingMR.MergeWhenPipelineSucceeds && config.Draft {
+		err := cancelAutoMerge(ctx, client, config, existingMR.IID)
+		switch {
+		case errors.Is(err, errNothingToCancel):
+		case err != nil:
+			return nil, fmt.Errorf("MR is a draft now, but its auto-merge could not be canceled: %w", err)
+		default:
+			fmt.Printf("Canceled auto-merge for MR (IID: %d), it is a draft now\n", existingMR.IID)
+		}
+	}
+
+	return existingMR, nil
+}
+
+// setUpdateMetadata fills in the milestone and labels of an update.
+//
+// Labels from --label or the issue replace the MR's labels, as they always
+// have, unless --label-mode merge asks to keep them. The labels derived from
+// the changes, and in merge mode all of them, go through add_labels instead,
+// so the MR's other labels stay; remove_labels then takes out the MR's labels
+// they supersede within a scope, which GitLab only does by itself for scoped
+// labels on Premium.
+func setUpdateMetadata(
+	ctx context.Context, client *http.Client, config *Config, existingMR *MergeRequest, request *MRUpdateRequest,
+) error {
+	if err := resolveMilestone(ctx, client, config); err != nil {
+		return err
+	}
+
+	var labels []string
+	request.MilestoneID, labels = resolveMRMetadata(ctx, client, config)
+
+	all, err := ensureLabels(ctx, client, config, orderLabels(config, labels, labelsFromChanges(ctx, client, config)))
+	if err != nil {
+		return err
+	}
+
+	if len(labels) > 0 && config.LabelMode != labelModeMerge {
+		request.Labels = all
+		return nil
+	}
+
+	request.AddLabels = all
+	request.RemoveLabels = supersededLabels(existingMR.Labels, request.AddLabels)
+	return nil
+}
+
+// orderLabels puts the labels derived from the changes right after the --label
+// values and ahead of the issue's labels, which resolveMRMetadata returned in
+// labels after the --label values. Of two labels in one scope the first wins,
+// so a --label value still beats a derived label, and a derived one the issue's.
+func orderLabels(config *Config, labels, derived []string) []string {
+	return mergeLabels(mergeLabels(config.Labels, derived), labels)
+}
+
+// supersededLabels lists the existing labels that adding added replaces: those
+// in the scope of an added scoped label, other than that label itself.
+func supersededLabels(existing, added []string) []string {
+	scopes := map[string]bool{}
+	for _, label := range added {
+		if scope := labelScope(label); scope != "" {
+			scopes[scope] = true
+		}
+	}
+
+	var superseded []string
+	for _, label := range existing {
+		if scopes[labelScope(label)] && !slices.Contains(added, label) {
+			superseded = append(superseded, label)
+		}
+	}
+	return superseded
+}
+
+// labelScope returns the scope of a scoped label, the part before its last ::
+// as GitLab reads it, or "" for a label without one.
+func labelScope(label string) string {
+	if i := strings.LastIndex(label, "::"); i > 0 {
+		return label[:i]
+	}
+	return ""
+}
+
+func handleCreateMR(
+	ctx context.Context, client *http.Client, config *Config,
+	title, description string,
+) (*MergeRequest, error) {
+	mrRequest := &MRCreateRequest{
+		SourceBranch:       config.SourceBranch,
+		TargetBranch:       config.TargetBranch,
+		Title:              title,
+		Description:        description,
+		AssigneeIDs:        config.UserIDs,
+		ReviewerIDs:        config.ReviewerIDs,
+		RemoveSourceBranch: config.RemoveBranch,
+		Squash:             config.SquashCommits,
+		AllowCollaboration: config.AllowCollaboration,
+	}
+
+	if err := resolveMilestone(ctx, client, config); err != nil {
+		return nil, err
+	}
+
+	mrRequest.MilestoneID, mrRequest.Labels = resolveMRMetadata(ctx, client, config)
+	labels, err := ensureLabels(ctx, client, config,
+		orderLabels(config, mrRequest.Labels, labelsFromChanges(ctx, client, config)))
+	if err != nil {
+		return nil, err
+	}
+	mrRequest.Labels = labels
+
+	createdMR, err := createMR(ctx, client, config, mrRequest)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create MR: %w", err)
+	}
+
+	fmt.Printf("Created a new MR %s, assigned to you.\n", title)
+	printMRURL(createdMR)
+	return createdMR, nil
+}
+
+// resolveMRMetadata determines the milestone and labels for the MR, combining
+// what was given on the command line with what the linked issue carries.
+//
+// --milestone wins over the issue's milestone; labels are the union of the two,
+// with --label values first. A failure to fetch the issue is a warning, not an
+// error: the MR is still worth creating without its issue metadata.
+func resolveMRMetadata(ctx context.Context, client *http.Client, config *Config) (int, []string) {
+	milestoneID := config.MilestoneID
+	labels := config.Labels
+
+	if !config.UseIssueName {
+		return milestoneID, labels
+	}
+
+	issue, err := getIssueData(ctx, client, config)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: failed to fetch issue data: %v\n", err)
+		return milestoneID, labels
+	}
+
+	if milestoneID == 0 {
+		milestoneID = issue.Milestone.ID
+	}
+
+	return milestoneID, mergeLabels(labels, issue.Labels)
+}
+
+// resolveMilestone turns a --milestone given by title, or as active, into the
+// milestone's ID. Both are looked up among the active milestones of the project
+// and its groups; active picks the one whose dates cover today, the one due
+// first if several do. A milestone that cannot be found fails the run, since
+// the MR would otherwise quietly go without it.
+func resolveMilestone(ctx context.Context, client *http.Client, config *Config) error {
+	if config.Milestone == "" {
+		return nil
+	}
+
+	milestones, err := listActiveMilestones(ctx, client, config)
+	if err != nil {
+		return fmt.Errorf("unable to list milestones for --milestone %s: %w", config.Milestone, err)
+	}
+
+	var found *Milestone
+	title, byTitle := strings.CutPrefix(config.Milestone, milestoneTitlePrefix)
+	if !byTitle && title == milestoneActive {
+		found = currentMilestone(milestones, time.Now())
+		if found == nil {
+			return fmt.Errorf("--milestone %s: no active milestone has dates covering today", milestoneActive)
+		}
+	} else {
+		for i := range milestones {
+			if milestones[i].Title == title {
+				found = &milestones[i]
+				break
+			}
+		}
+		if found == nil {
+			return fmt.Errorf("--milestone %q: no active milestone has that title", title)
+		}
+	}
+
+	fmt.Printf("Milestone: %s (ID: %d)\n", found.Title, found.ID)
+	config.MilestoneID, config.Milestone = found.ID, ""
+	return nil
+}
+
+// currentMilestone returns the milestone whose dates cover now, the one due
+// first if several do. A milestone without a due date never does: it would
+// cover every day from its start on. A missing start date reaches back
+// indefinitely.
+func currentMilestone(milestones []Milestone, now time.Time) *Milestone {
+	today := now.Format(time.DateOnly)
+
+	var current *Milestone
+	for i := range milestones {
+		milestone := &milestones[i]
+		if milestone.DueDate == "" || milestone.DueDate < today ||
+			(milestone.StartDate != "" && milestone.StartDate > today) {
+			continue
+		}
+		if current == nil || milestone.DueDate < current.DueDate {
+			current = milestone
+		}
+	}
+
+	return current
+}
+
+// listActiveMilestones lists the active milestones of the project and its
+// groups, every page of them.
+func listActiveMilestones(ctx context.Context, client *http.Client, config *Config) ([]Milestone, error) {
+	return listAll[Milestone](ctx, client, config,
+		fmt.Sprintf("projects/%d/milestones?state=active&include_ancestors=true", config.ProjectID))
+}
+
+// ensureLabels checks the labels against those of the project and its groups,
+// as --missing-labels asks. A label that exists under another case is sent
+// spelled the way it exists, since GitLab would otherwise create a second
+// label next to the group's. A missing label fails the run, or is created with
+// its --label-definitions color and description.
+func ensureLabels(ctx context.Context, client *http.Client, config *Config, labels []string) ([]string, error) {
+	if config.MissingLabels == "" || len(labels) == 0 {
+		return labels, nil
+	}
+
+	resolved := make([]string, 0, len(labels))
+	var missing []string
+
+	for _, name := range labels {
+		existing, err := findLabel(ctx, client, config, name)
+		if err != nil {
+			return nil, fmt.Errorf("unable to look up label %q: %w", name, err)
+		}
+
+		switch {
+		case existing != "":
+			if existing != name {
+				fmt.Printf("Using the existing label %q for %q\n", existing, name)
+			}
+			resolved = append(resolved, existing)
+		case config.MissingLabels == missingLabelsCreate:
+			if err := createLabel(ctx, client, config, labelDefinition(config, name)); err != nil {
+				return nil, fmt.Errorf("unable to create label %q: %w", name, err)
+			}
+			resolved = append(resolved, name)
+		default:
+			missing = append(missing, name)
+		}
+	}
+
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("labels not found in the project or its groups: %s; "+
+			"pass --missing-labels %s to create them", strings.Join(missing, ", "), missingLabelsCreate)
+	}
+
+	return mergeLabels(resolved, nil), nil
+}
+
+// labelDefinition returns how to create the label: its entry in the
+// --label-definitions file, or the default color.
+func labelDefinition(config *Config, name string) *LabelDefinition {
+	for _, definition := range config.LabelDefinitions {
+		if definition.Name == name {
+			return &definition
+		}
+	}
+	return &LabelDefinition{Name: name, Color: defaultLabelColor}
+}
+
+// findLabel returns the name of the project or group label called name, an
+// exact match before one differing only in case, or "" when there is none.
+func findLabel(ctx context.Context, client *http.Client, config *Config, name string) (string, error) {
+	query := url.Values{"search": {name}, "include_ancestor_groups": {"true"}, "per_page": {"100"}}
+	body, err := doRequest(ctx, client, config, http.MethodGet,
+		fmt.Sprintf("projects/%d/labels?%s", config.ProjectID, query.Encode()), nil)
+	if err != nil {
+		return "", err
+	}
+
+	var labels []Label
+	if err := json.Unmarshal(body, &labels); err != nil {
+		return "", err
+	}
+
+	found := ""
+	for _, label := range labels {
+		if label.Name == name {
+			return label.Name, nil
+		}
+		if found == "" && strings.EqualFold(label.Name, name) {
+			found = label.Name
+		}
+	}
+
+	return found, nil
+}
+
+// createLabel creates a project label. One created in the meantime, which
+// GitLab answers with 409, is just as good.
+func createLabel(ctx context.Context, client *http.Client, config *Config, definition *LabelDefinition) error {
+	_, err := doRequest(ctx, client, config, http.MethodPost,
+		fmt.Sprintf("projects/%d/labels", config.ProjectID), definition)
+
+	var apiErr *apiError
+	if errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusConflict {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Created label %q (%s)\n", definition.Name, definition.Color)
+	return nil
+}
+
+// labelsFromChanges works out the labels the branch's changes against the
+// target branch call for: the --path-label labels and the --size-labels size.
+// A failure to compare is a warning: the MR is still worth creating or
+// updating without these labels.
+func labelsFromChanges(ctx context.Context, client *http.Client, config *Config) []string {
+	if len(config.PathLabels) == 0 && !config.SizeLabels {
+		return nil
+	}
+
+	comparison, err := compareRefs(ctx, client, config, config.TargetBranch, config.SourceBranch)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: could not compare %s with %s, labels from the changes are skipped: %v\n",
+			config.SourceBranch, config.TargetBranch, err)
+		return nil
+	}
+
+	labels := labelsFromPaths(config, comparison.paths())
+	if config.SizeLabels {
+		labels = append(labels, sizeLabel(config, comparison.Diffs))
+	}
+
+	return labels
+}
+
+// labelsFromPaths returns the --path-label labels whose globs match one of the
+// changed paths, in flag order.
+func labelsFromPaths(config *Config, paths []string) []string {
+	var labels []string
+	for _, mapping := range config.PathLabels {
+		if slices.Contains(labels, mapping.Label) {
+			continue
+		}
+		for _, changed := range paths {
+			if matchPathGlob(mapping.Pattern, changed) {
+				labels = append(labels, mapping.Label)
+				break
+			}
+		}
+	}
+
+	if len(labels) > 0 {
+		fmt.Printf("Labels from changed paths: %s\n", strings.Join(labels, ", "))
+	}
+	return labels
+}
+
+// sizeLabel picks the size label for the changes: the first size whose
+// threshold the changed lines stay under, or XL. Generated files, and files
+// matching --size-exclude, do not count. A counted file whose diff GitLab left
+// out makes the changes at least L.
+func sizeLabel(config *Config, diffs []FileDiff) string {
+	added, removed, files, excluded := 0, 0, 0, 0
+	var omitted []string
+	for _, diff := range diffs {
+		if diff.GeneratedFile || slices.ContainsFunc(config.SizeExclude, func(pattern string) bool {
+			return matchPathGlob(pattern, diff.NewPath) || matchPathGlob(pattern, diff.OldPath)
+		}) {
+			excluded++
+			continue
+		}
+
+		files++
+		if diff.TooLarge || diff.Collapsed {
+			omitted = append(omitted, diff.NewPath)
+		}
+		for _, line := range strings.Split(diff.Diff, "\n") {
+			switch {
+			case strings.HasPrefix(line, "+"):
+				added++
+			case strings.HasPrefix(line, "-"):
+				removed++
+			}
+		}
+	}
+
+	index := len(sizeNames) - 1
+	for i, threshold := range config.SizeThresholds {
+		if added+removed < threshold {
+			index = i
+			break
+		}
+	}
+	if len(omitted) > 0 && index < omittedDiffSize {
+		index = omittedDiffSize
+		fmt.Fprintf(os.Stderr, "Warning: GitLab leaves out the diff of %s as too large, so the size is at least %s\n",
+			abbreviateList(omitted, 5), sizeNames[index])
+	}
+	size := sizeNames[index]
+
+	fmt.Printf("Size: %s, %d line(s) added and %d removed in %d file(s), %d file(s) not counted\n",
+		size, added, removed, files, excluded)
+	return sizeLabelScope + size
+}
+
+// matchPathGlob reports whether the slash-separated name matches pattern. A
+// ** segment stands for any number of whole directories, none included; every
+// other segment is matched as path.Match does, so * stays within one directory
+// and a pattern without a slash matches only top-level files.
+func matchPathGlob(pattern, name string) bool {
+	return matchGlobSegments(strings.Split(pattern, "/"), strings.Split(name, "/"))
+}
+
+// matchesAnyGlob reports whether name matches any of the path globs.
+func matchesAnyGlob(patterns []string, name string) bool {
+	return slices.ContainsFunc(patterns, func(pattern string) bool {
+		return matchPathGlob(pattern, name)
+	})
+}
+
+func matchGlobSegments(pattern, name []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := len(name); i >= 0; i-- {
+				if matchGlobSegments(pattern[1:], name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+
+		if len(name) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pattern[0], name[0]); !ok {
+			return false
+		}
+		pattern, name = pattern[1:], name[1:]
+	}
+
+	return len(name) == 0
+}
+
+// mergeLabels appends the labels from extra that are not already in base,
+// preserving the order of both and never returning a non-nil empty slice
+// (MRCreateRequest.Labels is omitempty, and an empty list would clear labels).
+//
+// A scoped label holds one value per scope, and GitLab resolves two in one
+// request unpredictably, so only the first label of each scope is kept: a
+// --label value wins over an issue's label in the same scope.
+func mergeLabels(base, extra []string) []string {
+	seen := make(map[string]struct{}, len(base)+len(extra))
+	scopes := make(map[string]struct{})
+	merged := make([]string, 0, len(base)+len(extra))
+
+	for _, group := range [][]string{base, extra} {
+		for _, label := range group {
+			if _, ok := seen[label]; ok {
+				continue
+			}
+			if scope := labelScope(label); scope != "" {
+				if _, taken := scopes[scope]; taken {
+					continue
+				}
+				scopes[scope] = struct{}{}
+			}
+			seen[label] = struct{}{}
+			merged = append(merged, label)
+		}
+	}
+
+	if len(merged) == 0 {
+		return nil
+	}
+	return merged
+}
+
+// printMRURL writes the MR's browser URL so it can be clicked straight out of a
+// CI job log. The URL comes from the API response rather than being assembled
+// locally: --gitlab-url is only the instance host, so the project path with its
+// namespace is not knowable here. Nothing is printed if GitLab omitted web_url.
+func printMRURL(mr *MergeRequest) {
+	if mr == nil || mr.WebURL == "" {
+		return
+	}
+	fmt.Printf("MR URL: %s\n", mr.WebURL)
+}
+
+// enableAutoMerge sets the MR to merge once its pipeline succeeds, pinned to
+// mr.SHA — the head this run created, updated, rebased or found the MR at — so
+// a push that lands in between is not merged along with it.
+func enableAutoMerge(ctx context.Context, client *http.Client, config *Config, mr *MergeRequest) error {
+	if mr == nil || mr.IID == 0 {
+		fmt.Println("Warning: could not determine MR IID, skipping auto-merge")
+		return nil
+	}
+
+	// Looked up here rather than in acceptMR so the request shape is settled
+	// before the first merge-related call, not in the middle of them.
+	gitlabServer(ctx, client, config)
+
+	if err := waitMergeable(ctx, client, config, mr); err != nil {
+		return fmt.Errorf("failed to enable auto-merge: %w", err)
+	}
+
+	if err := acceptMR(ctx, client, config, mr.IID, mr.SHA); err != nil {
+		return fmt.Errorf("failed to enable auto-merge: %w", err)
+	}
+
+	fmt.Printf("Auto-merge enabled for MR (IID: %d)%s\n", mr.IID, shaSuffix(mr.SHA))
+	return nil
+}
+
+// shaSuffix renders " at <short sha>" when the SHA is known.
+func shaSuffix(sha string) string {
+	if sha == "" {
+		return ""
+	}
+	return " at " + shortSHA(sha)
+}
+
+// disableAutoMerge cancels the MR's pending auto-merge. An MR without one is
+// already where --cancel-auto-merge wants it, so that is reported, not failed.
+func disableAutoMerge(ctx context.Context, client *http.Client, config *Config, mr *MergeRequest) error {
+	if mr == nil || mr.IID == 0 {
+		fmt.Println("Warning: could not determine MR IID, skipping auto-merge cancellation")
+		return nil
+	}
+
+	err := cancelAutoMerge(ctx, client, config, mr.IID)
+	switch {
+	case errors.Is(err, errNothingToCancel):
+		fmt.Printf("Auto-merge is not set for MR (IID: %d), nothing to cancel\n", mr.IID)
+		return nil
+	case err != nil:
+		return fmt.Errorf("failed to cancel auto-merge: %w", err)
+	}
+
+	fmt.Printf("Auto-merge canceled for MR (IID: %d)\n", mr.IID)
+	return nil
+}
+
+// addToMergeTrain puts the MR on its target branch's merge train once its
+// pipeline succeeds, pinned to mr.SHA like auto-merge, and reports where on the
+// train it ended up.
+//
+// It goes through the same mergeability wait as --auto-merge: the train refuses
+// an MR GitLab is still checking for the same reasons the merge endpoint does.
+func addToMergeTrain(ctx context.Context, client *http.Client, config *Config, mr *MergeRequest) error {
+	if mr == nil || mr.IID == 0 {
+		fmt.Println("Warning: could not determine MR IID, skipping merge train")
+		return nil
+	}
+
+	server := gitlabServer(ctx, client, config)
+	if !server.supports(featureMergeTrainsAPI) {
+		return fmt.Errorf("failed to add to merge train: the merge trains API needs GitLab 15.11 or later, " +
+			"use --auto-merge instead, which joins the train on projects that have one")
+	}
+
+	if err := waitMergeable(ctx, client, config, mr); err != nil {
+		return fmt.Errorf("failed to add to merge train: %w", err)
+	}
+
+	if err := postMergeTrain(ctx, client, config, mr); err != nil {
+		return fmt.Errorf("failed to add to merge train: %w", err)
+	}
+
+	// The MR is on the train, or queued for it, either way from here on; what
+	// follows only decides how that is reported.
+	position, length, err := mergeTrainPosition(ctx, client, config, mr.IID)
+	switch {
+	case err != nil:
+		fmt.Printf("Added MR (IID: %d) to the merge train for %s\n", mr.IID, config.TargetBranch)
+		fmt.Fprintf(os.Stderr, "Warning: could not read the merge train: %v\n", err)
+	case position == 0:
+		fmt.Printf("MR (IID: %d) will join the merge train for %s when its pipeline succeeds\n",
+			mr.IID, config.TargetBranch)
+	default:
+		fmt.Printf("Added MR (IID: %d) to the merge train for %s, position %d of %d\n",
+			mr.IID, config.TargetBranch, position, length)
+	}
+
+	return nil
+}
+
+// postMergeTrain asks for the MR to be added to the train. When its pipeline
+// has not succeeded yet, GitLab queues the addition instead of refusing it.
+func postMergeTrain(ctx context.Context, client *http.Client, config *Config, mr *MergeRequest) error {
+	request := &MergeTrainAddRequest{
+		WhenPipelineSucceeds: true,
+		SHA:                  mr.SHA,
+		Squash:               config.SquashCommits,
+	}
+
+	_, err := doRequest(ctx, client, config, http.MethodPost,
+		fmt.Sprintf("projects/%d/merge_trains/merge_requests/%d", config.ProjectID, mr.IID), request)
+
+	var apiErr *apiError
+	if errors.As(err, &apiErr) {
+		switch apiErr.StatusCode {
+		case http.StatusConflict:
+			return errBranchMoved
+		case http.StatusBadRequest:
+			return fmt.Errorf("GitLab refused to add the MR to the merge train: %s", apiErr.Body)
+		}
+	}
+
+	return err
+}
+
+// mergeTrainPosition returns the MR's 1-based place on its target branch's
+// active merge train and the train's length, or 0 when it is not on it.
+func mergeTrainPosition(
+	ctx context.Context, client *http.Client, config *Config, mrIID int,
+) (position, length int, err error) {
+	params := url.Values{}
+	params.Set("scope", "active")
+	params.Set("sort", "asc")
+	params.Set("per_page", "100")
+
+	body, err := doRequest(ctx, client, config, http.MethodGet,
+		fmt.Sprintf("projects/%d/merge_trains/%s?%s",
+			config.ProjectID, url.PathEscape(config.TargetBranch), params.Encode()), nil)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var cars []MergeTrainCar
+	if err := json.Unmarshal(body, &cars); err != nil {
+		return 0, 0, err
+	}
+
+	for i := range cars {
+		if cars[i].MergeRequest.IID == mrIID {
+			return i + 1, len(cars), nil
+		}
+	}
+
+	return 0, len(cars), nil
+}
+
+// leaveMergeTrain takes the MR off the merge train. GitLab has no endpoint of
+// the train's own for this: leaving the train is canceling auto-merge, which
+// also withdraws an addition still waiting for its pipeline.
+func leaveMergeTrain(ctx context.Context, client *http.Client, config *Config, mr *MergeRequest) error {
+	if mr == nil || mr.IID == 0 {
+		fmt.Println("Warning: could not determine MR IID, skipping merge train removal")
+		return nil
+	}
+
+	err := cancelAutoMerge(ctx, client, config, mr.IID)
+	switch {
+	case errors.Is(err, errNothingToCancel):
+		fmt.Printf("MR (IID: %d) is not on the merge train, nothing to remove\n", mr.IID)
+		return nil
+	case err != nil:
+		return fmt.Errorf("failed to remove MR from the merge train: %w", err)
+	}
+
+	fmt.Printf("Removed MR (IID: %d) from the merge train for %s\n", mr.IID, config.TargetBranch)
+	return nil
+}
+
+// pendingMergeStatuses are the detailed_merge_status values GitLab reports while
+// it is still working out whether an MR can be merged. They settle on their own
+// within seconds of a create or a push.
+var pendingMergeStatuses = map[string]bool{
+	"unchecked":         true,
+	"checking":          true,
+	"preparing":         true,
+	"approvals_syncing": true,
+}
+
+// mergeBlockers are the detailed_merge_status values that will not change by
+// waiting, each with what stands in the way. Statuses missing from both maps —
+// mergeable, the CI ones auto-merge exists to wait on, and any GitLab adds
+// later — are left for the merge endpoint to judge.
+var mergeBlockers = map[string]string{
+	"conflict":                   "it has conflicts with the target branch, resolve them or rebase",
+	"need_rebase":                "the target branch requires a rebase first, pass --rebase",
+	"discussions_not_resolved":   "it has unresolved threads",
+	"not_approved":               "it does not have the approvals it requires",
+	"requested_changes":          "a reviewer requested changes",
+	"draft_status":               "it is a draft, pass --ready to mark it ready",
+	"not_open":                   "it is not open",
+	"blocked_status":             "it is blocked by another merge request",
+	"merge_request_blocked":      "it is blocked by another merge request",
+	"commits_status":             "its source branch is missing or has no commits",
+	"jira_association_missing":   "its title or description does not reference a Jira issue",
+	"title_regex":                "its title does not match the project's required pattern",
+	"locked_paths":               "it touches paths locked by another user",
+	"locked_lfs_files":           "it touches LFS files locked by another user",
+	"security_policy_violations": "it violates a security policy",
+}
+
+// waitMergeable holds auto-merge back until GitLab has settled on whether the MR
+// can be merged. Right after a create or update its detailed_merge_status is
+// still "checking" and the pipeline may not exist yet, and the merge endpoint
+// answers 405 to both — which used to be the first thing many runs reported.
+//
+// A status that will not resolve by waiting fails with its own reason instead of
+// the merge endpoint's generic 405. With --trigger-pipeline the wait also covers
+// the pipeline just requested: accepting before it is the MR's head pipeline
+// would merge on the result of an older one, or of none.
+//
+// Not being able to read the status fails the run, since the merge would
+// otherwise go ahead on checks that were never made. GitLab releases before
+// 15.6 do not report detailed_merge_status at all, and on those the wait is
+// skipped outright.
+func waitMergeable(ctx context.Context, client *http.Client, config *Config, target *MergeRequest) error {
+	if !config.server.supports(featureDetailedMergeStatus) {
+		return nil
+	}
+
+	var status string
+	var blocked error
+
+	err := poll(ctx, pollInterval(config), mergeabilityTimeout, func() (bool, error) {
+		mr, err := getMR(ctx, client, config, target.IID, nil)
+		if err != nil {
+			return false, err
+		}
+
+		// The merge would be refused for it anyway; saying so now spares the
+		// rest of the wait.
+		if target.SHA != "" && mr.SHA != "" && mr.SHA != target.SHA {
+			blocked = errBranchMoved
+			return true, nil
+		}
+
+		status = mr.DetailedMergeStatus
+		if reason, ok := mergeBlockers[status]; ok {
+			blocked = fmt.Errorf("merge request cannot be merged, %s (status: %s)", reason, status)
+			return true, nil
+		}
+
+		if config.TriggerPipeline && !isRequestedPipeline(mr.HeadPipeline, target) {
+			status = "waiting for the requested pipeline to be the head pipeline"
+			return false, nil
+		}
+
+		return !pendingMergeStatuses[status], nil
+	})
+
+	switch {
+	case errors.Is(err, errWaitTimeout):
+		return fmt.Errorf("merge request is still not ready to merge after %s (status: %s)",
+			mergeabilityTimeout, status)
+	case ctx.Err() != nil:
+		return ctx.Err()
+	case err != nil:
+		return fmt.Errorf("could not check whether MR (IID: %d) can be merged: %w", target.IID, err)
+	}
+
+	return blocked
+}
+
+// isRequestedPipeline reports whether head, the MR's head pipeline, is the one
+// --trigger-pipeline asked for: target.HeadPipeline, the pipeline it created or
+// found, or a later one. When that pipeline is not known, a head pipeline for
+// the head commit has to do.
+func isRequestedPipeline(head *Pipeline, target *MergeRequest) bool {
+	switch {
+	case head == nil:
+		return false
+	case target.HeadPipeline != nil && target.HeadPipeline.ID != 0:
+		return head.ID >= target.HeadPipeline.ID
+	case target.SHA != "":
+		return head.SHA == target.SHA
+	}
+	return true
+}
+
+// rebaseMR rebases the MR's source branch onto its target and waits for GitLab
+// to finish, updating mr.SHA to the rebased head. Projects that merge by
+// fast-forward refuse to merge a branch that is behind, which is what makes
+// auto-merge answer 405/406 without it.
+//
+// A branch that is not behind is left alone: a rebase would rewrite it for
+// nothing and start another pipeline.
+func rebaseMR(ctx context.Context, client *http.Client, config *Config, mr *MergeRequest) error {
+	if mr.IID == 0 {
+		fmt.Println("Warning: could not determine MR IID, skipping rebase")
+		return nil
+	}
+
+	current, err := getMR(ctx, client, config, mr.IID, url.Values{"include_diverged_commits_count": {"true"}})
+	if err != nil {
+		return err
+	}
+	if current.DivergedCommitsCount == 0 {
+		fmt.Printf("MR (IID: %d) is up to date with %s, no rebase needed\n", mr.IID, current.TargetBranch)
+		return nil
+	}
+
+	_, err = doRequest(ctx, client, config, http.MethodPut,
+		fmt.Sprintf("projects/%d/merge_requests/%d/rebase", config.ProjectID, mr.IID), nil)
+	var apiErr *apiError
+	if errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusForbidden {
+		return fmt.Errorf("forbidden, the token owner needs push access to the source branch to rebase it")
+	}
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Rebasing MR (IID: %d) onto %s, %d commit(s) behind\n",
+		mr.IID, current.TargetBranch, current.DivergedCommitsCount)
+
+	// GitLab keeps merge_error from an earlier merge or rebase attempt after a
+	// later rebase succeeds, so only an error this rebase left counts.
+	staleError, staleSHA := current.MergeError, current.SHA
+
+	err = poll(ctx, pollInterval(config), rebaseTimeout, func() (bool, error) {
+		current, err = getMR(ctx, client, config, mr.IID, url.Values{"include_rebase_in_progress": {"true"}})
+		if err != nil {
+			return false, err
+		}
+		return !current.RebaseInProgress, nil
+	})
+	if errors.Is(err, errWaitTimeout) {
+		return fmt.Errorf("rebase still in progress after %s", rebaseTimeout)
+	}
+	if err != nil {
+		return err
+	}
+
+	// GitLab reports a failed rebase, conflicts included, only through
+	// merge_error once the rebase is no longer in progress: a new message, or
+	// the old one again on a head the rebase did not move.
+	if current.MergeError != "" && (current.MergeError != staleError || current.SHA == staleSHA) {
+		return fmt.Errorf("rebase onto %s failed, the branch may conflict with it: %s",
+			current.TargetBranch, current.MergeError)
+	}
+
+	mr.SHA = current.SHA
+	fmt.Printf("Rebased MR (IID: %d), head is now %s\n", mr.IID, shortSHA(mr.SHA))
+	return nil
+}
+
+// triggerMRPipeline asks GitLab to create a merge request pipeline for an
+// existing MR, and returns the pipeline created or the existing one it left
+// alone — nil when neither is known.
+//
+// GitLab does not start one on its own when an MR is created through the API
+// for a commit that already has a branch pipeline. A CI configuration whose
+// jobs run only on `merge_request_event` would therefore never see the MR, and
+// the missing checks are easy to mistake for passing ones.
+//
+// The call runs for updated MRs as well as new ones, because a moved branch is
+// exactly when the checks are worth re-running. To keep that from producing a
+// pipeline per job run, an existing pipeline for the same commit is left alone
+// unless --force-pipeline says otherwise.
+func triggerMRPipeline(
+	ctx context.Context, client *http.Client, config *Config, mr *MergeRequest,
+) (*Pipeline, error) {
+	if mr == nil || mr.IID == 0 {
+		fmt.Println("Warning: could not determine MR IID, skipping pipeline trigger")
+		return nil, nil
+	}
+
+	if !config.ForcePipeline {
+		existing, err := findPipelineForSHA(ctx, client, config, mr)
+		if err != nil {
+			// Not being able to list pipelines is no reason to skip creating one;
+			// the worst case is the duplicate this check exists to avoid.
+			fmt.Fprintf(os.Stderr, "Warning: could not check for existing pipelines: %v\n", err)
+		} else if existing != nil {
+			if config.RetryFailed && existing.Status == pipelineStatusFailed {
+				return retryFailedPipeline(ctx, client, config, existing)
+			}
+			fmt.Printf(
+				"Merge request pipeline already exists for commit %s (ID: %d, status: %s)%s\n",
+				shortSHA(mr.SHA), existing.ID, existing.Status, urlSuffix(existing.WebURL),
+			)
+			fmt.Println("Skipping pipeline creation; pass --force-pipeline to create another.")
+			return existing, nil
+		}
+	}
+
+	body, err := createMRPipeline(ctx, client, config, mr)
+	if err != nil {
+		return nil, err
+	}
+
+	// The pipeline already exists at this point, so a response we cannot read is
+	// worth a warning but must not fail the run: the body is only used to tell
+	// the user what was created.
+	var pipeline Pipeline
+	if err := json.Unmarshal(body, &pipeline); err != nil {
+		fmt.Printf("Warning: merge request pipeline created but response could not be read: %v\n", err)
+		return nil, nil
+	}
+
+	fmt.Printf(
+		"Merge request pipeline created (ID: %d, status: %s)%s\n",
+		pipeline.ID, pipeline.Status, urlSuffix(pipeline.WebURL),
+	)
+	if len(config.PipelineVariables) > 0 {
+		fmt.Printf("Pipeline variables: %s\n", pipelineVariableKeys(config.PipelineVariables))
+	}
+	return &pipeline, nil
+}
+
+// createMRPipeline sends the request that creates the MR's pipeline. The merge
+// request pipelines endpoint takes no variables, so a run that passes some
+// creates the pipeline through the pipelines API instead, on the ref GitLab
+// keeps for the MR's head.
+func createMRPipeline(ctx context.Context, client *http.Client, config *Config, mr *MergeRequest) ([]byte, error) {
+	var body []byte
+	var err error
+
+	if len(config.PipelineVariables) == 0 {
+		body, err = doRequest(ctx, client, config, http.MethodPost,
+			fmt.Sprintf("projects/%d/merge_requests/%d/pipelines", config.ProjectID, mr.IID), nil)
+	} else {
+		body, err = doRequest(ctx, client, config, http.MethodPost,
+			fmt.Sprintf("projects/%d/pipeline", config.ProjectID),
+			&PipelineCreateRequest{Ref: mrHeadRef(mr.IID), Variables: config.PipelineVariables})
+	}
+
+	var apiErr *apiError
+	if errors.As(err, &apiErr) {
+		switch apiErr.StatusCode {
+		case http.StatusForbidden:
+			return nil, fmt.Errorf(
+				"forbidden, the token owner needs at least the Developer role on the project " +
+					"to create pipelines",
+			)
+		case http.StatusBadRequest:
+			return nil, fmt.Errorf(
+				"GitLab refused to create the pipeline, "+
+					"the CI configuration may define no jobs for merge request pipelines: %s",
+				apiErr.Body,
+			)
+		}
+	}
+
+	return body, err
+}
+
+// mrHeadRef is the ref GitLab keeps pointing at an MR's head commit.
+func mrHeadRef(mrIID int) string {
+	return fmt.Sprintf("refs/merge-requests/%d/head", mrIID)
+}
+
+// pipelineVariableKeys lists the variables by key only, for the log: their
+// values may be secrets.
+func pipelineVariableKeys(variables []PipelineVariable) string {
+	keys := make([]string, len(variables))
+	for i, variable := range variables {
+		keys[i] = variable.Key
+	}
+	return strings.Join(keys, ", ")
+}
+
+// findPipelineForSHA returns the MR's existing merge request pipeline for its
+// head commit, or nil when there is none.
+//
+// The endpoint lists every pipeline attached to the MR, branch pipelines
+// included — the docs' own example shows a plain branch ref. Matching on the
+// commit alone would therefore match the branch pipeline that is usually
+// running this very job, and skipping on that would mean never creating the
+// merge request pipeline this tool exists to create. Only the MR's own
+// pipelines count, as isMRPipeline tells them apart.
+//
+// With an unknown head SHA there is nothing to compare against, so it reports
+// no match and the caller creates a pipeline: a duplicate is a better outcome
+// than silently skipping the checks.
+func findPipelineForSHA(
+	ctx context.Context, client *http.Client, config *Config, mr *MergeRequest,
+) (*Pipeline, error) {
+	if mr.SHA == "" {
+		return nil, nil
+	}
+
+	pipelines, err := listMRPipelines(ctx, client, config, mr.IID)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range pipelines {
+		if isMRPipeline(&pipelines[i], mr.IID) && pipelines[i].SHA == mr.SHA {
+			return &pipelines[i], nil
+		}
+	}
+
+	return nil, nil
+}
+
+// retryRestartTimeout bounds the wait for a retried pipeline to leave the
+// failed status. GitLab updates it in the background, usually within seconds.
+const retryRestartTimeout = time.Minute
+
+// retryFailedPipeline reruns the failed jobs of the MR's failed pipeline for the
+// head commit, instead of skipping it or creating a pipeline that reruns every
+// job. With --retry-job only the failed jobs matching a pattern are retried, one
+// by one; otherwise the pipeline retry API retries all of them at once.
+func retryFailedPipeline(
+	ctx context.Context, client *http.Client, config *Config, pipeline *Pipeline,
+) (*Pipeline, error) {
+	if len(config.RetryJobs) == 0 {
+		if err := retryPipeline(ctx, client, config, pipeline.ID); err != nil {
+			return nil, fmt.Errorf("unable to retry pipeline %d: %w", pipeline.ID, err)
+		}
+		fmt.Printf("Retrying the failed jobs of pipeline %d for commit %s%s\n",
+			pipeline.ID, shortSHA(pipeline.SHA), urlSuffix(pipeline.WebURL))
+		waitPipelineRestarted(ctx, client, config, pipeline.ID)
+		return pipeline, nil
+	}
+
+	jobs, err := getFailedJobs(ctx, client, config, pipeline.ID)
+	if err != nil {
+		return nil, fmt.Errorf("unable to list the failed jobs of pipeline %d: %w", pipeline.ID, err)
+	}
+
+	var retried []string
+	for _, job := range jobs {
+		if !matchesAnyPattern(config.RetryJobs, job.Name) {
+			continue
+		}
+		if err := retryJob(ctx, client, config, job.ID); err != nil {
+			return nil, fmt.Errorf("unable to retry job %s of pipeline %d: %w", job.Name, pipeline.ID, err)
+		}
+		retried = append(retried, job.Name)
+	}
+
+	if len(retried) == 0 {
+		fmt.Printf("Pipeline %d for commit %s failed, but none of its failed jobs match --retry-job%s\n",
+			pipeline.ID, shortSHA(pipeline.SHA), urlSuffix(pipeline.WebURL))
+		return pipeline, nil
+	}
+
+	fmt.Printf("Retried failed jobs of pipeline %d: %s%s\n",
+		pipeline.ID, strings.Join(retried, ", "), urlSuffix(pipeline.WebURL))
+	waitPipelineRestarted(ctx, client, config, pipeline.ID)
+	return pipeline, nil
+}
+
+// waitPipelineRestarted waits for a retried pipeline to leave the failed
+// status. Until GitLab has processed the retry it still reports "failed", and
+// --wait-pipeline would take that for the result of the retry.
+func waitPipelineRestarted(ctx context.Context, client *http.Client, config *Config, pipelineID int) {
+	err := poll(ctx, pollInterval(config), retryRestartTimeout, func() (bool, error) {
+		pipeline, err := getPipeline(ctx, client, config, pipelineID)
+		if err != nil {
+			return false, err
+		}
+		return pipeline.Status != pipelineStatusFailed, nil
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: could not confirm that pipeline %d restarted: %v\n", pipelineID, err)
+	}
+}
+
+// matchesAnyPattern reports whether name matches one of the patterns, in which
+// * stands for any run of characters, spaces and slashes included, as job names
+// such as "rspec 1/3" have them.
+func matchesAnyPattern(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		expr := "^" + strings.ReplaceAll(regexp.QuoteMeta(pattern), `\*`, ".*") + "$"
+		if regexp.MustCompile(expr).MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// activePipelineStatuses are the pipeline statuses in which a pipeline still
+// holds, or is waiting for, runners, and so can be canceled.
+var activePipelineStatuses = map[string]bool{
+	"created":              true,
+	"waiting_for_resource": true,
+	"preparing":            true,
+	"pending":              true,
+	"running":              true,
+	"scheduled":            true,
+}
+
+// cancelStalePipelines cancels the MR's pipelines that are still running for
+// commits the branch has since moved past. They test code that will not be
+// merged, and every minute they run is a runner minute spent on nothing.
+//
+// Only pipelines older than current, the one this run created or found for the
+// head, are touched. Comparing commits alone is not enough: the pipelines of a
+// project with merged results pipelines run a merge commit, never the head.
+// Branch pipelines are left alone, as they belong to the branch, not the MR.
+// Failing to cancel is a warning; the housekeeping is not worth failing the run.
+func cancelStalePipelines(
+	ctx context.Context, client *http.Client, config *Config, mr *MergeRequest, current *Pipeline,
+) {
+	if mr == nil || mr.IID == 0 || current == nil || current.ID == 0 {
+		fmt.Fprintln(os.Stderr, "Warning: the current pipeline is not known, not canceling older ones")
+		return
+	}
+
+	pipelines, err := listMRPipelines(ctx, client, config, mr.IID)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: could not list pipelines to cancel stale ones: %v\n", err)
+		return
+	}
+
+	for i := range pipelines {
+		stale := &pipelines[i]
+		if stale.ID >= current.ID || stale.SHA == mr.SHA ||
+			!isMRPipeline(stale, mr.IID) || !activePipelineStatuses[stale.Status] {
+			continue
+		}
+
+		if err := cancelPipeline(ctx, client, config, stale.ID); err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: could not cancel stale pipeline %d: %v\n", stale.ID, err)
+			continue
+		}
+		fmt.Printf("Canceled stale pipeline %d for commit %s (was %s)%s\n",
+			stale.ID, shortSHA(stale.SHA), stale.Status, urlSuffix(stale.WebURL))
+	}
+}
+
+// finishedPipelineStatuses are the pipeline statuses that will not change
+// without someone acting on the pipeline. "manual" is among them: a pipeline
+// stopped at a manual job waits for a person, not for time.
+var finishedPipelineStatuses = map[string]bool{
+	pipelineStatusSuccess: true,
+	pipelineStatusFailed:  true,
+	"canceled":            true,
+	"skipped":             true,
+	"manual":              true,
+}
+
+// waitPipeline waits for the MR pipeline to finish, printing each status it
+// moves through and each job as it fails, and fails unless the pipeline ends
+// in success, so a job orchestrating the MR can gate on it.
+//
+// Failed jobs are looked up on every check, not only at the end, so a long
+// pipeline reports a broken job while the rest of it is still running.
+func waitPipeline(ctx context.Context, client *http.Client, config *Config, pipeline *Pipeline) error {
+	// --wait-pipeline promises a failing run unless the pipeline succeeded,
+	// and a pipeline that cannot be watched has not been seen to.
+	if pipeline == nil || pipeline.ID == 0 {
+		return fmt.Errorf("the merge request pipeline is not known, so it cannot be waited for")
+	}
+
+	timeout := config.PipelineTimeout
+	if timeout <= 0 {
+		timeout = defaultPipelineTimeout
+	}
+
+	status := ""
+	reported := map[int]bool{}
+
+	err := poll(ctx, pollInterval(config), timeout, func() (bool, error) {
+		current, err := getPipeline(ctx, client, config, pipeline.ID)
+		if err != nil {
+			return false, err
+		}
+		if current.Status != status {
+			status = current.Status
+			fmt.Printf("Pipeline %d: %s\n", pipeline.ID, status)
+		}
+
+		reportFailedJobs(ctx, client, config, pipeline.ID, reported)
+		return finishedPipelineStatuses[status], nil
+	})
+
+	switch {
+	case errors.Is(err, errWaitTimeout):
+		return fmt.Errorf("pipeline %d is still %s after %s%s", pipeline.ID, status, timeout, urlSuffix(pipeline.WebURL))
+	case err != nil:
+		return fmt.Errorf("failed to wait for pipeline %d: %w", pipeline.ID, err)
+	case status != pipelineStatusSuccess:
+		return fmt.Errorf("pipeline %d did not succeed, it is %s%s", pipeline.ID, status, urlSuffix(pipeline.WebURL))
+	}
+
+	return nil
+}
+
+// reportFailedJobs prints the pipeline's failed jobs that are not in reported
+// yet, and adds them. Listing the jobs is only for the log, so a failure to do
+// it is a warning.
+func reportFailedJobs(ctx context.Context, client *http.Client, config *Config, pipelineID int, reported map[int]bool) {
+	jobs, err := getFailedJobs(ctx, client, config, pipelineID)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: could not list the failed jobs of pipeline %d: %v\n", pipelineID, err)
+		return
+	}
+
+	for _, job := range jobs {
+		if reported[job.ID] {
+			continue
+		}
+		reported[job.ID] = true
+
+		allowed := ""
+		if job.AllowFailure {
+			allowed = ", allowed to fail"
+		}
+		fmt.Printf("  Job failed: %s (stage: %s%s)%s\n", job.Name, job.Stage, allowed, urlSuffix(job.WebURL))
+	}
+}
+
+// isMRPipeline reports whether the pipeline is one of the MR's own, as opposed
+// to a branch pipeline for the same commit: a merge request pipeline, or one
+// created on the MR's head ref through the pipelines API, as --pipeline-variable
+// does.
+func isMRPipeline(pipeline *Pipeline, mrIID int) bool {
+	return pipeline.Source == pipelineSourceMergeRequest ||
+		(pipeline.Source == pipelineSourceAPI && pipeline.Ref == mrHeadRef(mrIID))
+}
+
+// shortSHA abbreviates a commit hash for log output, the way git does.
+func shortSHA(sha string) string {
+	const shortLen = 8
+	if len(sha) <= shortLen {
+		return sha
+	}
+	return sha[:shortLen]
+}
+
+// urlSuffix renders ": <url>" when there is a URL, and nothing when there is not.
+func urlSuffix(webURL string) string {
+	if webURL == "" {
+		return ""
+	}
+	return ": " + webURL
+}
+
+func createHTTPClient(config *Config) (*http.Client, error) {
+	timeout := config.Timeout
+	if timeout <= 0 {
+		timeout = defaultTimeout
+	}
+
+	client := &http.Client{
+		Timeout: timeout,
+	}
+
+	switch {
+	case config.Insecure:
+		// #nosec G402 -- certificate verification is disabled only at the user's
+		// explicit request, via --insecure/-k.
+		client.Transport = &http.Transport{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		}
+
+	case config.CACert != "":
+		pool, err := caCertPool(config.CACert)
+		if err != nil {
+			return nil, err
+		}
+		client.Transport = &http.Transport{
+			TLSClientConfig: &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12},
+		}
+	}
+
+	return client, nil
+}
+
+// caCertPool returns the system trust store with the given PEM certificate
+// added. It is additive on purpose: a self-hosted GitLab behind an internal CA
+// is usually reached alongside other hosts with public certificates.
+func caCertPool(path string) (*x509.CertPool, error) {
+	// #nosec G304 -- the path comes from the caller's own --ca-cert flag and the
+	// tool runs with the caller's rights, so there is no privilege boundary here.
+	pem, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read CA certificate %s: %w", path, err)
+	}
+
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		// Windows returns an error here rather than a pool; starting from an
+		// empty one still lets the given CA work.
+		pool = x509.NewCertPool()
+	}
+
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no PEM certificate found in %s", path)
+	}
+
+	return pool, nil
+}
+
+// apiError is returned by doRequest when GitLab answered with a status the
+// helper does not treat as success. Callers use errors.As to give the statuses
+// that mean something specific to their endpoint a message of their own; the
+// rest fall through to Error(), which is the wording every API function used to
+// build by hand.
+type apiError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *apiError) Error() string {
+	if e.Body == "" {
+		return fmt.Sprintf("HTTP %d", e.StatusCode)
+	}
+	return fmt.Sprintf("HTTP %d: %s", e.StatusCode, e.Body)
+}
+
+// errUnauthorized is returned for every 401. GitLab answers 401 for the same
+// reason on every endpoint, so the advice lives in one place rather than being
+// re-worded per function.
+var errUnauthorized = errors.New("unauthorized access, check your access token is valid and has the api scope")
+
+// doRequest performs one GitLab API call and returns the raw response body,
+// retrying the attempt when the failure looks transient.
+//
+// path is relative to /api/v4 and must already be escaped. body, when non-nil,
+// is sent as JSON. Any 2xx is success; 401 yields errUnauthorized and every
+// other status yields *apiError carrying the code and body.
+//
+// Decoding is left to the caller: the bodies are single objects, small enough
+// to hold in memory, and each caller has its own wording for a malformed one.
+func doRequest(
+	ctx context.Context, client *http.Client, config *Config,
+	method, path string, body any,
+) ([]byte, error) {
+	apiURL := fmt.Sprintf("%s/api/v4/%s", config.GitLabURL, path)
+
+	var jsonData []byte
+	if body != nil {
+		var err error
+		if jsonData, err = json.Marshal(body); err != nil {
+			return nil, err
+		}
+	}
+
+	for attempt := 0; ; attempt++ {
+		respBody, retryAfter, err := sendRequest(ctx, client, config, method, apiURL, jsonData, body != nil)
+		if err == nil {
+			return respBody, nil
+		}
+
+		if attempt >= config.Retries || !isRetryable(ctx, method, err) {
+			return nil, err
+		}
+
+		delay := retryDelay(config, attempt, retryAfter)
+		fmt.Fprintf(os.Stderr, "Warning: %s %s failed (%v), retrying in %s (%d/%d)\n",
+			method, path, err, delay, attempt+1, config.Retries)
+
+		if err := sleep(ctx, delay); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// listPageSize is the page size lists are read in, the most GitLab allows.
+const listPageSize = 100
+
+// listAll reads every page of a GitLab list endpoint; path may carry a query
+// of its own. A page shorter than a full one is the last.
+func listAll[T any](ctx context.Context, client *http.Client, config *Config, path string) ([]T, error) {
+	separator := "?"
+	if strings.Contains(path, "?") {
+		separator = "&"
+	}
+
+	var all []T
+	for page := 1; ; page++ {
+		body, err := doRequest(ctx, client, config, http.MethodGet,
+			fmt.Sprintf("%s%sper_page=%d&page=%d", path, separator, listPageSize, page), nil)
+		if err != nil {
+			return nil, err
+		}
+
+		var items []T
+		if err := json.Unmarshal(body, &items); err != nil {
+			return nil, err
+		}
+		all = append(all, items...)
+
+		if len(items) < listPageSize {
+			return all, nil
+		}
+	}
+}
+
+// sendRequest performs a single attempt. The returned duration is the value of
+// a Retry-After header, when GitLab sent one that could be parsed.
+func sendRequest(
+	ctx context.Context, client *http.Client, config *Config,
+	method, apiURL string, jsonData []byte, hasBody bool,
+) ([]byte, time.Duration, error) {
+	var reader io.Reader = http.NoBody
+	if hasBody {
+		reader = bytes.NewReader(jsonData)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, apiURL, reader)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	req.Header.Set("PRIVATE-TOKEN", config.PrivateToken)
+	if hasBody {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if resp.StatusCode == http.StatusUnauthorized {
+		return nil, 0, errUnauthorized
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, parseRetryAfter(resp.Header.Get("Retry-After")),
+			&apiError{StatusCode: resp.StatusCode, Body: string(respBody)}
+	}
+
+	return respBody, 0, nil
+}
+
+// isRetryable decides whether a failed attempt is worth repeating.
+//
+// The rule is about what a repeat could do, not only about what failed. GET and
+// PUT are idempotent, so repeating one is harmless: at worst GitLab applies the
+// same change twice. POST is not — retrying POST /merge_requests after a
+// timeout could open a second MR — so it is repeated only when the request
+// demonstrably never reached GitLab, which is what a dial failure means.
+//
+// Whether the caller gave up is read from ctx, not from err. A --timeout that
+// elapsed also surfaces as context.DeadlineExceeded, and that one is a
+// transient failure worth repeating — the very case retries exist for.
+func isRetryable(ctx context.Context, method string, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+
+	if errors.Is(err, errUnauthorized) {
+		return false
+	}
+
+	var apiErr *apiError
+	if errors.As(err, &apiErr) {
+		// GitLab answered, so the request did reach it: repeating is only safe
+		// for the idempotent verbs.
+		if !isIdempotent(method) {
+			return false
+		}
+		return apiErr.StatusCode >= 500 || apiErr.StatusCode == http.StatusTooManyRequests
+	}
+
+	if isIdempotent(method) {
+		return true
+	}
+
+	return isDialError(err)
+}
+
+func isIdempotent(method string) bool {
+	return method == http.MethodGet || method == http.MethodPut || method == http.MethodHead
+}
+
+// isDialError reports whether the connection was never established, which means
+// the server cannot have seen the request.
+func isDialError(err error) bool {
+	var opErr *net.OpError
+	if errors.As(err, &opErr) {
+		return opErr.Op == "dial"
+	}
+	return false
+}
+
+// retryDelay is the exponential backoff, unless GitLab asked for a specific
+// wait via Retry-After — it knows better, and ignoring it on a 429 only earns
+// another one.
+func retryDelay(config *Config, attempt int, retryAfter time.Duration) time.Duration {
+	if retryAfter > 0 {
+		if retryAfter > maxRetryDelay {
+			return maxRetryDelay
+		}
+		return retryAfter
+	}
+
+	base := config.RetryDelay
+	if base <= 0 {
+		base = defaultRetryDelay
+	}
+
+	delay := base << attempt
+	// Shifting past the width of the type wraps; both cases mean "too long".
+	if delay > maxRetryDelay || delay <= 0 {
+		return maxRetryDelay
+	}
+	return delay
+}
+
+// parseRetryAfter reads the delay-seconds form of Retry-After, which is what
+// GitLab sends. The HTTP-date form is ignored rather than guessed at.
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+
+	seconds, err := strconv.Atoi(strings.TrimSpace(value))
+	if err != nil || seconds < 0 {
+		return 0
+	}
+
+	return time.Duration(seconds) * time.Second
+}
+
+// poll calls check every interval until it reports done, returning
+// errWaitTimeout once another wait would pass timeout. A canceled ctx ends the
+// wait early with ctx's error, as it does for sleep.
+func poll(ctx context.Context, interval, timeout time.Duration, check func() (bool, error)) error {
+	deadline := time.Now().Add(timeout)
+
+	for {
+		done, err := check()
+		if err != nil || done {
+			return err
+		}
+
+		if time.Now().Add(interval).After(deadline) {
+			return errWaitTimeout
+		}
+
+		if err := sleep(ctx, interval); err != nil {
+			return err
+		}
+	}
+}
+
+// pollInterval is --poll-interval, or its default for a zero-valued Config.
+func pollInterval(config *Config) time.Duration {
+	if config.PollInterval <= 0 {
+		return defaultPollInterval
+	}
+	return config.PollInterval
+}
+
+// sleep waits for d, or returns early if the context is canceled first.
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+func getProject(ctx context.Context, client *http.Client, config *Config) (*Project, error) {
+	body, err := doRequest(ctx, client, config, http.MethodGet,
+		fmt.Sprintf("projects/%d", config.ProjectID), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var project Project
+	if err := json.Unmarshal(body, &project); err != nil {
+		return nil, err
+	}
+
+	return &project, nil
+}
+
+func validateMR(sourceBranch, targetBranch string) error {
+	if sourceBranch == targetBranch {
+		return fmt.Errorf("source branch and target branches must be different, source: %s and target: %s",
+			sourceBranch, targetBranch)
+	}
+	return nil
+}
+
+// checkBranchPolicy reports a source branch that takes none of the forms
+// --branch-policy allows, spelling out the convention so the error is enough
+// to rename the branch by.
+func checkBranchPolicy(config *Config) error {
+	if len(config.BranchPolicy) == 0 {
+		return nil
+	}
+
+	messages := make([]string, 0, len(config.BranchPolicy))
+	for _, rule := range config.BranchPolicy {
+		if rule.Pattern.MatchString(config.SourceBranch) {
+			return nil
+		}
+		messages = append(messages, "- "+rule.Message)
+	}
+
+	return fmt.Errorf("branch %s does not follow the branch naming policy, use one of:\n%s",
+		config.SourceBranch, strings.Join(messages, "\n"))
+}
+
+// enforceBranchPolicy fails the run for a branch outside --branch-policy,
+// before anything is committed or opened. With --branch-policy-mode comment an
+// MR that is already open is not held back: the policy goes into a comment on
+// it, once, and the run carries on. A new MR is still refused either way.
+func enforceBranchPolicy(ctx context.Context, client *http.Client, config *Config) error {
+	violation := checkBranchPolicy(config)
+	if violation == nil || config.BranchPolicyMode != branchPolicyComment {
+		return violation
+	}
+
+	existingMR, err := getExistingMR(ctx, client, config)
+	if err != nil {
+		return fmt.Errorf("failed to check if MR exists: %w", err)
+	}
+	if existingMR == nil {
+		return violation
+	}
+
+	body := fmt.Sprintf("The source branch does not follow the branch naming policy.\n\n```\n%s\n```", violation)
+	posted, err := postNoteOnce(ctx, client, config, existingMR.IID, body)
+	if err != nil {
+		return fmt.Errorf("failed to comment on the branch naming policy: %w", err)
+	}
+
+	fmt.Fprintf(os.Stderr, "Warning: %v\n", violation)
+	if posted {
+		fmt.Printf("Commented on merge request !%d about the branch naming policy\n", existingMR.IID)
+	}
+	return nil
+}
+
+// postNoteOnce comments on the MR unless one of its recent comments already
+// says the same, so a pipeline running on every push does not repeat itself.
+// It reports whether it posted.
+func postNoteOnce(ctx context.Context, client *http.Client, config *Config, mrIID int, body string) (bool, error) {
+	path := fmt.Sprintf("projects/%d/merge_requests/%d/notes", config.ProjectID, mrIID)
+
+	data, err := doRequest(ctx, client, config, http.MethodGet,
+		path+"?sort=desc&order_by=created_at&per_page=100", nil)
+	if err != nil {
+		return false, err
+	}
+
+	var notes []Note
+	if err := json.Unmarshal(data, &notes); err != nil {
+		return false, err
+	}
+	for _, note := range notes {
+		if !note.System && note.Body == body {
+			return false, nil
+		}
+	}
+
+	if _, err := doRequest(ctx, client, config, http.MethodPost, path, NoteRequest{Body: body}); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func getExistingMR(ctx context.Context, client *http.Client, config *Config) (*MergeRequest, error) {
+	params := url.Values{}
+	params.Set("state", "opened")
+	params.Set("source_branch", config.SourceBranch)
+	params.Set("target_branch", config.TargetBranch)
+	params.Set("per_page", "1")
+
+	body, err := doRequest(ctx, client, config, http.MethodGet,
+		fmt.Sprintf("projects/%d/merge_requests?%s", config.ProjectID, params.Encode()), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var mrs []MergeRequest
+	if err := json.Unmarshal(body, &mrs); err != nil {
+		return nil, err
+	}
+
+	if len(mrs) > 0 {
+		return &mrs[0], nil
+	}
+
+	return nil, nil
+}
+
+// getMR fetches a single MR. params, which may be nil, ask for the optional
+// attributes the single-MR endpoint only returns on request.
+func getMR(
+	ctx context.Context, client *http.Client, config *Config, mrIID int, params url.Values,
+) (*MergeRequest, error) {
+	apiPath := fmt.Sprintf("projects/%d/merge_requests/%d", config.ProjectID, mrIID)
+	if len(params) > 0 {
+		apiPath += "?" + params.Encode()
+	}
+
+	body, err := doRequest(ctx, client, config, http.MethodGet, apiPath, nil)
+	if err != nil {
+		var apiErr *apiError
+		if errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusNotFound {
+			return nil, fmt.Errorf("merge request !%d not found", mrIID)
+		}
+		return nil, err
+	}
+
+	var mr MergeRequest
+	if err := json.Unmarshal(body, &mr); err != nil {
+		return nil, err
 	}
 
-	updateRequest.MilestoneID, updateRequest.Labels = resolveMRMetadata(ctx, client, config)
+	return &mr, nil
+}
 
-	if err := updateMR(ctx, client, config, existingMR.IID, updateRequest); err != nil {
-		return nil, fmt.Errorf("failed to update MR: %w", err)
+// getApprovals reads whether the MR has the approvals its rules require.
+func getApprovals(ctx context.Context, client *http.Client, config *Config, mrIID int) (*MRApprovals, error) {
+	body, err := doRequest(ctx, client, config, http.MethodGet,
+		fmt.Sprintf("projects/%d/merge_requests/%d/approvals", config.ProjectID, mrIID), nil)
+	if err != nil {
+		return nil, err
 	}
 
-	fmt.Printf("Updated existing MR %s (IID: %d)\n", title, existingMR.IID)
-	printMRURL(existingMR)
-	return existingMR, nil
+	var approvals MRApprovals
+	if err := json.Unmarshal(body, &approvals); err != nil {
+		return nil, err
+	}
+
+	return &approvals, nil
 }
 
-func handleCreateMR(
-	ctx context.Context, client *http.Client, config *Config,
-	title, description string,
-) (*MergeRequest, error) {
-	mrRequest := &MRCreateRequest{
-		SourceBranch:       config.SourceBranch,
-		TargetBranch:       config.TargetBranch,
-		Title:              title,
-		Description:        description,
-		AssigneeIDs:        config.UserIDs,
-		ReviewerIDs:        config.ReviewerIDs,
-		RemoveSourceBranch: config.RemoveBranch,
-		Squash:             config.SquashCommits,
-		AllowCollaboration: config.AllowCollaboration,
-	}
+// listMRPipelines lists the pipelines GitLab attaches to the MR, newest first,
+// branch pipelines for its commits included. Every page is read, so a stale
+// pipeline past GitLab's default page of 20 is still found.
+func listMRPipelines(ctx context.Context, client *http.Client, config *Config, mrIID int) ([]Pipeline, error) {
+	return listAll[Pipeline](ctx, client, config,
+		fmt.Sprintf("projects/%d/merge_requests/%d/pipelines", config.ProjectID, mrIID))
+}
 
-	mrRequest.MilestoneID, mrRequest.Labels = resolveMRMetadata(ctx, client, config)
+// cancelPipeline cancels a pipeline's jobs that have not finished.
+func cancelPipeline(ctx context.Context, client *http.Client, config *Config, pipelineID int) error {
+	_, err := doRequest(ctx, client, config, http.MethodPost,
+		fmt.Sprintf("projects/%d/pipelines/%d/cancel", config.ProjectID, pipelineID), nil)
+	return err
+}
 
-	createdMR, err := createMR(ctx, client, config, mrRequest)
+// retryPipeline retries every failed or canceled job of the pipeline.
+func retryPipeline(ctx context.Context, client *http.Client, config *Config, pipelineID int) error {
+	_, err := doRequest(ctx, client, config, http.MethodPost,
+		fmt.Sprintf("projects/%d/pipelines/%d/retry", config.ProjectID, pipelineID), nil)
+	return err
+}
+
+// retryJob retries a single job, which GitLab runs as a new job in the same
+// pipeline.
+func retryJob(ctx context.Context, client *http.Client, config *Config, jobID int) error {
+	_, err := doRequest(ctx, client, config, http.MethodPost,
+		fmt.Sprintf("projects/%d/jobs/%d/retry", config.ProjectID, jobID), nil)
+	return err
+}
+
+// getPipeline fetches a single pipeline of the project.
+func getPipeline(ctx context.Context, client *http.Client, config *Config, pipelineID int) (*Pipeline, error) {
+	body, err := doRequest(ctx, client, config, http.MethodGet,
+		fmt.Sprintf("projects/%d/pipelines/%d", config.ProjectID, pipelineID), nil)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create MR: %w", err)
+		return nil, err
 	}
 
-	fmt.Printf("Created a new MR %s, assigned to you.\n", title)
-	printMRURL(createdMR)
-	return createdMR, nil
+	var pipeline Pipeline
+	if err := json.Unmarshal(body, &pipeline); err != nil {
+		return nil, err
+	}
+
+	return &pipeline, nil
 }
 
-// resolveMRMetadata determines the milestone and labels for the MR, combining
-// what was given on the command line with what the linked issue carries.
-//
-// --milestone wins over the issue's milestone; labels are the union of the two,
-// with --label values first. A failure to fetch the issue is a warning, not an
-// error: the MR is still worth creating without its issue metadata.
-func resolveMRMetadata(ctx context.Context, client *http.Client, config *Config) (int, []string) {
-	milestoneID := config.MilestoneID
-	labels := config.Labels
+// getFailedJobs lists every one of the pipeline's failed jobs.
+func getFailedJobs(ctx context.Context, client *http.Client, config *Config, pipelineID int) ([]Job, error) {
+	return listAll[Job](ctx, client, config,
+		fmt.Sprintf("projects/%d/pipelines/%d/jobs?scope[]=failed", config.ProjectID, pipelineID))
+}
 
-	if !config.UseIssueName {
-		return milestoneID, labels
-	}
+// getMRCommits lists every one of the MR's commits, newest first.
+func getMRCommits(ctx context.Context, client *http.Client, config *Config, mrIID int) ([]Commit, error) {
+	return listAll[Commit](ctx, client, config,
+		fmt.Sprintf("projects/%d/merge_requests/%d/commits", config.ProjectID, mrIID))
+}
 
-	issue, err := getIssueData(ctx, client, config)
+// countUnresolvedThreads counts the MR's unresolved threads, across all its
+// threads.
+func countUnresolvedThreads(ctx context.Context, client *http.Client, config *Config, mrIID int) (int, error) {
+	discussions, err := listAll[Discussion](ctx, client, config,
+		fmt.Sprintf("projects/%d/merge_requests/%d/discussions", config.ProjectID, mrIID))
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Warning: failed to fetch issue data: %v\n", err)
-		return milestoneID, labels
+		return 0, err
 	}
 
-	if milestoneID == 0 {
-		milestoneID = issue.Milestone.ID
+	unresolved := 0
+	for _, discussion := range discussions {
+		for _, note := range discussion.Notes {
+			if note.Resolvable && !note.Resolved {
+				unresolved++
+				break
+			}
+		}
 	}
 
-	return milestoneID, mergeLabels(labels, issue.Labels)
+	return unresolved, nil
 }
 
-// mergeLabels appends the labels from extra that are not already in base,
-// preserving the order of both and never returning a non-nil empty slice
-// (MRCreateRequest.Labels is omitempty, and an empty list would clear labels).
-func mergeLabels(base, extra []string) []string {
-	if len(extra) == 0 {
-		if len(base) == 0 {
-			return nil
-		}
-		return base
+// checkGroupExists makes sure the group can be read before its members are
+// looked up, since a misspelt group would otherwise just leave every approver
+// outside it.
+func checkGroupExists(ctx context.Context, client *http.Client, config *Config, group string) error {
+	_, err := doRequest(ctx, client, config, http.MethodGet, "groups/"+url.PathEscape(group), nil)
+
+	var apiErr *apiError
+	if errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusNotFound {
+		return fmt.Errorf("group %s not found, or the token cannot read it", group)
+	}
+	if err != nil {
+		return fmt.Errorf("unable to get group %s: %w", group, err)
 	}
 
-	seen := make(map[string]struct{}, len(base)+len(extra))
-	merged := make([]string, 0, len(base)+len(extra))
+	return nil
+}
 
-	for _, group := range [][]string{base, extra} {
-		for _, label := range group {
-			if _, ok := seen[label]; ok {
-				continue
-			}
-			seen[label] = struct{}{}
-			merged = append(merged, label)
-		}
+// applyPipelineActions triggers the MR pipeline and runs the steps that go with
+// it. The pipeline is recorded as mr's head pipeline, which is what auto-merge
+// and the merge train wait to see GitLab report.
+func applyPipelineActions(ctx context.Context, client *http.Client, config *Config, mr *MergeRequest) error {
+	pipeline, err := triggerMRPipeline(ctx, client, config, mr)
+	if err != nil {
+		return fmt.Errorf("failed to trigger merge request pipeline: %w", err)
 	}
 
-	if len(merged) == 0 {
-		return nil
+	if config.CancelStalePipelines {
+		cancelStalePipelines(ctx, client, config, mr, pipeline)
 	}
-	return merged
-}
 
-// printMRURL writes the MR's browser URL so it can be clicked straight out of a
-// CI job log. The URL comes from the API response rather than being assembled
-// locally: --gitlab-url is only the instance host, so the project path with its
-// namespace is not knowable here. Nothing is printed if GitLab omitted web_url.
-func printMRURL(mr *MergeRequest) {
-	if mr == nil || mr.WebURL == "" {
-		return
+	if pipeline != nil && pipeline.ID != 0 {
+		mr.HeadPipeline = pipeline
 	}
-	fmt.Printf("MR URL: %s\n", mr.WebURL)
+
+	if config.WaitPipeline {
+		return waitPipeline(ctx, client, config, pipeline)
+	}
+	return nil
 }
 
-func enableAutoMerge(ctx context.Context, client *http.Client, config *Config, mrIID int) error {
-	if mrIID == 0 {
-		fmt.Println("Warning: could not determine MR IID, skipping auto-merge")
-		return nil
+// applyApprovalActions sets the MR's approval rules and then approves it, each
+// when asked to.
+func applyApprovalActions(ctx context.Context, client *http.Client, config *Config, mr *MergeRequest) error {
+	if len(config.ApprovalRules) > 0 {
+		if err := applyApprovalRules(ctx, client, config, mr); err != nil {
+			return fmt.Errorf("failed to apply approval rules: %w", err)
+		}
 	}
 
-	if err := acceptMR(ctx, client, config, mrIID); err != nil {
-		return fmt.Errorf("failed to enable auto-merge: %w", err)
+	if config.Approve {
+		if err := approveMR(ctx, client, config, mr); err != nil {
+			return fmt.Errorf("failed to approve merge request: %w", err)
+		}
 	}
 
-	fmt.Printf("Auto-merge enabled for MR (IID: %d)\n", mrIID)
 	return nil
 }
 
-// triggerMRPipeline asks GitLab to create a merge request pipeline for an
-// existing MR.
-//
-// GitLab does not start one on its own when an MR is created through the API
-// for a commit that already has a branch pipeline. A CI configuration whose
-// jobs run only on `merge_request_event` would therefore never see the MR, and
-// the missing checks are easy to mistake for passing ones.
+// approveMR approves the MR as the token owner, for the automated MRs nobody
+// needs to review: the token owner must have opened the MR itself, and every
+// path it changes must match --approve-paths. Since the token owner is then
+// also the author, the project has to allow authors to approve their own MRs;
+// when it does not, the run says so rather than leave GitLab's bare 401 to be
+// puzzled over.
 //
-// The call runs for updated MRs as well as new ones, because a moved branch is
-// exactly when the checks are worth re-running. To keep that from producing a
-// pipeline per job run, an existing pipeline for the same commit is left alone
-// unless --force-pipeline says otherwise.
-func triggerMRPipeline(ctx context.Context, client *http.Client, config *Config, mr *MergeRequest) error {
-	if mr == nil || mr.IID == 0 {
-		fmt.Println("Warning: could not determine MR IID, skipping pipeline trigger")
+// The approval is pinned to the head the changes were checked at, so commits
+// pushed in between are not approved unseen.
+func approveMR(ctx context.Context, client *http.Client, config *Config, mr *MergeRequest) error {
+	if mr.IID == 0 {
+		fmt.Println("Warning: could not determine MR IID, skipping approval")
 		return nil
 	}
 
-	if !config.ForcePipeline {
-		existing, err := findPipelineForSHA(ctx, client, config, mr)
-		if err != nil {
-			// Not being able to list pipelines is no reason to skip creating one;
-			// the worst case is the duplicate this check exists to avoid.
-			fmt.Fprintf(os.Stderr, "Warning: could not check for existing pipelines: %v\n", err)
-		} else if existing != nil {
-			fmt.Printf(
-				"Merge request pipeline already exists for commit %s (ID: %d, status: %s)%s\n",
-				shortSHA(mr.SHA), existing.ID, existing.Status, urlSuffix(existing.WebURL),
-			)
-			fmt.Println("Skipping pipeline creation; pass --force-pipeline to create another.")
-			return nil
-		}
+	current, err := getMR(ctx, client, config, mr.IID, nil)
+	if err != nil {
+		return err
+	}
+	if mr.SHA != "" && current.SHA != mr.SHA {
+		return errBranchMoved
 	}
 
-	body, err := doRequest(ctx, client, config, http.MethodPost,
-		fmt.Sprintf("projects/%d/merge_requests/%d/pipelines", config.ProjectID, mr.IID), nil)
+	user, err := getCurrentUser(ctx, client, config)
 	if err != nil {
-		var apiErr *apiError
-		if errors.As(err, &apiErr) {
-			switch apiErr.StatusCode {
-			case http.StatusForbidden:
-				return fmt.Errorf(
-					"forbidden, the token owner needs at least the Developer role on the project " +
-						"to create pipelines",
-				)
-			case http.StatusBadRequest:
-				return fmt.Errorf(
-					"GitLab refused to create the pipeline, "+
-						"the CI configuration may define no jobs for merge request pipelines: %s",
-					apiErr.Body,
-				)
-			}
-		}
-		return err
+		return fmt.Errorf("unable to get the token owner: %w", err)
 	}
 
-	// The pipeline already exists at this point, so a response we cannot read is
-	// worth a warning but must not fail the run: the body is only used to tell
-	// the user what was created.
-	var pipeline Pipeline
-	if err := json.Unmarshal(body, &pipeline); err != nil {
-		fmt.Printf("Warning: merge request pipeline created but response could not be read: %v\n", err)
+	approvals, err := getApprovals(ctx, client, config, current.IID)
+	if err != nil {
+		return err
+	}
+	if approvals.approvedBy(user.ID) {
+		fmt.Printf("MR (IID: %d) is already approved by %s\n", current.IID, user.Username)
 		return nil
 	}
 
-	fmt.Printf(
-		"Merge request pipeline created (ID: %d, status: %s)%s\n",
-		pipeline.ID, pipeline.Status, urlSuffix(pipeline.WebURL),
-	)
+	if err := checkApprovable(ctx, client, config, current, user); err != nil {
+		return fmt.Errorf("refusing to approve MR !%d: %w", current.IID, err)
+	}
+
+	_, err = doRequest(ctx, client, config, http.MethodPost,
+		fmt.Sprintf("projects/%d/merge_requests/%d/approve", config.ProjectID, current.IID),
+		&MRApproveRequest{SHA: current.SHA})
+	// The approve endpoint answers 401 rather than 403 to a user it will not
+	// let approve; the token itself has just been used to read the MR.
+	var apiErr *apiError
+	switch {
+	case errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusConflict:
+		return errBranchMoved
+	case errors.Is(err, errUnauthorized), errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusForbidden:
+		return fmt.Errorf("GitLab does not let %s approve it, the project may keep committers from approving "+
+			"or require approvers it is not one of", user.Username)
+	case err != nil:
+		return err
+	}
+
+	fmt.Printf("Approved MR (IID: %d) as %s at %s\n", current.IID, user.Username, shortSHA(current.SHA))
 	return nil
 }
 
-// findPipelineForSHA returns the MR's existing merge request pipeline for its
-// head commit, or nil when there is none.
-//
-// The endpoint lists every pipeline attached to the MR, branch pipelines
-// included — the docs' own example shows a plain branch ref. Matching on the
-// commit alone would therefore match the branch pipeline that is usually
-// running this very job, and skipping on that would mean never creating the
-// merge request pipeline this tool exists to create. Only pipelines GitLab
-// reports as merge_request_event count.
-//
-// With an unknown head SHA there is nothing to compare against, so it reports
-// no match and the caller creates a pipeline: a duplicate is a better outcome
-// than silently skipping the checks.
-func findPipelineForSHA(
-	ctx context.Context, client *http.Client, config *Config, mr *MergeRequest,
-) (*Pipeline, error) {
-	if mr.SHA == "" {
-		return nil, nil
+// checkApprovable applies --approve's guards to the MR: opened by the token
+// owner, in a project that lets authors approve, changing only allowed paths.
+func checkApprovable(ctx context.Context, client *http.Client, config *Config, mr *MergeRequest, user *User) error {
+	if mr.Author.ID != user.ID {
+		return fmt.Errorf("it was opened by %s, not by %s, the token owner", mr.Author.Username, user.Username)
 	}
 
-	body, err := doRequest(ctx, client, config, http.MethodGet,
-		fmt.Sprintf("projects/%d/merge_requests/%d/pipelines", config.ProjectID, mr.IID), nil)
-	if err != nil {
-		return nil, err
+	// The project's approval settings are a Premium API: on a lower tier it
+	// answers 403 or 404, and GitLab's answer to the approval itself is then
+	// the only word on whether an author may approve.
+	settings, err := getProjectApprovalSettings(ctx, client, config)
+	var apiErr *apiError
+	switch {
+	case errors.As(err, &apiErr) &&
+		(apiErr.StatusCode == http.StatusForbidden || apiErr.StatusCode == http.StatusNotFound):
+		fmt.Fprintf(os.Stderr, "Warning: the project's approval settings are not available on this GitLab tier, "+
+			"so whether %s may approve its own MR is left to GitLab\n", user.Username)
+	case err != nil:
+		return fmt.Errorf("unable to read whether the project lets authors approve their own MRs: %w", err)
+	case !settings.MergeRequestsAuthorApproval:
+		return fmt.Errorf("%s opened it, and the project does not let authors approve their own MRs", user.Username)
 	}
 
-	var pipelines []Pipeline
-	if err := json.Unmarshal(body, &pipelines); err != nil {
-		return nil, err
+	paths, err := mrChangedPaths(ctx, client, config, mr)
+	if err != nil {
+		return fmt.Errorf("unable to list its changes: %w", err)
+	}
+	if len(paths) == 0 {
+		return fmt.Errorf("it changes nothing against %s", mr.TargetBranch)
 	}
 
-	for i := range pipelines {
-		if pipelines[i].Source == pipelineSourceMergeRequest && pipelines[i].SHA == mr.SHA {
-			return &pipelines[i], nil
+	var outside []string
+	for _, changed := range paths {
+		if !matchesAnyGlob(config.ApprovePaths, changed) {
+			outside = append(outside, changed)
 		}
 	}
+	if len(outside) > 0 {
+		return fmt.Errorf("it changes %d path(s) outside --approve-paths: %s", len(outside), abbreviateList(outside, 5))
+	}
 
-	return nil, nil
+	return nil
 }
 
-// shortSHA abbreviates a commit hash for log output, the way git does.
-func shortSHA(sha string) string {
-	const shortLen = 8
-	if len(sha) <= shortLen {
-		return sha
+// abbreviateList joins the first limit items and counts the rest, to keep an
+// error about many paths readable.
+func abbreviateList(items []string, limit int) string {
+	if len(items) <= limit {
+		return strings.Join(items, ", ")
 	}
-	return sha[:shortLen]
+	return fmt.Sprintf("%s and %d more", strings.Join(items[:limit], ", "), len(items)-limit)
 }
 
-// urlSuffix renders ": <url>" when there is a URL, and nothing when there is not.
-func urlSuffix(webURL string) string {
-	if webURL == "" {
-		return ""
+// getCurrentUser returns the token owner.
+func getCurrentUser(ctx context.Context, client *http.Client, config *Config) (*User, error) {
+	body, err := doRequest(ctx, client, config, http.MethodGet, "user", nil)
+	if err != nil {
+		return nil, err
 	}
-	return ": " + webURL
-}
 
-func createHTTPClient(config *Config) (*http.Client, error) {
-	timeout := config.Timeout
-	if timeout <= 0 {
-		timeout = defaultTimeout
+	var user User
+	if err := json.Unmarshal(body, &user); err != nil {
+		return nil, err
 	}
 
-	client := &http.Client{
-		Timeout: timeout,
-	}
+	return &user, nil
+}
 
-	switch {
-	case config.Insecure:
-		// #nosec G402 -- certificate verification is disabled only at the user's
-		// explicit request, via --insecure/-k.
-		client.Transport = &http.Transport{
-			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
-		}
+func getProjectApprovalSettings(
+	ctx context.Context, client *http.Client, config *Config,
+) (*ProjectApprovalSettings, error) {
+	body, err := doRequest(ctx, client, config, http.MethodGet,
+		fmt.Sprintf("projects/%d/approvals", config.ProjectID), nil)
+	if err != nil {
+		return nil, err
+	}
 
-	case config.CACert != "":
-		pool, err := caCertPool(config.CACert)
-		if err != nil {
-			return nil, err
-		}
-		client.Transport = &http.Transport{
-			TLSClientConfig: &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12},
-		}
+	var settings ProjectApprovalSettings
+	if err := json.Unmarshal(body, &settings); err != nil {
+		return nil, err
 	}
 
-	return client, nil
+	return &settings, nil
 }
 
-// caCertPool returns the system trust store with the given PEM certificate
-// added. It is additive on purpose: a self-hosted GitLab behind an internal CA
-// is usually reached alongside other hosts with public certificates.
-func caCertPool(path string) (*x509.CertPool, error) {
-	// #nosec G304 -- the path comes from the caller's own --ca-cert flag and the
-	// tool runs with the caller's rights, so there is no privilege boundary here.
-	pem, err := os.ReadFile(path)
+// mrChangedPaths lists every path the MR changes, from the MR's own diff read
+// page by page. GitLab works the diff out in the background after a push, so
+// it is waited for until it covers the head the run holds. A diff GitLab cut
+// short at its limits, with a changes_count like "1000+", is an error: the
+// paths past the cut are not known, and a check on the rest would pass them.
+func mrChangedPaths(ctx context.Context, client *http.Client, config *Config, mr *MergeRequest) ([]string, error) {
+	current := mr
+	err := poll(ctx, pollInterval(config), mergeabilityTimeout, func() (bool, error) {
+		if current.SHA == "" || current.DiffRefs.HeadSHA == current.SHA {
+			return true, nil
+		}
+		var err error
+		current, err = getMR(ctx, client, config, mr.IID, nil)
+		return false, err
+	})
+	if errors.Is(err, errWaitTimeout) {
+		return nil, fmt.Errorf("GitLab has not worked out the diff for %s after %s", shortSHA(mr.SHA), mergeabilityTimeout)
+	}
 	if err != nil {
-		return nil, fmt.Errorf("unable to read CA certificate %s: %w", path, err)
+		return nil, err
+	}
+	if current.SHA != mr.SHA {
+		return nil, errBranchMoved
 	}
 
-	pool, err := x509.SystemCertPool()
+	diffs, err := listAll[FileDiff](ctx, client, config,
+		fmt.Sprintf("projects/%d/merge_requests/%d/diffs", config.ProjectID, mr.IID))
 	if err != nil {
-		// Windows returns an error here rather than a pool; starting from an
-		// empty one still lets the given CA work.
-		pool = x509.NewCertPool()
+		return nil, err
 	}
 
-	if !pool.AppendCertsFromPEM(pem) {
-		return nil, fmt.Errorf("no PEM certificate found in %s", path)
+	if count, err := strconv.Atoi(current.ChangesCount); err != nil || count != len(diffs) {
+		return nil, fmt.Errorf("GitLab lists %d of the MR's %s changed files, the rest are past its diff limits",
+			len(diffs), current.ChangesCount)
 	}
 
-	return pool, nil
+	return (&Comparison{Diffs: diffs}).paths(), nil
 }
 
-// apiError is returned by doRequest when GitLab answered with a status the
-// helper does not treat as success. Callers use errors.As to give the statuses
-// that mean something specific to their endpoint a message of their own; the
-// rest fall through to Error(), which is the wording every API function used to
-// build by hand.
-type apiError struct {
-	StatusCode int
-	Body       string
+// compareRefs compares to with the merge base of from and to, the way an MR
+// from to into from is diffed.
+func compareRefs(ctx context.Context, client *http.Client, config *Config, from, to string) (*Comparison, error) {
+	query := url.Values{"from": {from}, "to": {to}, "straight": {"false"}}
+	body, err := doRequest(ctx, client, config, http.MethodGet,
+		fmt.Sprintf("projects/%d/repository/compare?%s", config.ProjectID, query.Encode()), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var comparison Comparison
+	if err := json.Unmarshal(body, &comparison); err != nil {
+		return nil, err
+	}
+
+	return &comparison, nil
 }
 
-func (e *apiError) Error() string {
-	if e.Body == "" {
-		return fmt.Sprintf("HTTP %d", e.StatusCode)
+// paths lists the changed paths, a renamed file under both its names.
+func (c *Comparison) paths() []string {
+	var paths []string
+	for _, diff := range c.Diffs {
+		paths = append(paths, diff.NewPath)
+		if diff.OldPath != diff.NewPath {
+			paths = append(paths, diff.OldPath)
+		}
 	}
-	return fmt.Sprintf("HTTP %d: %s", e.StatusCode, e.Body)
+	return paths
 }
 
-// errUnauthorized is returned for every 401. GitLab answers 401 for the same
-// reason on every endpoint, so the advice lives in one place rather than being
-// re-worded per function.
-var errUnauthorized = errors.New("unauthorized access, check your access token is valid and has the api scope")
+// applyApprovalRules brings the MR's approval rules in line with the
+// --approval-rules file: a rule that applies is added, or updated when it
+// differs, and a rule from the file that no longer applies, because the paths
+// or labels that brought it in are gone, is removed. The file owns the rules it
+// names and nothing else, so rerunning changes nothing and rules added by hand
+// or inherited from the project under other names are left alone.
+func applyApprovalRules(ctx context.Context, client *http.Client, config *Config, mr *MergeRequest) error {
+	if mr.IID == 0 {
+		fmt.Println("Warning: could not determine MR IID, skipping approval rules")
+		return nil
+	}
 
-// doRequest performs one GitLab API call and returns the raw response body,
-// retrying the attempt when the failure looks transient.
-//
-// path is relative to /api/v4 and must already be escaped. body, when non-nil,
-// is sent as JSON. Any 2xx is success; 401 yields errUnauthorized and every
-// other status yields *apiError carrying the code and body.
-//
-// Decoding is left to the caller: the bodies are single objects, small enough
-// to hold in memory, and each caller has its own wording for a malformed one.
-func doRequest(
-	ctx context.Context, client *http.Client, config *Config,
-	method, path string, body any,
-) ([]byte, error) {
-	apiURL := fmt.Sprintf("%s/api/v4/%s", config.GitLabURL, path)
+	current, err := getMR(ctx, client, config, mr.IID, nil)
+	if err != nil {
+		return err
+	}
 
-	var jsonData []byte
-	if body != nil {
-		var err error
-		if jsonData, err = json.Marshal(body); err != nil {
-			return nil, err
+	var paths []string
+	if rulesUsePaths(config.ApprovalRules) {
+		if paths, err = mrChangedPaths(ctx, client, config, current); err != nil {
+			return fmt.Errorf("unable to list the MR's changes: %w", err)
 		}
 	}
 
-	for attempt := 0; ; attempt++ {
-		respBody, retryAfter, err := sendRequest(ctx, client, config, method, apiURL, jsonData, body != nil)
-		if err == nil {
-			return respBody, nil
-		}
+	existing, err := listApprovalRules(ctx, client, config, current.IID)
+	if err != nil {
+		return err
+	}
 
-		if attempt >= config.Retries || !isRetryable(ctx, method, err) {
-			return nil, err
+	for _, rule := range config.ApprovalRules {
+		var have *ApprovalRule
+		for i := range existing {
+			if existing[i].Name == rule.Name {
+				have = &existing[i]
+				break
+			}
 		}
 
-		delay := retryDelay(config, attempt, retryAfter)
-		fmt.Fprintf(os.Stderr, "Warning: %s %s failed (%v), retrying in %s (%d/%d)\n",
-			method, path, err, delay, attempt+1, config.Retries)
-
-		if err := sleep(ctx, delay); err != nil {
-			return nil, err
+		applies := ruleApplies(rule, current, paths)
+		if err := syncApprovalRule(ctx, client, config, current.IID, rule, have, applies); err != nil {
+			return fmt.Errorf("approval rule %q: %w", rule.Name, err)
 		}
 	}
+
+	return nil
 }
 
-// sendRequest performs a single attempt. The returned duration is the value of
-// a Retry-After header, when GitLab sent one that could be parsed.
-func sendRequest(
+// syncApprovalRule creates, updates or deletes one approval rule, whichever
+// brings have, the MR's rule of that name if it has one, in line with rule.
+func syncApprovalRule(
 	ctx context.Context, client *http.Client, config *Config,
-	method, apiURL string, jsonData []byte, hasBody bool,
-) ([]byte, time.Duration, error) {
-	var reader io.Reader = http.NoBody
-	if hasBody {
-		reader = bytes.NewReader(jsonData)
+	mrIID int, rule ApprovalRuleConfig, have *ApprovalRule, applies bool,
+) error {
+	rulesPath := fmt.Sprintf("projects/%d/merge_requests/%d/approval_rules", config.ProjectID, mrIID)
+	request := &ApprovalRuleRequest{
+		Name:              rule.Name,
+		ApprovalsRequired: rule.ApprovalsRequired,
+		UserIDs:           append([]int{}, rule.UserIDs...),
+		GroupIDs:          append([]int{}, rule.GroupIDs...),
 	}
 
-	req, err := http.NewRequestWithContext(ctx, method, apiURL, reader)
-	if err != nil {
-		return nil, 0, err
+	var err error
+	switch {
+	case applies && have == nil:
+		if _, err = doRequest(ctx, client, config, http.MethodPost, rulesPath, request); err == nil {
+			fmt.Printf("Added approval rule %q to MR (IID: %d)\n", rule.Name, mrIID)
+		}
+	case applies && !sameApprovalRule(have, rule):
+		if _, err = doRequest(ctx, client, config, http.MethodPut,
+			fmt.Sprintf("%s/%d", rulesPath, have.ID), request); err == nil {
+			fmt.Printf("Updated approval rule %q of MR (IID: %d)\n", rule.Name, mrIID)
+		}
+	case !applies && have != nil:
+		if _, err = doRequest(ctx, client, config, http.MethodDelete,
+			fmt.Sprintf("%s/%d", rulesPath, have.ID), nil); err == nil {
+			fmt.Printf("Removed approval rule %q from MR (IID: %d), it no longer applies\n", rule.Name, mrIID)
+		}
 	}
 
-	req.Header.Set("PRIVATE-TOKEN", config.PrivateToken)
-	if hasBody {
-		req.Header.Set("Content-Type", "application/json")
+	return approvalRulesError(err)
+}
+
+// approvalRulesError explains the 403 GitLab answers to approval rule edits it
+// will not allow.
+func approvalRulesError(err error) error {
+	var apiErr *apiError
+	if errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusForbidden {
+		return fmt.Errorf("forbidden, MR approval rules need GitLab Premium, a project that allows overriding " +
+			"approvers per MR, and a token owner who can edit the MR")
 	}
+	return err
+}
 
-	resp, err := client.Do(req)
-	if err != nil {
-		return nil, 0, err
+// rulesUsePaths reports whether any rule depends on the changed paths, which
+// are only looked up when one does.
+func rulesUsePaths(rules []ApprovalRuleConfig) bool {
+	for _, rule := range rules {
+		if len(rule.Paths) > 0 {
+			return true
+		}
 	}
-	defer resp.Body.Close()
+	return false
+}
 
-	respBody, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return nil, 0, err
+// ruleApplies reports whether the rule applies to the MR, given the paths it
+// changes.
+func ruleApplies(rule ApprovalRuleConfig, mr *MergeRequest, paths []string) bool {
+	if len(rule.Paths) == 0 && len(rule.Labels) == 0 {
+		return true
 	}
 
-	if resp.StatusCode == http.StatusUnauthorized {
-		return nil, 0, errUnauthorized
+	for _, label := range mr.Labels {
+		for _, want := range rule.Labels {
+			if strings.EqualFold(label, want) {
+				return true
+			}
+		}
 	}
 
-	if resp.StatusCode < 200 || resp.StatusCode > 299 {
-		return nil, parseRetryAfter(resp.Header.Get("Retry-After")),
-			&apiError{StatusCode: resp.StatusCode, Body: string(respBody)}
+	for _, changed := range paths {
+		if matchesAnyGlob(rule.Paths, changed) {
+			return true
+		}
 	}
 
-	return respBody, 0, nil
+	return false
 }
 
-// isRetryable decides whether a failed attempt is worth repeating.
-//
-// The rule is about what a repeat could do, not only about what failed. GET and
-// PUT are idempotent, so repeating one is harmless: at worst GitLab applies the
-// same change twice. POST is not — retrying POST /merge_requests after a
-// timeout could open a second MR — so it is repeated only when the request
-// demonstrably never reached GitLab, which is what a dial failure means.
-//
-// Whether the caller gave up is read from ctx, not from err. A --timeout that
-// elapsed also surfaces as context.DeadlineExceeded, and that one is a
-// transient failure worth repeating — the very case retries exist for.
-func isRetryable(ctx context.Context, method string, err error) bool {
-	if ctx.Err() != nil {
-		return false
-	}
-
-	if errors.Is(err, errUnauthorized) {
+// sameApprovalRule reports whether the MR's rule already is what the file asks
+// for, the order of its approvers aside.
+func sameApprovalRule(have *ApprovalRule, rule ApprovalRuleConfig) bool {
+	if have.ApprovalsRequired != rule.ApprovalsRequired {
 		return false
 	}
 
-	var apiErr *apiError
-	if errors.As(err, &apiErr) {
-		// GitLab answered, so the request did reach it: repeating is only safe
-		// for the idempotent verbs.
-		if !isIdempotent(method) {
-			return false
-		}
-		return apiErr.StatusCode >= 500 || apiErr.StatusCode == http.StatusTooManyRequests
+	userIDs := make([]int, 0, len(have.Users))
+	for _, user := range have.Users {
+		userIDs = append(userIDs, user.ID)
 	}
-
-	if isIdempotent(method) {
-		return true
+	groupIDs := make([]int, 0, len(have.Groups))
+	for _, group := range have.Groups {
+		groupIDs = append(groupIDs, group.ID)
 	}
 
-	return isDialError(err)
+	return sameIDs(userIDs, rule.UserIDs) && sameIDs(groupIDs, rule.GroupIDs)
 }
 
-func isIdempotent(method string) bool {
-	return method == http.MethodGet || method == http.MethodPut || method == http.MethodHead
+// sameIDs reports whether a and b hold the same IDs in any order.
+func sameIDs(a, b []int) bool {
+	a, b = slices.Clone(a), slices.Clone(b)
+	slices.Sort(a)
+	slices.Sort(b)
+	return slices.Equal(a, b)
 }
 
-// isDialError reports whether the connection was never established, which means
-// the server cannot have seen the request.
-func isDialError(err error) bool {
-	var opErr *net.OpError
-	if errors.As(err, &opErr) {
-		return opErr.Op == "dial"
+// listApprovalRules lists the MR's approval rules, every page of them, so a
+// rule past GitLab's default page of 20 is not added a second time.
+func listApprovalRules(ctx context.Context, client *http.Client, config *Config, mrIID int) ([]ApprovalRule, error) {
+	rules, err := listAll[ApprovalRule](ctx, client, config,
+		fmt.Sprintf("projects/%d/merge_requests/%d/approval_rules", config.ProjectID, mrIID))
+	if err != nil {
+		return nil, approvalRulesError(err)
 	}
-	return false
-}
 
-// retryDelay is the exponential backoff, unless GitLab asked for a specific
-// wait via Retry-After — it knows better, and ignoring it on a 429 only earns
-// another one.
-func retryDelay(config *Config, attempt int, retryAfter time.Duration) time.Duration {
-	if retryAfter > 0 {
-		if retryAfter > maxRetryDelay {
-			return maxRetryDelay
-		}
-		return retryAfter
-	}
+	return rules, nil
+}
 
-	base := config.RetryDelay
-	if base <= 0 {
-		base = defaultRetryDelay
-	}
+// isGroupMember reports whether the user is a member of the group, directly or
+// through a parent group. The group may be given by ID or by full path.
+func isGroupMember(ctx context.Context, client *http.Client, config *Config, group string, userID int) (bool, error) {
+	_, err := doRequest(ctx, client, config, http.MethodGet,
+		fmt.Sprintf("groups/%s/members/all/%d", url.PathEscape(group), userID), nil)
 
-	delay := base << attempt
-	// Shifting past the width of the type wraps; both cases mean "too long".
-	if delay > maxRetryDelay || delay <= 0 {
-		return maxRetryDelay
+	var apiErr *apiError
+	if errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusNotFound {
+		return false, nil
 	}
-	return delay
-}
-
-// parseRetryAfter reads the delay-seconds form of Retry-After, which is what
-// GitLab sends. The HTTP-date form is ignored rather than guessed at.
-func parseRetryAfter(value string) time.Duration {
-	if value == "" {
-		return 0
+	if err != nil {
+		return false, err
 	}
 
-	seconds, err := strconv.Atoi(strings.TrimSpace(value))
-	if err != nil || seconds < 0 {
-		return 0
-	}
+	return true, nil
+}
 
-	return time.Duration(seconds) * time.Second
+// createBranch creates branch from ref, which may be a branch, a tag or a SHA.
+func createBranch(ctx context.Context, client *http.Client, config *Config, branch, ref string) error {
+	_, err := doRequest(ctx, client, config, http.MethodPost,
+		fmt.Sprintf("projects/%d/repository/branches", config.ProjectID),
+		&BranchCreateRequest{Branch: branch, Ref: ref})
+	return err
 }
 
-// sleep waits for d, or returns early if the context is canceled first.
-func sleep(ctx context.Context, d time.Duration) error {
-	timer := time.NewTimer(d)
-	defer timer.Stop()
+func branchExists(ctx context.Context, client *http.Client, config *Config, branch string) (bool, error) {
+	_, err := doRequest(ctx, client, config, http.MethodGet,
+		fmt.Sprintf("projects/%d/repository/branches/%s", config.ProjectID, url.PathEscape(branch)), nil)
+	if err == nil {
+		return true, nil
+	}
 
-	select {
-	case <-ctx.Done():
-		return ctx.Err()
-	case <-timer.C:
-		return nil
+	var apiErr *apiError
+	if errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusNotFound {
+		return false, nil
 	}
+
+	return false, err
 }
 
-func getProject(ctx context.Context, client *http.Client, config *Config) (*Project, error) {
-	body, err := doRequest(ctx, client, config, http.MethodGet,
-		fmt.Sprintf("projects/%d", config.ProjectID), nil)
+// ensureBranch creates branch from ref unless it already exists, and reports
+// whether it had to.
+func ensureBranch(ctx context.Context, client *http.Client, config *Config, branch, ref string) (bool, error) {
+	exists, err := branchExists(ctx, client, config, branch)
 	if err != nil {
-		return nil, err
+		return false, fmt.Errorf("unable to check branch %s: %w", branch, err)
+	}
+	if exists {
+		return false, nil
 	}
 
-	var project Project
-	if err := json.Unmarshal(body, &project); err != nil {
-		return nil, err
+	if err := createBranch(ctx, client, config, branch, ref); err != nil {
+		return false, fmt.Errorf("unable to create branch %s from %s: %w", branch, ref, err)
 	}
 
-	return &project, nil
+	return true, nil
 }
 
-func validateMR(sourceBranch, targetBranch string) error {
-	if sourceBranch == targetBranch {
-		return fmt.Errorf("source branch and target branches must be different, source: %s and target: %s",
-			sourceBranch, targetBranch)
-	}
-	return nil
+func deleteBranch(ctx context.Context, client *http.Client, config *Config, branch string) error {
+	_, err := doRequest(ctx, client, config, http.MethodDelete,
+		fmt.Sprintf("projects/%d/repository/branches/%s", config.ProjectID, url.PathEscape(branch)), nil)
+	return err
 }
 
-func getExistingMR(ctx context.Context, client *http.Client, config *Config) (*MergeRequest, error) {
+// getRawFile reads a file from the repository at ref. A file that does not exist
+// there is reported through the bool rather than as an error.
+func getRawFile(
+	ctx context.Context, client *http.Client, config *Config, filePath, ref string,
+) ([]byte, bool, error) {
 	params := url.Values{}
-	params.Set("state", "opened")
-	params.Set("source_branch", config.SourceBranch)
-	params.Set("target_branch", config.TargetBranch)
-	params.Set("per_page", "1")
+	params.Set("ref", ref)
 
 	body, err := doRequest(ctx, client, config, http.MethodGet,
-		fmt.Sprintf("projects/%d/merge_requests?%s", config.ProjectID, params.Encode()), nil)
+		fmt.Sprintf("projects/%d/repository/files/%s/raw?%s",
+			config.ProjectID, url.PathEscape(filePath), params.Encode()), nil)
 	if err != nil {
-		return nil, err
+		var apiErr *apiError
+		if errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusNotFound {
+			return nil, false, nil
+		}
+		return nil, false, err
 	}
 
-	var mrs []MergeRequest
-	if err := json.Unmarshal(body, &mrs); err != nil {
+	return body, true, nil
+}
+
+func createCommit(
+	ctx context.Context, client *http.Client, config *Config, commitRequest *CommitCreateRequest,
+) (*Commit, error) {
+	body, err := doRequest(ctx, client, config, http.MethodPost,
+		fmt.Sprintf("projects/%d/repository/commits", config.ProjectID), commitRequest)
+	if err != nil {
 		return nil, err
 	}
 
-	if len(mrs) > 0 {
-		return &mrs[0], nil
+	// As with createMR, the commit exists once GitLab said so; an unreadable
+	// body only costs the SHA in the log line.
+	var commit Commit
+	if err := json.Unmarshal(body, &commit); err != nil {
+		fmt.Printf("Warning: commit created but response could not be read: %v\n", err)
 	}
 
-	return nil, nil
+	return &commit, nil
+}
+
+// revertCommit commits the revert of sha onto branch. GitLab answers 400 when
+// the revert does not apply cleanly, which after a merge almost always means a
+// later change touched the same lines.
+func revertCommit(ctx context.Context, client *http.Client, config *Config, sha, branch string) error {
+	_, err := doRequest(ctx, client, config, http.MethodPost,
+		fmt.Sprintf("projects/%d/repository/commits/%s/revert", config.ProjectID, url.PathEscape(sha)),
+		&CommitRevertRequest{Branch: branch})
+
+	var apiErr *apiError
+	if errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusBadRequest {
+		return fmt.Errorf(
+			"GitLab could not revert it automatically, later changes may conflict with it: %s",
+			apiErr.Body,
+		)
+	}
+
+	return err
 }
 
 // draftMarkers are the title prefixes GitLab accepts as marking a merge request
@@ -1062,7 +4748,14 @@ func stripDraftMarker(title string) string {
 	return trimmed
 }
 
+// isDraftTitle reports whether GitLab treats an MR with this title as a draft.
+func isDraftTitle(title string) bool {
+	return stripDraftMarker(title) != strings.TrimSpace(title)
+}
+
 // mrTitle builds the title for this run, applying --draft and --ready.
+// --title-from-branch stands in for a missing --title when the branch name
+// allows it.
 //
 // With --ready on an existing MR and no --title, the MR's own title is the base:
 // marking a draft ready should not also rename a title someone wrote by hand.
@@ -1079,7 +4772,16 @@ func mrTitle(config *Config, existingMR *MergeRequest) string {
 		prefix = ""
 	}
 
-	title := getMRTitle(prefix, config.Title, config.SourceBranch)
+	base := config.Title
+	if base == "" && config.TitleFromBranch {
+		var ok bool
+		if base, ok = titleFromBranch(config.SourceBranch, config.TitleTypes); !ok {
+			fmt.Fprintf(os.Stderr, "Warning: branch %s is not named type/scope-description, "+
+				"the title falls back to the branch name\n", config.SourceBranch)
+		}
+	}
+
+	title := getMRTitle(prefix, base, config.SourceBranch)
 
 	switch {
 	case config.Ready:
@@ -1091,6 +4793,143 @@ func mrTitle(config *Config, existingMR *MergeRequest) string {
 	return title
 }
 
+// conventionalTitle matches a Conventional Commits header: a type, an optional
+// scope in parentheses, an optional ! marking a breaking change, then ": " and
+// the description.
+var conventionalTitle = regexp.MustCompile(`^([a-z]+)(?:\(([^()\s]+)\))?(!)?: \S`)
+
+// looseConventionalTitle matches the headers --title-lint fix can repair: the
+// same parts in another case or spacing, such as "Feat (api) : add x".
+var looseConventionalTitle = regexp.MustCompile(`^([A-Za-z]+)\s*(?:\(([^()]*)\))?\s*(!)?\s*:\s*(\S.*)$`)
+
+// conventionalType is what a Conventional Commits type may be spelt with here.
+var conventionalType = regexp.MustCompile(`^[a-z]+$`)
+
+// branchTypeAliases map the branch prefixes teams use for the types they mean.
+var branchTypeAliases = map[string]string{
+	"feature": "feat",
+	"bugfix":  "fix",
+	"hotfix":  "fix",
+}
+
+// checkTitle holds the title to Conventional Commits with --title-lint, since
+// the squash commit takes the MR's title and release tooling parses it. A
+// draft marker is left out of the check, as GitLab drops it on merge. It
+// returns the title to use: the same one, or with fix the repaired one.
+func checkTitle(config *Config, title string) (string, error) {
+	if config.TitleLint == "" {
+		return title, nil
+	}
+
+	header := stripDraftMarker(title)
+	violation := lintTitle(header, config.TitleTypes)
+	if violation == nil {
+		return title, nil
+	}
+
+	switch config.TitleLint {
+	case titleLintWarn:
+		fmt.Fprintf(os.Stderr, "Warning: %v\n", violation)
+		return title, nil
+	case titleLintFix:
+		fixed, ok := fixTitle(header, config.SourceBranch, config.TitleTypes)
+		if !ok {
+			return "", fmt.Errorf("%w; it cannot be fixed without a type, and the branch name gives none", violation)
+		}
+		fixed = strings.TrimSuffix(strings.TrimSpace(title), header) + fixed
+		fmt.Printf("Title changed to follow Conventional Commits: %s\n", fixed)
+		return fixed, nil
+	}
+
+	return "", violation
+}
+
+// lintTitle reports how header falls short of a Conventional Commits header
+// with one of types.
+func lintTitle(header string, types []string) error {
+	match := conventionalTitle.FindStringSubmatch(header)
+	if match == nil {
+		return fmt.Errorf("title %q does not follow Conventional Commits, want type(scope): description", header)
+	}
+	if !slices.Contains(types, match[1]) {
+		return fmt.Errorf("title %q has type %s, want one of %s", header, match[1], strings.Join(types, ", "))
+	}
+	return nil
+}
+
+// fixTitle repairs a header that has a known type but is spelt loosely, or
+// else takes the type and scope from a type/scope-description branch and keeps
+// the header as the description. A header that is just the branch name, the
+// title without --title, becomes the title the branch name gives.
+func fixTitle(header, branch string, types []string) (string, bool) {
+	if match := looseConventionalTitle.FindStringSubmatch(header); match != nil {
+		if titleType := strings.ToLower(match[1]); slices.Contains(types, titleType) {
+			scope := strings.Join(strings.Fields(match[2]), "-")
+			return formatConventionalTitle(titleType, scope, match[3] != "", match[4]), true
+		}
+	}
+
+	titleType, scope, description, ok := parseBranchTitle(branch, types)
+	if !ok {
+		return "", false
+	}
+	if header != branch {
+		description = header
+	}
+	return formatConventionalTitle(titleType, scope, false, description), true
+}
+
+// titleFromBranch builds the title --title-from-branch asks for, reporting
+// false for a branch not named type/scope-description.
+func titleFromBranch(branch string, types []string) (string, bool) {
+	titleType, scope, description, ok := parseBranchTitle(branch, types)
+	if !ok {
+		return "", false
+	}
+	return formatConventionalTitle(titleType, scope, false, description), true
+}
+
+// parseBranchTitle reads a branch named type/scope-description, such as
+// feat/auth-add-login-page: the type before the slash, which may be one of
+// branchTypeAliases, then the scope up to the first hyphen and a description
+// whose words the remaining hyphens and underscores separate. A branch with no
+// hyphen after the slash, such as fix/typo, has no scope.
+func parseBranchTitle(branch string, types []string) (titleType, scope, description string, ok bool) {
+	prefix, rest, found := strings.Cut(branch, "/")
+	titleType = strings.ToLower(prefix)
+	if alias, isAlias := branchTypeAliases[titleType]; isAlias {
+		titleType = alias
+	}
+	if !found || rest == "" || !slices.Contains(types, titleType) {
+		return "", "", "", false
+	}
+
+	scope, words, hasScope := strings.Cut(rest, "-")
+	if !hasScope {
+		scope, words = "", rest
+	}
+	description = strings.Join(strings.FieldsFunc(words, func(r rune) bool {
+		return r == '-' || r == '_'
+	}), " ")
+	if description == "" {
+		return "", "", "", false
+	}
+
+	return titleType, scope, description, true
+}
+
+// formatConventionalTitle writes a Conventional Commits header.
+func formatConventionalTitle(titleType, scope string, breaking bool, description string) string {
+	header := titleType
+	if scope != "" {
+		header += "(" + scope + ")"
+	}
+	if breaking {
+		header += "!"
+	}
+	return header + ": " + description
+}
+
 func getMRTitle(prefix, title, sourceBranch string) string {
 	if title != "" {
 		if prefix != "" {
@@ -1185,30 +5024,315 @@ func updateMR(
 	return err
 }
 
-func acceptMR(ctx context.Context, client *http.Client, config *Config, mrIID int) error {
+func acceptMR(ctx context.Context, client *http.Client, config *Config, mrIID int, sha string) error {
 	acceptRequest := &MRAcceptRequest{
-		MergeWhenPipelineSucceeds: true,
-		ShouldRemoveSourceBranch:  config.RemoveBranch,
-		Squash:                    config.SquashCommits,
+		ShouldRemoveSourceBranch: config.RemoveBranch,
+		Squash:                   config.SquashCommits,
+		SHA:                      sha,
 	}
 
-	_, err := doRequest(ctx, client, config, http.MethodPut,
-		fmt.Sprintf("projects/%d/merge_requests/%d/merge", config.ProjectID, mrIID), acceptRequest)
+	if config.server.supports(featureAutoMergeParam) {
+		acceptRequest.AutoMerge = true
+	} else {
+		acceptRequest.MergeWhenPipelineSucceeds = true
+	}
+
+	var err error
+	acceptRequest.MergeCommitMessage, acceptRequest.SquashCommitMessage, err = commitMessages(ctx, client, config, mrIID)
+	if err != nil {
+		return err
+	}
+
+	_, err = putMerge(ctx, client, config, mrIID, acceptRequest)
+	return err
+}
+
+// putMerge sends a merge request's merge call, turning the statuses GitLab
+// refuses a merge with into messages that say why, and returns the MR as
+// GitLab reports it afterwards.
+func putMerge(
+	ctx context.Context, client *http.Client, config *Config, mrIID int, request *MRAcceptRequest,
+) ([]byte, error) {
+	body, err := doRequest(ctx, client, config, http.MethodPut,
+		fmt.Sprintf("projects/%d/merge_requests/%d/merge", config.ProjectID, mrIID), request)
 
 	var apiErr *apiError
 	if errors.As(err, &apiErr) {
 		switch apiErr.StatusCode {
 		case http.StatusMethodNotAllowed:
-			return fmt.Errorf(
+			return nil, fmt.Errorf(
 				"merge request cannot be merged, " +
 					"the pipeline may not have started yet or other merge conditions are not met",
 			)
 		case http.StatusNotAcceptable:
-			return fmt.Errorf(
+			return nil, fmt.Errorf(
 				"merge request cannot be merged, " +
 					"there may be unresolved discussions or other blocking conditions",
 			)
+		case http.StatusConflict:
+			return nil, errBranchMoved
+		}
+	}
+
+	return body, err
+}
+
+// commitMessageData is what the --merge-commit-message and
+// --squash-commit-message templates can refer to.
+type commitMessageData struct {
+	Title        string
+	IID          int
+	SourceBranch string
+	TargetBranch string
+	// Issues are the issue references, such as "#12", found in the source
+	// branch name, the title and the description, in that order.
+	Issues []string
+	// CoAuthors are the distinct authors of the MR's commits, as
+	// "Name <email>", ready for Co-authored-by trailers.
+	CoAuthors []string
+}
+
+// commitMessages renders the commit message templates for the MR. The MR and
+// its commits are read fresh: an MR this run just updated still has its old
+// title in the copy the run holds. Not being able to list the commits only
+// leaves CoAuthors empty.
+func commitMessages(
+	ctx context.Context, client *http.Client, config *Config, mrIID int,
+) (mergeMessage, squashMessage string, err error) {
+	if config.MergeCommitMessage == "" && config.SquashCommitMessage == "" {
+		return "", "", nil
+	}
+
+	mr, err := getMR(ctx, client, config, mrIID, nil)
+	if err != nil {
+		return "", "", fmt.Errorf("unable to read the MR for its commit messages: %w", err)
+	}
+
+	data := &commitMessageData{
+		Title:        stripDraftMarker(mr.Title),
+		IID:          mr.IID,
+		SourceBranch: mr.SourceBranch,
+		TargetBranch: mr.TargetBranch,
+		Issues:       issueReferences(mr.SourceBranch, mr.Title, mr.Description),
+	}
+
+	commits, err := getMRCommits(ctx, client, config, mrIID)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: could not list the MR's commits for co-authors: %v\n", err)
+	}
+	data.CoAuthors = coAuthors(commits, mr.Author)
+
+	mergeMessage, err = renderCommitMessage("--merge-commit-message", config.MergeCommitMessage, data)
+	if err != nil {
+		return "", "", err
+	}
+	squashMessage, err = renderCommitMessage("--squash-commit-message", config.SquashCommitMessage, data)
+	if err != nil {
+		return "", "", err
+	}
+
+	return mergeMessage, squashMessage, nil
+}
+
+// renderCommitMessage executes one commit message template. Text without
+// template actions comes out unchanged, and an empty template renders empty so
+// GitLab keeps generating that message itself.
+func renderCommitMessage(flagName, text string, data *commitMessageData) (string, error) {
+	if text == "" {
+		return "", nil
+	}
+
+	tmpl, err := parseCommitMessage(flagName, text)
+	if err != nil {
+		return "", err
+	}
+
+	var out strings.Builder
+	if err := tmpl.Execute(&out, data); err != nil {
+		return "", fmt.Errorf("invalid %s template: %w", flagName, err)
+	}
+
+	return strings.TrimSpace(out.String()), nil
+}
+
+// parseCommitMessage parses one commit message template.
+func parseCommitMessage(flagName, text string) (*template.Template, error) {
+	tmpl, err := template.New(flagName).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s template: %w", flagName, err)
+	}
+	return tmpl, nil
+}
+
+// issueReferences collects the distinct #N references across texts, in the
+// order they first appear.
+func issueReferences(texts ...string) []string {
+	re := regexp.MustCompile(`#\d+\b`)
+
+	var refs []string
+	seen := map[string]bool{}
+	for _, text := range texts {
+		for _, ref := range re.FindAllString(text, -1) {
+			if !seen[ref] {
+				seen[ref] = true
+				refs = append(refs, ref)
+			}
+		}
+	}
+
+	return refs
+}
+
+// coAuthors lists the distinct commit authors as "Name <email>". GitLab lists an
+// MR's commits newest first; the result is oldest first, the order people
+// joined in.
+//
+// The MR's author is left out, as the commit is theirs already. The API gives
+// no email for them, so their commits are told by the author name matching
+// their GitLab name or username.
+func coAuthors(commits []Commit, mrAuthor User) []string {
+	var authors []string
+	seen := map[string]bool{}
+	for i := len(commits) - 1; i >= 0; i-- {
+		email := strings.ToLower(commits[i].AuthorEmail)
+		if email == "" || seen[email] || isUser(commits[i].AuthorName, mrAuthor) {
+			continue
 		}
+		seen[email] = true
+		authors = append(authors, fmt.Sprintf("%s <%s>", commits[i].AuthorName, commits[i].AuthorEmail))
+	}
+	return authors
+}
+
+// isUser reports whether a commit author name is the user's GitLab name or
+// username.
+func isUser(authorName string, user User) bool {
+	authorName = strings.TrimSpace(authorName)
+	return authorName != "" && (strings.EqualFold(authorName, user.Name) || strings.EqualFold(authorName, user.Username))
+}
+
+// gitlabVersion is a GitLab release, to the precision features are added at.
+type gitlabVersion struct {
+	Major, Minor int
+}
+
+func (v gitlabVersion) atLeast(other gitlabVersion) bool {
+	if v.Major != other.Major {
+		return v.Major > other.Major
+	}
+	return v.Minor >= other.Minor
+}
+
+// Features whose availability depends on the GitLab release.
+const (
+	featureAutoMergeParam      = "auto_merge"
+	featureDetailedMergeStatus = "detailed_merge_status"
+	featureMergeTrainsAPI      = "merge_trains_api"
+)
+
+// capabilities is the table of what each feature needs from the server: the
+// release it first appeared in, and what to assume when the release is not
+// known. The assumption is chosen per feature by what a wrong guess costs.
+var capabilities = map[string]struct {
+	since         gitlabVersion
+	assumeUnknown bool
+}{
+	// auto_merge replaced merge_when_pipeline_succeeds in 17.11. Older
+	// releases ignore it, so an unknown server gets the parameter every
+	// release still accepts.
+	featureAutoMergeParam: {since: gitlabVersion{17, 11}, assumeUnknown: false},
+	// An unknown server is asked anyway: a missing status reads as "nothing
+	// to wait for", so guessing wrong costs one request.
+	featureDetailedMergeStatus: {since: gitlabVersion{15, 6}, assumeUnknown: true},
+	// Adding to a train through its own API came in 15.11. An unknown server
+	// is tried: a release without it answers 404, which is reported as is.
+	featureMergeTrainsAPI: {since: gitlabVersion{15, 11}, assumeUnknown: true},
+}
+
+// serverInfo is what is known about the GitLab instance. The zero value, and a
+// nil pointer, stand for a server whose release could not be determined.
+type serverInfo struct {
+	version string
+	release gitlabVersion
+	known   bool
+}
+
+// supports reports whether the server has feature, going by the capabilities
+// table. Features missing from the table are assumed present.
+func (s *serverInfo) supports(feature string) bool {
+	capability, ok := capabilities[feature]
+	if !ok {
+		return true
+	}
+	if s == nil || !s.known {
+		return capability.assumeUnknown
+	}
+	return s.release.atLeast(capability.since)
+}
+
+// gitlabServer returns what the instance reports about itself, asking GET
+// /version only the first time in a run. Not being able to tell is a warning:
+// every feature has a safe assumption for an unknown release.
+func gitlabServer(ctx context.Context, client *http.Client, config *Config) *serverInfo {
+	if config.server != nil {
+		return config.server
+	}
+	config.server = &serverInfo{}
+
+	body, err := doRequest(ctx, client, config, http.MethodGet, "version", nil)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: could not determine the GitLab version: %v\n", err)
+		return config.server
+	}
+
+	var version struct {
+		Version string `json:"version"`
+	}
+	if err := json.Unmarshal(body, &version); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: could not read the GitLab version: %v\n", err)
+		return config.server
+	}
+
+	config.server.version = version.Version
+	config.server.release, config.server.known = parseGitLabVersion(version.Version)
+	if !config.server.known {
+		fmt.Fprintf(os.Stderr, "Warning: unrecognized GitLab version %q\n", version.Version)
+	}
+
+	return config.server
+}
+
+// parseGitLabVersion reads the major and minor release out of what GET /version
+// reports, such as "17.11.2-ee" or "16.0.0-pre".
+func parseGitLabVersion(version string) (gitlabVersion, bool) {
+	matches := regexp.MustCompile(`^(\d+)\.(\d+)`).FindStringSubmatch(strings.TrimSpace(version))
+	if matches == nil {
+		return gitlabVersion{}, false
+	}
+
+	major, err := strconv.Atoi(matches[1])
+	if err != nil {
+		return gitlabVersion{}, false
+	}
+	minor, err := strconv.Atoi(matches[2])
+	if err != nil {
+		return gitlabVersion{}, false
+	}
+
+	return gitlabVersion{Major: major, Minor: minor}, true
+}
+
+// cancelAutoMerge withdraws a pending auto-merge, which on a project with merge
+// trains also takes the MR off the train. It returns errNothingToCancel when
+// there is nothing to withdraw.
+func cancelAutoMerge(ctx context.Context, client *http.Client, config *Config, mrIID int) error {
+	_, err := doRequest(ctx, client, config, http.MethodPost,
+		fmt.Sprintf("projects/%d/merge_requests/%d/cancel_merge_when_pipeline_succeeds",
+			config.ProjectID, mrIID), nil)
+
+	var apiErr *apiError
+	if errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusNotAcceptable {
+		return errNothingToCancel
 	}
 
 	return err
@@ -1292,3 +5416,287 @@ func parseIntSlice(s string) []int {
 
 	return result
 }
+
+// repeatedFlag collects every value of a flag that may be given more than once,
+// for values that may themselves contain commas.
+type repeatedFlag []string
+
+func (f *repeatedFlag) String() string {
+	return strings.Join(*f, ", ")
+}
+
+func (f *repeatedFlag) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
+
+// loadApprovalRules reads the --approval-rules file, a JSON array of rules.
+// Unknown fields are refused so a misspelt "paths" does not quietly turn a rule
+// into one that applies to every MR.
+func loadApprovalRules(file string) ([]ApprovalRuleConfig, error) {
+	if file == "" {
+		return nil, nil
+	}
+
+	// #nosec G304 -- the path comes from the caller's own --approval-rules flag
+	// and the tool runs with the caller's rights, so there is no privilege
+	// boundary here.
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read --approval-rules: %w", err)
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+
+	var rules []ApprovalRuleConfig
+	if err := decoder.Decode(&rules); err != nil {
+		return nil, fmt.Errorf("invalid --approval-rules file %s: %w", file, err)
+	}
+
+	seen := map[string]bool{}
+	for i, rule := range rules {
+		switch {
+		case strings.TrimSpace(rule.Name) == "":
+			return nil, fmt.Errorf("invalid --approval-rules file %s: rule %d has no name", file, i+1)
+		case seen[rule.Name]:
+			return nil, fmt.Errorf("invalid --approval-rules file %s: rule %q appears twice", file, rule.Name)
+		case rule.ApprovalsRequired < 0:
+			return nil, fmt.Errorf("invalid --approval-rules file %s: rule %q requires %d approvals",
+				file, rule.Name, rule.ApprovalsRequired)
+		}
+		for _, pattern := range rule.Paths {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("invalid --approval-rules file %s: rule %q has a bad glob %s",
+					file, rule.Name, pattern)
+			}
+		}
+		seen[rule.Name] = true
+	}
+
+	return rules, nil
+}
+
+// parseRuleFlags fills in the rules the MR and its branch are held to: the
+// --approve-paths allowlist, the --approval-rules file and the --branch-policy
+// forms.
+func parseRuleFlags(config *Config, approvePaths, approvalRulesFile string, branchPolicy []string) error {
+	var err error
+	if config.ApprovePaths, err = parseApprovePaths(approvePaths); err != nil {
+		return err
+	}
+	if config.ApprovalRules, err = loadApprovalRules(approvalRulesFile); err != nil {
+		return err
+	}
+
+	config.BranchPolicy, err = parseBranchPolicy(branchPolicy)
+	return err
+}
+
+// parseLabelFlags fills in the label settings that need more than a flag's
+// value: the labels derived from the changes, --path-label and --size-labels,
+// and the --label-definitions file.
+func parseLabelFlags(
+	config *Config, pathLabels []string, sizeThresholds, sizeExclude, labelDefinitionsFile string,
+) error {
+	var err error
+	if config.PathLabels, err = parsePathLabels(pathLabels); err != nil {
+		return err
+	}
+	if config.SizeThresholds, err = parseSizeThresholds(sizeThresholds); err != nil {
+		return err
+	}
+	config.SizeExclude = parseStringSlice(sizeExclude)
+
+	config.LabelDefinitions, err = loadLabelDefinitions(labelDefinitionsFile)
+	return err
+}
+
+// parseMilestone reads --milestone: a number is the milestone's ID, anything
+// else a title, or active, that resolveMilestone looks up once GitLab can be
+// asked. A title behind milestoneTitlePrefix is a title even if it reads like
+// a number or like active.
+func parseMilestone(config *Config, value string) error {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return nil
+	}
+	if title, ok := strings.CutPrefix(value, milestoneTitlePrefix); ok {
+		if strings.TrimSpace(title) == "" {
+			return fmt.Errorf("--milestone %s needs a title after it", milestoneTitlePrefix)
+		}
+		config.Milestone = value
+		return nil
+	}
+
+	id, err := strconv.Atoi(value)
+	if err != nil {
+		config.Milestone = value
+		return nil
+	}
+	if id < 0 {
+		return fmt.Errorf("--milestone must not be negative, got %d", id)
+	}
+
+	config.MilestoneID = id
+	return nil
+}
+
+// loadLabelDefinitions reads the --label-definitions file, a JSON array of
+// labels with their colors and descriptions.
+func loadLabelDefinitions(file string) ([]LabelDefinition, error) {
+	if file == "" {
+		return nil, nil
+	}
+
+	// #nosec G304 -- the path comes from the caller's own --label-definitions
+	// flag and the tool runs with the caller's rights, so there is no privilege
+	// boundary here.
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read --label-definitions: %w", err)
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+
+	var definitions []LabelDefinition
+	if err := decoder.Decode(&definitions); err != nil {
+		return nil, fmt.Errorf("invalid --label-definitions file %s: %w", file, err)
+	}
+
+	for i, definition := range definitions {
+		if strings.TrimSpace(definition.Name) == "" {
+			return nil, fmt.Errorf("invalid --label-definitions file %s: label %d has no name", file, i+1)
+		}
+		if definition.Color == "" {
+			definitions[i].Color = defaultLabelColor
+		}
+	}
+
+	return definitions, nil
+}
+
+// parseSizeThresholds parses --size-thresholds: the changed lines at which an
+// MR stops being XS, S, M and L.
+func parseSizeThresholds(value string) ([]int, error) {
+	parts := strings.Split(value, ",")
+	if len(parts) != len(sizeNames)-1 {
+		return nil, fmt.Errorf("invalid --size-thresholds %q, want %d increasing numbers", value, len(sizeNames)-1)
+	}
+
+	thresholds := make([]int, 0, len(parts))
+	for _, part := range parts {
+		threshold, err := strconv.Atoi(strings.TrimSpace(part))
+		if err != nil || threshold <= 0 || (len(thresholds) > 0 && threshold <= thresholds[len(thresholds)-1]) {
+			return nil, fmt.Errorf("invalid --size-thresholds %q, want %d increasing numbers", value, len(sizeNames)-1)
+		}
+		thresholds = append(thresholds, threshold)
+	}
+
+	return thresholds, nil
+}
+
+// parsePathLabels parses the --path-label GLOB=LABEL values. The glob is
+// checked here, since a malformed one would otherwise just never match.
+func parsePathLabels(values []string) ([]PathLabel, error) {
+	var mappings []PathLabel
+	for _, value := range values {
+		pattern, label, ok := strings.Cut(value, "=")
+		pattern, label = strings.TrimSpace(pattern), strings.TrimSpace(label)
+		if !ok || pattern == "" || label == "" {
+			return nil, fmt.Errorf("invalid --path-label %q, want GLOB=LABEL", value)
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid --path-label %q: bad glob %s", value, pattern)
+		}
+		mappings = append(mappings, PathLabel{Pattern: pattern, Label: label})
+	}
+	return mappings, nil
+}
+
+// parseApprovePaths parses the --approve-paths globs. They are checked here,
+// since a malformed one would otherwise just never match.
+func parseApprovePaths(value string) ([]string, error) {
+	patterns := parseStringSlice(value)
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid --approve-paths: bad glob %s", pattern)
+		}
+	}
+	return patterns, nil
+}
+
+// parseBranchPolicy parses the --branch-policy REGEX=MESSAGE values. The regex
+// is compiled here, so a typo in it fails every run rather than every branch.
+func parseBranchPolicy(values []string) ([]BranchRule, error) {
+	var rules []BranchRule
+	for _, value := range values {
+		pattern, message, ok := strings.Cut(value, "=")
+		pattern, message = strings.TrimSpace(pattern), strings.TrimSpace(message)
+		if !ok || pattern == "" || message == "" {
+			return nil, fmt.Errorf("invalid --branch-policy %q, want REGEX=MESSAGE", value)
+		}
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid --branch-policy %q: %w", value, err)
+		}
+		rules = append(rules, BranchRule{Pattern: re, Message: message})
+	}
+	return rules, nil
+}
+
+// pipelineVariableKey is what GitLab accepts as a CI/CD variable name.
+var pipelineVariableKey = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// loadPipelineVariables combines the --pipeline-variables-file entries with the
+// --pipeline-variable flags. The file takes KEY=VALUE lines, skipping blank
+// lines and # comments; a flag overrides a file entry with the same key.
+func loadPipelineVariables(file string, values []string) ([]PipelineVariable, error) {
+	// Each entry keeps where it came from, for errors that must not echo it.
+	type entry struct {
+		text, source string
+	}
+
+	var entries []entry
+	if file != "" {
+		// #nosec G304 -- the path comes from the caller's own --pipeline-variables-file
+		// flag and the tool runs with the caller's rights, so there is no privilege
+		// boundary here.
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read --pipeline-variables-file: %w", err)
+		}
+		for i, line := range strings.Split(string(data), "\n") {
+			line = strings.TrimSpace(line)
+			if line != "" && !strings.HasPrefix(line, "#") {
+				entries = append(entries, entry{line, fmt.Sprintf("line %d of --pipeline-variables-file %s", i+1, file)})
+			}
+		}
+	}
+	for i, value := range values {
+		entries = append(entries, entry{value, fmt.Sprintf("--pipeline-variable number %d", i+1)})
+	}
+
+	var variables []PipelineVariable
+	index := map[string]int{}
+	for _, e := range entries {
+		key, value, ok := strings.Cut(e.text, "=")
+		key = strings.TrimSpace(key)
+		if !ok || !pipelineVariableKey.MatchString(key) {
+			// Neither key nor value is echoed: without an =, what would be the
+			// key may well be a secret pasted on its own.
+			return nil, fmt.Errorf("invalid pipeline variable in %s, want KEY=VALUE with a key of letters, "+
+				"digits and underscores", e.source)
+		}
+
+		if i, seen := index[key]; seen {
+			variables[i].Value = value
+			continue
+		}
+		index[key] = len(variables)
+		variables = append(variables, PipelineVariable{Key: key, Value: value})
+	}
+
+	return variables, nil
+}
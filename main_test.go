@@ -7,6 +7,7 @@ import (
 	"encoding/pem"
 	"errors"
 	"flag"
+	"fmt"
 	"io"
 	"net"
 	"net/http"
@@ -14,6 +15,7 @@ import (
 	"os"
 	"path/filepath"
 	"regexp"
+	"slices"
 	"strings"
 	"sync/atomic"
 	"testing"
@@ -1185,7 +1187,7 @@ func TestAcceptMR(t *testing.T) {
 		SquashCommits: true,
 	}
 
-	err := acceptMR(context.Background(), client, config, 42)
+	err := acceptMR(context.Background(), client, config, 42, "")
 	if err != nil {
 		t.Errorf("Expected no error, got %v", err)
 	}
@@ -1204,7 +1206,7 @@ func TestAcceptMR405(t *testing.T) {
 		PrivateToken: "test-token",
 	}
 
-	err := acceptMR(context.Background(), client, config, 42)
+	err := acceptMR(context.Background(), client, config, 42, "")
 	if err == nil {
 		t.Error("Expected error for 405 response")
 	}
@@ -1226,7 +1228,7 @@ func TestAcceptMR401(t *testing.T) {
 		PrivateToken: "bad-token",
 	}
 
-	err := acceptMR(context.Background(), client, config, 42)
+	err := acceptMR(context.Background(), client, config, 42, "")
 	if err == nil {
 		t.Error("Expected error for 401 response")
 	}
@@ -1248,7 +1250,7 @@ func TestAcceptMR406(t *testing.T) {
 		PrivateToken: "test-token",
 	}
 
-	err := acceptMR(context.Background(), client, config, 42)
+	err := acceptMR(context.Background(), client, config, 42, "")
 	if err == nil {
 		t.Error("Expected error for 406 response")
 	}
@@ -1326,6 +1328,8 @@ func TestRunWithAutoMerge(t *testing.T) {
 		case strings.HasPrefix(r.URL.Path, "/api/v4/projects/123") && r.Method == "GET" && !strings.Contains(r.URL.Path, "merge_requests"):
 			project := Project{ID: 123, Name: "test-project", DefaultBranch: "main"}
 			json.NewEncoder(w).Encode(project)
+		case r.URL.Path == "/api/v4/projects/123/merge_requests/10" && r.Method == "GET":
+			json.NewEncoder(w).Encode(MergeRequest{ID: 1, IID: 10, DetailedMergeStatus: "mergeable"})
 		case strings.HasPrefix(r.URL.Path, "/api/v4/projects/123/merge_requests") && r.Method == "GET":
 			json.NewEncoder(w).Encode([]MergeRequest{})
 		case strings.HasPrefix(r.URL.Path, "/api/v4/projects/123/merge_requests") && r.Method == "POST":
@@ -1370,6 +1374,8 @@ func TestRunWithAutoMergeUpdate(t *testing.T) {
 		case strings.HasPrefix(r.URL.Path, "/api/v4/projects/123") && r.Method == "GET" && !strings.Contains(r.URL.Path, "merge_requests"):
 			project := Project{ID: 123, Name: "test-project", DefaultBranch: "main"}
 			json.NewEncoder(w).Encode(project)
+		case r.URL.Path == "/api/v4/projects/123/merge_requests/5" && r.Method == "GET":
+			json.NewEncoder(w).Encode(MergeRequest{ID: 1, IID: 5, DetailedMergeStatus: "mergeable"})
 		case strings.HasPrefix(r.URL.Path, "/api/v4/projects/123/merge_requests") && r.Method == "GET":
 			mrs := []MergeRequest{{ID: 1, IID: 5, Title: "Existing MR", SourceBranch: "feature/test", TargetBranch: "main", State: "opened"}}
 			json.NewEncoder(w).Encode(mrs)
@@ -1472,6 +1478,8 @@ func TestRunWithAutoMergeExistingMRNoUpdate(t *testing.T) {
 		case r.URL.Path == "/api/v4/projects/123/merge_requests" && r.Method == "GET":
 			mrs := []MergeRequest{{ID: 1, IID: 7, Title: "Existing MR", SourceBranch: "feature/test", TargetBranch: "main", State: "opened"}}
 			json.NewEncoder(w).Encode(mrs)
+		case r.URL.Path == "/api/v4/projects/123/merge_requests/7" && r.Method == "GET":
+			json.NewEncoder(w).Encode(MergeRequest{ID: 1, IID: 7, DetailedMergeStatus: "mergeable"})
 		case r.URL.Path == "/api/v4/projects/123/merge_requests/7/merge" && r.Method == "PUT":
 			autoMergeCalled = true
 			w.WriteHeader(http.StatusOK)
@@ -1674,6 +1682,10 @@ func TestMergeLabels(t *testing.T) {
 		{"deduplicates", []string{"bug", "backend"}, []string{"backend", "ci"}, []string{"bug", "backend", "ci"}},
 		{"base order first", []string{"z", "a"}, []string{"a", "m"}, []string{"z", "a", "m"}},
 		{"case sensitive", []string{"Bug"}, []string{"bug"}, []string{"Bug", "bug"}},
+		{"base wins within a scope", []string{"status::review"}, []string{"status::todo", "bug"},
+			[]string{"status::review", "bug"}},
+		{"first wins within base", []string{"status::review", "status::done"}, nil, []string{"status::review"}},
+		{"nested scope is its own", []string{"a::b::c"}, []string{"a::d"}, []string{"a::b::c", "a::d"}},
 	}
 
 	for _, tt := range tests {
@@ -1694,8 +1706,436 @@ func TestMergeLabels(t *testing.T) {
 	}
 }
 
-// newIssueMetadataServer serves a project, no existing MR, and an issue carrying
-// milestone 99 and labels ["from-issue", "shared"]. It records the create request.
+func TestMatchPathGlob(t *testing.T) {
+	tests := []struct {
+		pattern string
+		name    string
+		want    bool
+	}{
+		{"docs/**", "docs/index.md", true},
+		{"docs/**", "docs/guide/setup/linux.md", true},
+		{"docs/**", "src/docs/index.md", false},
+		{"**/*.sql", "schema.sql", true},
+		{"**/*.sql", "db/migrations/001_init.sql", true},
+		{"db/**/*.sql", "db/001.sql", true},
+		{"db/**/*.sql", "db/a/b/001.sql", true},
+		{"db/**/*.sql", "db/a/b/001.go", false},
+		{"*.md", "README.md", true},
+		{"*.md", "docs/README.md", false},
+		{"src/*/main.go", "src/app/main.go", true},
+		{"src/*/main.go", "src/app/cmd/main.go", false},
+		{"go.sum", "go.sum", true},
+		{"**", "anything/at/all", true},
+	}
+
+	for _, tt := range tests {
+		if got := matchPathGlob(tt.pattern, tt.name); got != tt.want {
+			t.Errorf("matchPathGlob(%q, %q) = %v, want %v", tt.pattern, tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestCurrentMilestone(t *testing.T) {
+	now := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+
+	milestones := []Milestone{
+		{ID: 1, Title: "Backlog"},
+		{ID: 2, Title: "Sprint 41", StartDate: "2026-10-01", DueDate: "2026-10-14"},
+		{ID: 3, Title: "Q4", StartDate: "2026-10-01", DueDate: "2026-12-31"},
+		{ID: 4, Title: "Sprint 42", StartDate: "2026-10-15", DueDate: "2026-10-28"},
+		{ID: 5, Title: "Sprint 43", StartDate: "2026-10-29", DueDate: "2026-11-11"},
+	}
+	if got := currentMilestone(milestones, now); got == nil || got.ID != 4 {
+		t.Errorf("currentMilestone() = %+v, want Sprint 42, the one due first among those under way", got)
+	}
+
+	if got := currentMilestone([]Milestone{{ID: 6, DueDate: "2026-10-18"}}, now); got == nil || got.ID != 6 {
+		t.Errorf("currentMilestone() = %+v, want the milestone due today without a start date", got)
+	}
+
+	if got := currentMilestone(milestones[:2], now); got != nil {
+		t.Errorf("currentMilestone() = %+v, want none", got)
+	}
+}
+
+func TestResolveMilestone(t *testing.T) {
+	today := time.Now().Format(time.DateOnly)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v4/projects/123/milestones" || r.URL.Query().Get("state") != "active" {
+			t.Errorf("unexpected request %s %s", r.Method, r.URL)
+		}
+		if r.URL.Query().Get("page") == "2" {
+			writeTestJSON(t, w, []Milestone{{ID: 9, Title: "2025"}, {ID: 10, Title: "active"}})
+			return
+		}
+		milestones := []Milestone{
+			{ID: 7, Title: "v2.0"},
+			{ID: 8, Title: "Current", StartDate: "2000-01-01", DueDate: today},
+		}
+		for i := len(milestones); i < listPageSize; i++ {
+			milestones = append(milestones, Milestone{ID: 100 + i, Title: fmt.Sprintf("Old %d", i)})
+		}
+		writeTestJSON(t, w, milestones)
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		milestone string
+		wantID    int
+		errSubstr string
+	}{
+		{milestone: "v2.0", wantID: 7},
+		{milestone: milestoneActive, wantID: 8},
+		{milestone: "title:2025", wantID: 9},
+		{milestone: "title:active", wantID: 10},
+		{milestone: "v3.0", errSubstr: `--milestone "v3.0": no active milestone has that title`},
+	}
+
+	for _, tt := range tests {
+		config := &Config{GitLabURL: server.URL, ProjectID: 123, PrivateToken: "test-token", Milestone: tt.milestone}
+		var err error
+		captureOutput(t, func() { err = resolveMilestone(context.Background(), &http.Client{}, config) })
+		if tt.errSubstr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.errSubstr) {
+				t.Errorf("resolveMilestone(%q) error = %v, want it to contain %q", tt.milestone, err, tt.errSubstr)
+			}
+			continue
+		}
+		if err != nil || config.MilestoneID != tt.wantID {
+			t.Errorf("resolveMilestone(%q) = %d, %v, want %d", tt.milestone, config.MilestoneID, err, tt.wantID)
+		}
+	}
+}
+
+// TestEnsureLabels pins --missing-labels: a label spelled differently from an
+// existing group label takes the group label's spelling, and a missing one
+// fails the run or is created with its definition.
+func TestEnsureLabels(t *testing.T) {
+	tests := []struct {
+		mode        string
+		want        []string
+		wantCreated []LabelDefinition
+		errSubstr   string
+	}{
+		{mode: "", want: []string{"bug", "backend", "size::M"}},
+		{mode: missingLabelsFail, errSubstr: "labels not found in the project or its groups: size::M; pass --missing-labels create"},
+		{
+			mode:        missingLabelsCreate,
+			want:        []string{"Bug", "backend", "size::M"},
+			wantCreated: []LabelDefinition{{Name: "size::M", Color: "#FFAA00", Description: "Medium change"}},
+		},
+	}
+
+	for _, tt := range tests {
+		var created []LabelDefinition
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			switch {
+			case r.URL.Path == "/api/v4/projects/123/labels" && r.Method == http.MethodGet:
+				switch r.URL.Query().Get("search") {
+				case "bug":
+					_, _ = w.Write([]byte(`[{"id":1,"name":"Bug"},{"id":2,"name":"bugfix"}]`))
+				case "backend":
+					_, _ = w.Write([]byte(`[{"id":3,"name":"Backend"},{"id":4,"name":"backend"}]`))
+				default:
+					_, _ = w.Write([]byte(`[]`))
+				}
+			case r.URL.Path == "/api/v4/projects/123/labels" && r.Method == http.MethodPost:
+				var definition LabelDefinition
+				if err := json.NewDecoder(r.Body).Decode(&definition); err != nil {
+					t.Errorf("decode label: %v", err)
+				}
+				created = append(created, definition)
+				w.WriteHeader(http.StatusCreated)
+				_, _ = w.Write([]byte(`{}`))
+			default:
+				t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+			}
+		}))
+
+		config := &Config{
+			GitLabURL: server.URL, ProjectID: 123, PrivateToken: "test-token", MissingLabels: tt.mode,
+			LabelDefinitions: []LabelDefinition{{Name: "size::M", Color: "#FFAA00", Description: "Medium change"}},
+		}
+		var got []string
+		var err error
+		captureOutput(t, func() {
+			got, err = ensureLabels(context.Background(), &http.Client{}, config, []string{"bug", "backend", "size::M"})
+		})
+		server.Close()
+
+		if tt.errSubstr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.errSubstr) {
+				t.Errorf("mode %q: ensureLabels() error = %v, want it to contain %q", tt.mode, err, tt.errSubstr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("mode %q: ensureLabels() error = %v", tt.mode, err)
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("mode %q: ensureLabels() = %v, want %v", tt.mode, got, tt.want)
+		}
+		if !slices.Equal(created, tt.wantCreated) {
+			t.Errorf("mode %q: created %v, want %v", tt.mode, created, tt.wantCreated)
+		}
+	}
+}
+
+func TestValidateLabelFlags(t *testing.T) {
+	definitions := []LabelDefinition{{Name: "size::M", Color: "#FFAA00"}}
+
+	tests := []struct {
+		config    Config
+		errSubstr string
+	}{
+		{config: Config{MissingLabels: missingLabelsCreate, LabelDefinitions: definitions}},
+		{config: Config{MissingLabels: "ignore"}, errSubstr: `unknown --missing-labels "ignore"`},
+		{config: Config{LabelMode: "append"}, errSubstr: `unknown --label-mode "append"`},
+		{
+			config:    Config{MissingLabels: missingLabelsFail, LabelDefinitions: definitions},
+			errSubstr: "--label-definitions has no effect without --missing-labels create",
+		},
+	}
+
+	for _, tt := range tests {
+		err := validateConfig(&tt.config)
+		if tt.errSubstr == "" {
+			if err != nil {
+				t.Errorf("validateConfig(%+v) error = %v, want nil", tt.config, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tt.errSubstr) {
+			t.Errorf("validateConfig(%+v) error = %v, want it to contain %q", tt.config, err, tt.errSubstr)
+		}
+	}
+}
+
+func TestSizeLabel(t *testing.T) {
+	lines := func(n int, prefix string) string {
+		return "@@ -1 +1 @@\n" + strings.Repeat(prefix+"x\n", n) + " context"
+	}
+
+	tests := []struct {
+		name     string
+		diffs    []FileDiff
+		want     string
+		wantWarn bool
+	}{
+		{name: "nothing", want: "size::XS"},
+		{name: "XS", diffs: []FileDiff{{NewPath: "a.go", Diff: lines(9, "+")}}, want: "size::XS"},
+		{
+			name:  "S, added and removed together",
+			diffs: []FileDiff{{NewPath: "a.go", Diff: lines(5, "+")}, {NewPath: "b.go", Diff: lines(5, "-")}},
+			want:  "size::S",
+		},
+		{name: "M", diffs: []FileDiff{{NewPath: "a.go", Diff: lines(249, "+")}}, want: "size::M"},
+		{name: "L", diffs: []FileDiff{{NewPath: "a.go", Diff: lines(250, "-")}}, want: "size::L"},
+		{name: "XL", diffs: []FileDiff{{NewPath: "a.go", Diff: lines(1000, "+")}}, want: "size::XL"},
+		{
+			name: "vendored and generated files do not count",
+			diffs: []FileDiff{
+				{NewPath: "a.go", Diff: lines(3, "+")},
+				{NewPath: "vendor/lib/lib.go", Diff: lines(5000, "+")},
+				{NewPath: "web/package-lock.json", Diff: lines(5000, "+")},
+				{NewPath: "api.pb.go", Diff: lines(5000, "+"), GeneratedFile: true},
+			},
+			want: "size::XS",
+		},
+		{
+			name:  "a diff left out as too large is at least L",
+			diffs: []FileDiff{{NewPath: "a.go", Diff: lines(3, "+")}, {NewPath: "schema.sql", TooLarge: true}},
+			want:  "size::L", wantWarn: true,
+		},
+		{
+			name:  "a collapsed diff is at least L",
+			diffs: []FileDiff{{NewPath: "schema.sql", Collapsed: true}},
+			want:  "size::L", wantWarn: true,
+		},
+		{
+			name:  "a diff left out of a larger change",
+			diffs: []FileDiff{{NewPath: "a.go", Diff: lines(1000, "+")}, {NewPath: "schema.sql", TooLarge: true}},
+			want:  "size::XL",
+		},
+		{
+			name:  "an excluded file left out does not count",
+			diffs: []FileDiff{{NewPath: "go.sum", TooLarge: true}},
+			want:  "size::XS",
+		},
+	}
+
+	config := &Config{
+		SizeThresholds: []int{10, 50, 250, 1000},
+		SizeExclude:    parseStringSlice(defaultSizeExclude),
+	}
+	for _, tt := range tests {
+		var got, stderr string
+		captureOutput(t, func() {
+			stderr = captureStderr(t, func() { got = sizeLabel(config, tt.diffs) })
+		})
+		if got != tt.want {
+			t.Errorf("%s: sizeLabel() = %q, want %q", tt.name, got, tt.want)
+		}
+		if warned := strings.Contains(stderr, "schema.sql as too large"); warned != tt.wantWarn {
+			t.Errorf("%s: warned = %v, want %v (stderr %q)", tt.name, warned, tt.wantWarn, stderr)
+		}
+	}
+}
+
+func TestParseSizeThresholds(t *testing.T) {
+	got, err := parseSizeThresholds(" 5, 20,100 ,400")
+	if err != nil || !slices.Equal(got, []int{5, 20, 100, 400}) {
+		t.Errorf("parseSizeThresholds() = %v, %v, want [5 20 100 400]", got, err)
+	}
+
+	for _, bad := range []string{"10,50,250", "10,50,250,1000,5000", "10,50,50,1000", "0,50,250,1000", "10,x,250,1000"} {
+		if _, err := parseSizeThresholds(bad); err == nil {
+			t.Errorf("parseSizeThresholds(%q) error = nil, want it rejected", bad)
+		}
+	}
+}
+
+// TestRunSizeLabelOnUpdate pins that an update adds the size and path labels
+// instead of replacing the MR's labels, and swaps out a size label left by an
+// earlier run.
+func TestRunLabelModeOnUpdate(t *testing.T) {
+	tests := []struct {
+		name   string
+		mode   string
+		labels string
+		add    string
+		remove string
+	}{
+		{"replace sets the labels", labelModeReplace, "[status::review bug]", "<nil>", "<nil>"},
+		{"merge replaces within a scope", labelModeMerge, "<nil>", "[status::review bug]", "[status::todo]"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var raw []byte
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				switch {
+				case r.URL.Path == "/api/v4/projects/123" && r.Method == http.MethodGet:
+					writeTestJSON(t, w, Project{ID: 123, DefaultBranch: "main"})
+				case r.URL.Path == "/api/v4/projects/123/merge_requests" && r.Method == http.MethodGet:
+					_, _ = w.Write([]byte(`[{"id":1,"iid":42,"title":"Old","labels":["status::todo","needs-review"]}]`))
+				case r.URL.Path == "/api/v4/projects/123/merge_requests/42" && r.Method == http.MethodPut:
+					var err error
+					if raw, err = io.ReadAll(r.Body); err != nil {
+						t.Errorf("read update body: %v", err)
+					}
+					_, _ = w.Write([]byte(`{"id":1,"iid":42}`))
+				default:
+					t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+					w.WriteHeader(http.StatusNotFound)
+				}
+			}))
+			defer server.Close()
+
+			config := &Config{
+				PrivateToken: "test-token", SourceBranch: "feature", ProjectID: 123, GitLabURL: server.URL,
+				UserIDs: []int{1}, TargetBranch: "main", UpdateMR: true,
+				Labels: []string{"status::review", "bug"}, LabelMode: tt.mode,
+			}
+
+			var err error
+			captureOutput(t, func() { err = run(context.Background(), config) })
+			if err != nil {
+				t.Fatalf("run() error = %v", err)
+			}
+
+			var body map[string]any
+			if err := json.Unmarshal(raw, &body); err != nil {
+				t.Fatalf("update body %q: %v", raw, err)
+			}
+			for key, want := range map[string]string{"labels": tt.labels, "add_labels": tt.add, "remove_labels": tt.remove} {
+				if got := fmt.Sprint(body[key]); got != want {
+					t.Errorf("%s = %s, want %s", key, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestRunSizeLabelOnUpdate(t *testing.T) {
+	var raw []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case r.URL.Path == "/api/v4/projects/123" && r.Method == http.MethodGet:
+			writeTestJSON(t, w, Project{ID: 123, DefaultBranch: "main"})
+		case r.URL.Path == "/api/v4/projects/123/merge_requests" && r.Method == http.MethodGet:
+			_, _ = w.Write([]byte(`[{"id":1,"iid":42,"title":"Old","labels":["size::S","needs-review"]}]`))
+		case r.URL.Path == "/api/v4/projects/123/repository/compare" && r.Method == http.MethodGet:
+			_, _ = w.Write([]byte(`{"diffs":[{"old_path":"docs/a.md","new_path":"docs/a.md","diff":"` +
+				strings.Repeat(`+x\n`, 60) + `"}]}`))
+		case r.URL.Path == "/api/v4/projects/123/merge_requests/42" && r.Method == http.MethodPut:
+			var err error
+			if raw, err = io.ReadAll(r.Body); err != nil {
+				t.Errorf("read update body: %v", err)
+			}
+			_, _ = w.Write([]byte(`{"id":1,"iid":42}`))
+		default:
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	config := &Config{
+		PrivateToken: "test-token", SourceBranch: "feature", ProjectID: 123, GitLabURL: server.URL,
+		UserIDs: []int{1}, TargetBranch: "main", UpdateMR: true,
+		PathLabels:     []PathLabel{{Pattern: "docs/**", Label: "documentation"}},
+		SizeLabels:     true,
+		SizeThresholds: []int{10, 50, 250, 1000},
+	}
+
+	var err error
+	out := captureOutput(t, func() { err = run(context.Background(), config) })
+	if err != nil {
+		t.Fatalf("run() error = %v", err)
+	}
+
+	var body map[string]any
+	if err := json.Unmarshal(raw, &body); err != nil {
+		t.Fatalf("update body %q: %v", raw, err)
+	}
+	if _, ok := body["labels"]; ok {
+		t.Errorf("update body %s sets labels, which would drop the MR's own", raw)
+	}
+	if got := fmt.Sprint(body["add_labels"]); got != "[documentation size::M]" {
+		t.Errorf("add_labels = %s, want [documentation size::M]", got)
+	}
+	if got := fmt.Sprint(body["remove_labels"]); got != "[size::S]" {
+		t.Errorf("remove_labels = %s, want [size::S]", got)
+	}
+	if !strings.Contains(out, "Size: M, 60 line(s) added and 0 removed in 1 file(s)") {
+		t.Errorf("output %q does not report the size", out)
+	}
+}
+
+func TestParsePathLabels(t *testing.T) {
+	got, err := parsePathLabels([]string{"docs/** = documentation", "migrations/**=scope::database"})
+	if err != nil {
+		t.Fatalf("parsePathLabels() error = %v", err)
+	}
+	want := []PathLabel{{Pattern: "docs/**", Label: "documentation"}, {Pattern: "migrations/**", Label: "scope::database"}}
+	if !slices.Equal(got, want) {
+		t.Errorf("parsePathLabels() = %v, want %v", got, want)
+	}
+
+	for _, bad := range []string{"docs/**", "=documentation", "docs/**=", "docs/[=documentation"} {
+		if _, err := parsePathLabels([]string{bad}); err == nil || !strings.Contains(err.Error(), "invalid --path-label") {
+			t.Errorf("parsePathLabels(%q) error = %v, want it rejected", bad, err)
+		}
+	}
+}
+
+// newIssueMetadataServer serves a project, no existing MR, an issue carrying
+// milestone 99 and labels ["from-issue", "shared"], and a branch changing
+// docs/guide/setup.md and main.go. It records the create request.
 func newIssueMetadataServer(t *testing.T, captured *MRCreateRequest) *httptest.Server {
 	t.Helper()
 	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -1725,6 +2165,18 @@ func newIssueMetadataServer(t *testing.T, captured *MRCreateRequest) *httptest.S
 			if err := json.NewEncoder(w).Encode(MergeRequest{ID: 1, IID: 7}); err != nil {
 				t.Errorf("encode MR: %v", err)
 			}
+		case strings.HasPrefix(r.URL.Path, "/api/v4/projects/123/repository/branches/") && r.Method == "GET":
+			w.Header().Set("Content-Type", "application/json")
+			if _, err := w.Write([]byte(`{}`)); err != nil {
+				t.Errorf("write branch: %v", err)
+			}
+		case r.URL.Path == "/api/v4/projects/123/repository/compare" && r.Method == "GET":
+			w.Header().Set("Content-Type", "application/json")
+			if _, err := w.Write([]byte(`{"diffs":[` +
+				`{"old_path":"docs/guide/setup.md","new_path":"docs/guide/setup.md"},` +
+				`{"old_path":"main.go","new_path":"main.go"}]}`)); err != nil {
+				t.Errorf("write comparison: %v", err)
+			}
 		default:
 			w.WriteHeader(http.StatusNotFound)
 		}
@@ -1738,6 +2190,7 @@ func TestRunLabelAndMilestone(t *testing.T) {
 	tests := []struct {
 		name             string
 		labels           []string
+		pathLabels       []PathLabel
 		milestoneID      int
 		useIssueName     bool
 		expectedLabels   []string
@@ -1770,6 +2223,18 @@ func TestRunLabelAndMilestone(t *testing.T) {
 			expectedLabels:   []string{"from-issue", "shared"},
 			expectedMileston: 5,
 		},
+		{
+			name:   "labels from changed paths",
+			labels: []string{"bug"},
+			pathLabels: []PathLabel{
+				{Pattern: "docs/**", Label: "documentation"},
+				{Pattern: "migrations/**", Label: "database"},
+				{Pattern: "*.go", Label: "bug"},
+			},
+			useIssueName:     true,
+			expectedLabels:   []string{"bug", "documentation", "from-issue", "shared"},
+			expectedMileston: 99,
+		},
 		{
 			name:             "neither",
 			expectedLabels:   nil,
@@ -1791,6 +2256,7 @@ func TestRunLabelAndMilestone(t *testing.T) {
 				UserIDs:      []int{1},
 				TargetBranch: "main",
 				Labels:       tt.labels,
+				PathLabels:   tt.pathLabels,
 				MilestoneID:  tt.milestoneID,
 				UseIssueName: tt.useIssueName,
 			}
@@ -1852,7 +2318,7 @@ func captureStream(t *testing.T, stream **os.File, fn func()) string {
 
 	fn()
 
-	os.Stdout = orig
+	*stream = orig
 	if cerr := w.Close(); cerr != nil {
 		t.Errorf("close pipe writer: %v", cerr)
 	}
@@ -2041,6 +2507,10 @@ func TestPrintMRURL(t *testing.T) {
 					if _, err := w.Write([]byte(`{}`)); err != nil {
 						t.Errorf("write update response: %v", err)
 					}
+				case strings.HasPrefix(r.URL.Path, "/api/v4/projects/123/repository/branches/"):
+					if _, err := w.Write([]byte(`{}`)); err != nil {
+						t.Errorf("write branch: %v", err)
+					}
 				default:
 					w.WriteHeader(http.StatusNotFound)
 				}
@@ -2194,7 +2664,7 @@ func TestTriggerMRPipelineDeduplicates(t *testing.T) {
 				ForcePipeline:   tt.force,
 			}
 
-			err := triggerMRPipeline(context.Background(), server.Client(), config, &MergeRequest{IID: 42, SHA: tt.mrSHA})
+			_, err := triggerMRPipeline(context.Background(), server.Client(), config, &MergeRequest{IID: 42, SHA: tt.mrSHA})
 			if err != nil {
 				t.Fatalf("triggerMRPipeline() error = %v", err)
 			}
@@ -2236,7 +2706,7 @@ func TestTriggerMRPipelineIgnoresBranchPipelines(t *testing.T) {
 				TriggerPipeline: true,
 			}
 
-			err := triggerMRPipeline(context.Background(), server.Client(), config,
+			_, err := triggerMRPipeline(context.Background(), server.Client(), config,
 				&MergeRequest{IID: 42, SHA: headSHA})
 			if err != nil {
 				t.Fatalf("triggerMRPipeline() error = %v", err)
@@ -3130,6 +3600,8 @@ func clearRequiredParseEnv(t *testing.T) {
 		"GITLAB_AUTO_MR_TIMEOUT",
 		"GITLAB_AUTO_MR_RETRIES",
 		"GITLAB_AUTO_MR_RETRY_DELAY",
+		"GITLAB_AUTO_MR_POLL_INTERVAL",
+		"GITLAB_AUTO_MR_PIPELINE_TIMEOUT",
 	} {
 		t.Setenv(key, "")
 	}
@@ -3329,6 +3801,35 @@ func TestParseFlags(t *testing.T) {
 			wantErr:   true,
 			errSubstr: "--milestone must not be negative",
 		},
+		{
+			name:  "milestone-by-title",
+			args:  []string{"prog", "--milestone", "Sprint 12"},
+			setup: setRequiredParseEnv,
+			checkConfig: func(t *testing.T, c *Config) {
+				t.Helper()
+				if c.Milestone != "Sprint 12" || c.MilestoneID != 0 {
+					t.Errorf("Milestone, MilestoneID = %q, %d, want the title to look up", c.Milestone, c.MilestoneID)
+				}
+			},
+		},
+		{
+			name:  "milestone-title-like-a-number",
+			args:  []string{"prog", "--milestone", "title:2025"},
+			setup: setRequiredParseEnv,
+			checkConfig: func(t *testing.T, c *Config) {
+				t.Helper()
+				if c.Milestone != "title:2025" || c.MilestoneID != 0 {
+					t.Errorf("Milestone, MilestoneID = %q, %d, want the title to look up", c.Milestone, c.MilestoneID)
+				}
+			},
+		},
+		{
+			name:      "milestone-title-prefix-alone",
+			args:      []string{"prog", "--milestone", "title:"},
+			setup:     setRequiredParseEnv,
+			wantErr:   true,
+			errSubstr: "--milestone title: needs a title after it",
+		},
 		{
 			name: "labels-and-milestone-flags-override-env",
 			args: []string{"prog", "--label", "ci", "--milestone", "9"},
@@ -3383,6 +3884,13 @@ func TestParseFlags(t *testing.T) {
 			wantErr:   true,
 			errSubstr: "--retry-delay must not be negative",
 		},
+		{
+			name:      "zero-poll-interval",
+			args:      []string{"prog", "--poll-interval", "0s"},
+			setup:     setRequiredParseEnv,
+			wantErr:   true,
+			errSubstr: "--poll-interval must be positive",
+		},
 		{
 			name: "http-tuning-from-env",
 			args: []string{"prog"},
@@ -3422,19 +3930,146 @@ func TestParseFlags(t *testing.T) {
 			},
 		},
 		{
-			name:  "success",
-			args:  []string{"prog"},
-			setup: setRequiredParseEnv,
+			name:      "unknown-command",
+			args:      []string{"prog", "frobnicate"},
+			setup:     setRequiredParseEnv,
+			wantErr:   true,
+			errSubstr: `unknown command "frobnicate"`,
+		},
+		{
+			name:      "revert-requires-mr-iid",
+			args:      []string{"prog", "revert"},
+			setup:     setRequiredParseEnv,
+			wantErr:   true,
+			errSubstr: "--mr-iid is required",
+		},
+		{
+			// A revert derives its branches and assignee from the reverted MR,
+			// so neither CI_COMMIT_REF_NAME nor GITLAB_USER_ID is needed.
+			name: "revert-without-source-branch-or-user",
+			args: []string{"prog", "revert", "--mr-iid", "42"},
+			setup: func(t *testing.T) {
+				t.Setenv("GITLAB_PRIVATE_TOKEN", "tok")
+				t.Setenv("CI_PROJECT_ID", "42")
+				t.Setenv("CI_PROJECT_URL", "https://gl.example.com/group/proj")
+			},
 			checkConfig: func(t *testing.T, c *Config) {
 				t.Helper()
-				if c == nil {
-					t.Fatal("expected non-nil config")
-				}
-				if c.ProjectID != 42 {
-					t.Errorf("ProjectID = %d, want 42", c.ProjectID)
+				if c.Command != commandRevert || c.MRIID != 42 {
+					t.Errorf("Command, MRIID = %q, %d, want %q, 42", c.Command, c.MRIID, commandRevert)
 				}
-				if c.SourceBranch != "feat/x" {
-					t.Errorf("SourceBranch = %q, want %q", c.SourceBranch, "feat/x")
+			},
+		},
+		{
+			name: "pipeline-variables-repeatable",
+			args: []string{
+				"prog", "--trigger-pipeline",
+				"--pipeline-variable", "DEPLOY_ENV=staging", "--pipeline-variable", "TARGETS=a,b",
+			},
+			setup: setRequiredParseEnv,
+			checkConfig: func(t *testing.T, c *Config) {
+				t.Helper()
+				want := []PipelineVariable{{Key: "DEPLOY_ENV", Value: "staging"}, {Key: "TARGETS", Value: "a,b"}}
+				if !slices.Equal(c.PipelineVariables, want) {
+					t.Errorf("PipelineVariables = %v, want %v", c.PipelineVariables, want)
+				}
+			},
+		},
+		{
+			name:      "pipeline-variable-malformed",
+			args:      []string{"prog", "--pipeline-variable", "DEPLOY_ENV"},
+			setup:     setRequiredParseEnv,
+			wantErr:   true,
+			errSubstr: "invalid pipeline variable in --pipeline-variable number 1",
+		},
+		{
+			name:      "pipeline-timeout-not-positive",
+			args:      []string{"prog", "--pipeline-timeout", "0s"},
+			setup:     setRequiredParseEnv,
+			wantErr:   true,
+			errSubstr: "--pipeline-timeout must be positive",
+		},
+		{
+			// A merge assigns nobody, and an IID is enough to find the MR.
+			name: "merge-by-iid-without-source-branch-or-user",
+			args: []string{"prog", "merge", "--mr-iid", "42", "--merge-commit-message", "Release 2.0"},
+			setup: func(t *testing.T) {
+				t.Setenv("GITLAB_PRIVATE_TOKEN", "tok")
+				t.Setenv("CI_PROJECT_ID", "42")
+				t.Setenv("CI_PROJECT_URL", "https://gl.example.com/group/proj")
+			},
+			checkConfig: func(t *testing.T, c *Config) {
+				t.Helper()
+				if c.Command != commandMerge || c.MRIID != 42 || c.MergeCommitMessage != "Release 2.0" {
+					t.Errorf("Command, MRIID, MergeCommitMessage = %q, %d, %q", c.Command, c.MRIID, c.MergeCommitMessage)
+				}
+			},
+		},
+		{
+			name: "status-by-iid-as-junit",
+			args: []string{"prog", "status", "--mr-iid", "42", "--format", "junit"},
+			setup: func(t *testing.T) {
+				t.Setenv("GITLAB_PRIVATE_TOKEN", "tok")
+				t.Setenv("CI_PROJECT_ID", "42")
+				t.Setenv("CI_PROJECT_URL", "https://gl.example.com/group/proj")
+			},
+			checkConfig: func(t *testing.T, c *Config) {
+				t.Helper()
+				if c.Command != commandStatus || c.MRIID != 42 || c.Format != formatJUnit {
+					t.Errorf("Command, MRIID, Format = %q, %d, %q", c.Command, c.MRIID, c.Format)
+				}
+			},
+		},
+		{
+			// A policy check assigns nobody either.
+			name: "check-without-user",
+			args: []string{"prog", "check", "--min-approvals", "2", "--policy-mode", "warn"},
+			setup: func(t *testing.T) {
+				t.Setenv("GITLAB_PRIVATE_TOKEN", "tok")
+				t.Setenv("CI_COMMIT_REF_NAME", "feature")
+				t.Setenv("CI_PROJECT_ID", "42")
+				t.Setenv("CI_PROJECT_URL", "https://gl.example.com/group/proj")
+			},
+			checkConfig: func(t *testing.T, c *Config) {
+				t.Helper()
+				if c.Command != commandCheck || c.MinApprovals != 2 || c.PolicyMode != policyWarn {
+					t.Errorf("Command, MinApprovals, PolicyMode = %q, %d, %q", c.Command, c.MinApprovals, c.PolicyMode)
+				}
+			},
+		},
+		{
+			name:      "min-approvals-negative",
+			args:      []string{"prog", "--min-approvals", "-1"},
+			setup:     setRequiredParseEnv,
+			wantErr:   true,
+			errSubstr: "--min-approvals must not be negative",
+		},
+		{
+			name: "merge-needs-iid-or-source-branch",
+			args: []string{"prog", "merge"},
+			setup: func(t *testing.T) {
+				t.Setenv("GITLAB_PRIVATE_TOKEN", "tok")
+				t.Setenv("CI_COMMIT_REF_NAME", "")
+				t.Setenv("CI_PROJECT_ID", "42")
+				t.Setenv("CI_PROJECT_URL", "https://gl.example.com/group/proj")
+			},
+			wantErr:   true,
+			errSubstr: "--source-branch is required",
+		},
+		{
+			name:  "success",
+			args:  []string{"prog"},
+			setup: setRequiredParseEnv,
+			checkConfig: func(t *testing.T, c *Config) {
+				t.Helper()
+				if c == nil {
+					t.Fatal("expected non-nil config")
+				}
+				if c.ProjectID != 42 {
+					t.Errorf("ProjectID = %d, want 42", c.ProjectID)
+				}
+				if c.SourceBranch != "feat/x" {
+					t.Errorf("SourceBranch = %q, want %q", c.SourceBranch, "feat/x")
 				}
 				if len(c.UserIDs) != 1 || c.UserIDs[0] != 7 {
 					t.Errorf("UserIDs = %v, want [7]", c.UserIDs)
@@ -3512,7 +4147,7 @@ func TestTriggerMRPipeline(t *testing.T) {
 		PrivateToken: "test-token",
 	}
 
-	if err := triggerMRPipeline(context.Background(), client, config, &MergeRequest{IID: 42}); err != nil {
+	if _, err := triggerMRPipeline(context.Background(), client, config, &MergeRequest{IID: 42}); err != nil {
 		t.Errorf("Expected no error, got %v", err)
 	}
 }
@@ -3531,7 +4166,7 @@ func TestTriggerMRPipelineZeroIID(t *testing.T) {
 		PrivateToken: "test-token",
 	}
 
-	if err := triggerMRPipeline(context.Background(), client, config, &MergeRequest{}); err != nil {
+	if _, err := triggerMRPipeline(context.Background(), client, config, &MergeRequest{}); err != nil {
 		t.Errorf("Expected no error, got %v", err)
 	}
 }
@@ -3564,7 +4199,7 @@ func TestTriggerMRPipelineErrors(t *testing.T) {
 				PrivateToken: "test-token",
 			}
 
-			err := triggerMRPipeline(context.Background(), client, config, &MergeRequest{IID: 42})
+			_, err := triggerMRPipeline(context.Background(), client, config, &MergeRequest{IID: 42})
 			if err == nil {
 				t.Fatal("Expected an error, got nil")
 			}
@@ -3591,7 +4226,7 @@ func TestTriggerMRPipelineUnreadableBody(t *testing.T) {
 		PrivateToken: "test-token",
 	}
 
-	if err := triggerMRPipeline(context.Background(), client, config, &MergeRequest{IID: 42}); err != nil {
+	if _, err := triggerMRPipeline(context.Background(), client, config, &MergeRequest{IID: 42}); err != nil {
 		t.Errorf("Expected no error for an unreadable body, got %v", err)
 	}
 }
@@ -3606,6 +4241,10 @@ func TestRunWithTriggerPipeline(t *testing.T) {
 		case strings.HasPrefix(r.URL.Path, "/api/v4/projects/123") && r.Method == "GET" &&
 			!strings.Contains(r.URL.Path, "merge_requests"):
 			json.NewEncoder(w).Encode(Project{ID: 123, Name: "test-project", DefaultBranch: "main"})
+		case r.URL.Path == "/api/v4/projects/123/merge_requests/10" && r.Method == "GET":
+			json.NewEncoder(w).Encode(MergeRequest{
+				ID: 1, IID: 10, DetailedMergeStatus: "ci_still_running", HeadPipeline: &Pipeline{ID: 7},
+			})
 		case strings.HasPrefix(r.URL.Path, "/api/v4/projects/123/merge_requests") && r.Method == "GET":
 			json.NewEncoder(w).Encode([]MergeRequest{})
 		case strings.HasSuffix(r.URL.Path, "/merge_requests") && r.Method == "POST":
@@ -3687,9 +4326,10 @@ func TestRunWithoutTriggerPipeline(t *testing.T) {
 }
 
 // mrFlowOpts configures mrFlowServer. A zero value serves the whole happy path:
-// project lookup, an empty MR list, MR creation and pipeline creation. The
-// *Status fields make one endpoint fail so run()'s error wrapping can be
-// exercised one failing call at a time.
+// project lookup, an empty MR list, an existing source branch, MR creation and
+// pipeline creation. The *Status fields make one endpoint fail so run()'s error
+// wrapping can be exercised one failing call at a time; missingBranch makes the
+// source branch lookup answer 404.
 type mrFlowOpts struct {
 	defaultBranch  string
 	existing       bool
@@ -3697,6 +4337,7 @@ type mrFlowOpts struct {
 	createStatus   int
 	updateStatus   int
 	pipelineStatus int
+	missingBranch  bool
 }
 
 // mrFlowServer mocks the endpoints run() walks through for project 123. The
@@ -3751,6 +4392,13 @@ func mrFlowServer(t *testing.T, opts mrFlowOpts) (*httptest.Server, *MRCreateReq
 			}
 			writeTestJSON(t, w, MergeRequest{ID: 1, IID: 1})
 
+		case strings.HasPrefix(r.URL.Path, "/api/v4/projects/123/repository/branches/"):
+			if opts.missingBranch {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			writeTestJSON(t, w, map[string]string{"name": "feature/test"})
+
 		case strings.HasSuffix(r.URL.Path, "/pipelines"):
 			if opts.pipelineStatus != 0 {
 				w.WriteHeader(opts.pipelineStatus)
@@ -3885,6 +4533,11 @@ func TestRunErrorPaths(t *testing.T) {
 			opts:      mrFlowOpts{listStatus: http.StatusInternalServerError},
 			errSubstr: "failed to check if MR exists",
 		},
+		{
+			name:      "source-branch-missing",
+			opts:      mrFlowOpts{missingBranch: true},
+			errSubstr: "source branch feature/test does not exist in project 123",
+		},
 		{
 			name:      "create-fails",
 			opts:      mrFlowOpts{createStatus: http.StatusInternalServerError},
@@ -3980,7 +4633,7 @@ func TestEnableAutoMerge(t *testing.T) {
 
 		var err error
 		out := captureOutput(t, func() {
-			err = enableAutoMerge(context.Background(), &http.Client{}, config, 0)
+			err = enableAutoMerge(context.Background(), &http.Client{}, config, &MergeRequest{})
 		})
 
 		if err != nil {
@@ -4002,7 +4655,7 @@ func TestEnableAutoMerge(t *testing.T) {
 
 		config := &Config{GitLabURL: server.URL, ProjectID: 123, PrivateToken: "test-token"}
 
-		err := enableAutoMerge(context.Background(), &http.Client{}, config, 42)
+		err := enableAutoMerge(context.Background(), &http.Client{}, config, &MergeRequest{IID: 42})
 		if err == nil {
 			t.Fatal("enableAutoMerge() error = nil, want an error")
 		}
@@ -4094,7 +4747,7 @@ func TestTriggerMRPipelineUnreadablePipelineList(t *testing.T) {
 	mr := &MergeRequest{IID: 42, SHA: "deadbeefcafe"}
 
 	var err error
-	captureOutput(t, func() { err = triggerMRPipeline(context.Background(), &http.Client{}, config, mr) })
+	captureOutput(t, func() { _, err = triggerMRPipeline(context.Background(), &http.Client{}, config, mr) })
 
 	if err != nil {
 		t.Errorf("triggerMRPipeline() error = %v, want nil", err)
@@ -4263,3 +4916,3408 @@ func TestSendRequestTruncatedBody(t *testing.T) {
 		t.Fatal("sendRequest() error = nil, want a read error for the truncated body")
 	}
 }
+
+// revertCalls records what the revert command asked revertServer for.
+type revertCalls struct {
+	branch        BranchCreateRequest
+	revert        CommitRevertRequest
+	revertedSHA   string
+	created       MRCreateRequest
+	deletedBranch string
+
+	// existingBranches are the branches the server reports as already there.
+	existingBranches []string
+}
+
+// revertServer mocks the endpoints the revert command walks through for MR 42
+// of project 123. A non-zero revertStatus makes the revert call fail with it.
+func revertServer(t *testing.T, original MergeRequest, revertStatus int) (*httptest.Server, *revertCalls) {
+	t.Helper()
+
+	calls := &revertCalls{}
+	const base = "/api/v4/projects/123"
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		switch {
+		case r.URL.Path == base+"/merge_requests/42" && r.Method == http.MethodGet:
+			writeTestJSON(t, w, original)
+
+		case r.URL.Path == base+"/repository/branches" && r.Method == http.MethodPost:
+			if err := json.NewDecoder(r.Body).Decode(&calls.branch); err != nil {
+				t.Errorf("decode branch request: %v", err)
+			}
+			w.WriteHeader(http.StatusCreated)
+			writeTestJSON(t, w, map[string]string{"name": calls.branch.Branch})
+
+		case strings.HasPrefix(r.URL.Path, base+"/repository/branches/") && r.Method == http.MethodGet:
+			name := strings.TrimPrefix(r.URL.Path, base+"/repository/branches/")
+			if !slices.Contains(calls.existingBranches, name) {
+				w.WriteHeader(http.StatusNotFound)
+				writeTestJSON(t, w, map[string]string{"message": "404 Branch Not Found"})
+				return
+			}
+			writeTestJSON(t, w, map[string]string{"name": name})
+
+		case strings.HasPrefix(r.URL.Path, base+"/repository/branches/") && r.Method == http.MethodDelete:
+			calls.deletedBranch = strings.TrimPrefix(r.URL.Path, base+"/repository/branches/")
+			w.WriteHeader(http.StatusNoContent)
+
+		case strings.HasSuffix(r.URL.Path, "/revert") && r.Method == http.MethodPost:
+			calls.revertedSHA = strings.TrimSuffix(
+				strings.TrimPrefix(r.URL.Path, base+"/repository/commits/"), "/revert")
+			if err := json.NewDecoder(r.Body).Decode(&calls.revert); err != nil {
+				t.Errorf("decode revert request: %v", err)
+			}
+			if revertStatus != 0 {
+				w.WriteHeader(revertStatus)
+				writeTestJSON(t, w, map[string]string{"message": "Sorry, we cannot revert this commit automatically."})
+				return
+			}
+			w.WriteHeader(http.StatusCreated)
+			writeTestJSON(t, w, map[string]string{"id": "feedface"})
+
+		case r.URL.Path == base+"/merge_requests" && r.Method == http.MethodPost:
+			if err := json.NewDecoder(r.Body).Decode(&calls.created); err != nil {
+				t.Errorf("decode create request: %v", err)
+			}
+			w.WriteHeader(http.StatusCreated)
+			writeTestJSON(t, w, MergeRequest{ID: 2, IID: 43, Title: calls.created.Title})
+
+		default:
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	return server, calls
+}
+
+// TestRunRevert pins the happy path of the revert command: the merge commit is
+// reverted onto a fresh branch cut from the original target, and the MR that
+// proposes it goes back to that target, titled and assigned from the original.
+func TestRunRevert(t *testing.T) {
+	original := MergeRequest{
+		IID: 42, Title: "Draft: Add caching", State: "merged", TargetBranch: "release/2.x",
+		MergeCommitSHA: "abc123def4567890", SquashCommitSHA: "1111111122222222",
+		WebURL: "https://gitlab.example.com/g/p/-/merge_requests/42",
+		Author: User{ID: 77, Username: "alice"},
+	}
+	server, calls := revertServer(t, original, 0)
+
+	config := &Config{
+		Command: commandRevert, MRIID: 42, GitLabURL: server.URL, ProjectID: 123,
+		PrivateToken: "test-token", UserIDs: []int{1}, CommitPrefix: "Draft",
+	}
+
+	var err error
+	out := captureOutput(t, func() { err = run(context.Background(), config) })
+	if err != nil {
+		t.Fatalf("run() error = %v", err)
+	}
+
+	if calls.branch.Branch != "revert-abc123de" || calls.branch.Ref != "release/2.x" {
+		t.Errorf("branch request = %+v, want revert-abc123de from release/2.x", calls.branch)
+	}
+	if calls.revertedSHA != original.MergeCommitSHA {
+		t.Errorf("reverted %q, want the merge commit %q", calls.revertedSHA, original.MergeCommitSHA)
+	}
+	if calls.revert.Branch != "revert-abc123de" {
+		t.Errorf("revert committed onto %q, want revert-abc123de", calls.revert.Branch)
+	}
+
+	created := calls.created
+	if created.SourceBranch != "revert-abc123de" || created.TargetBranch != "release/2.x" {
+		t.Errorf("MR %s -> %s, want revert-abc123de -> release/2.x", created.SourceBranch, created.TargetBranch)
+	}
+	if created.Title != "Draft: Revert: Add caching" {
+		t.Errorf("Title = %q, want %q", created.Title, "Draft: Revert: Add caching")
+	}
+	if len(created.AssigneeIDs) != 1 || created.AssigneeIDs[0] != 77 {
+		t.Errorf("AssigneeIDs = %v, want the original author [77]", created.AssigneeIDs)
+	}
+	if !strings.Contains(created.Description, "!42") || !strings.Contains(created.Description, original.WebURL) {
+		t.Errorf("Description = %q, want a link back to !42", created.Description)
+	}
+	if !strings.Contains(out, "Reverted commit abc123de") {
+		t.Errorf("output %q does not report the revert", out)
+	}
+}
+
+// TestRunRevertBranchTaken pins that a second revert of the same commit, after
+// the first revert's MR was closed and its branch kept, picks the next free
+// branch name instead of failing on the existing one.
+func TestRunRevertBranchTaken(t *testing.T) {
+	original := MergeRequest{
+		IID: 42, Title: "Add caching", State: "merged", TargetBranch: "main",
+		MergeCommitSHA: "abc123def4567890", Author: User{ID: 77},
+	}
+	server, calls := revertServer(t, original, 0)
+	calls.existingBranches = []string{"revert-abc123de", "revert-abc123de-2"}
+
+	config := &Config{
+		Command: commandRevert, MRIID: 42, GitLabURL: server.URL, ProjectID: 123, PrivateToken: "test-token",
+	}
+
+	var err error
+	captureOutput(t, func() { err = run(context.Background(), config) })
+	if err != nil {
+		t.Fatalf("run() error = %v", err)
+	}
+
+	if calls.branch.Branch != "revert-abc123de-3" || calls.created.SourceBranch != "revert-abc123de-3" {
+		t.Errorf("branch = %q, MR from %q, want revert-abc123de-3 for both",
+			calls.branch.Branch, calls.created.SourceBranch)
+	}
+}
+
+// TestValidateRevertModes pins that the flags choosing how the source branch's
+// MR is handled are refused by revert, which opens an MR of its own.
+func TestValidateRevertModes(t *testing.T) {
+	tests := []struct {
+		config Config
+		flag   string
+	}{
+		{Config{UpdateMR: true}, "--update-mr"},
+		{Config{CreateOnly: true}, "--create-only"},
+		{Config{MRExists: true}, "--mr-exists"},
+		{Config{UseIssueName: true}, "--use-issue-name"},
+		{Config{CommitFiles: []string{"go.mod"}, CommitMessage: "bump"}, "--commit-file"},
+		{Config{CreateBranchFrom: "main"}, "--create-branch-from"},
+	}
+
+	for _, tt := range tests {
+		tt.config.Command = commandRevert
+		err := validateConfig(&tt.config)
+		if err == nil || !strings.Contains(err.Error(), "the revert command opens an MR from a branch of its own, "+
+			"it cannot be used with "+tt.flag) {
+			t.Errorf("validateConfig(%s) error = %v, want it refused", tt.flag, err)
+		}
+	}
+}
+
+// TestRunRevertConflict pins that a revert GitLab cannot apply fails the run
+// with its reason and takes the just-created branch away again, so the next
+// attempt is not blocked by a leftover branch.
+func TestRunRevertConflict(t *testing.T) {
+	original := MergeRequest{
+		IID: 42, Title: "Add caching", State: "merged", TargetBranch: "main",
+		MergeCommitSHA: "abc123def4567890",
+	}
+	server, calls := revertServer(t, original, http.StatusBadRequest)
+
+	config := &Config{
+		Command: commandRevert, MRIID: 42, GitLabURL: server.URL, ProjectID: 123, PrivateToken: "test-token",
+	}
+
+	err := run(context.Background(), config)
+	if err == nil {
+		t.Fatal("run() error = nil, want the revert conflict")
+	}
+	if !strings.Contains(err.Error(), "could not revert it automatically") {
+		t.Errorf("error = %q, want it to explain the conflict", err)
+	}
+	if calls.deletedBranch != "revert-abc123de" {
+		t.Errorf("deleted branch %q, want revert-abc123de", calls.deletedBranch)
+	}
+	if calls.created.Title != "" {
+		t.Errorf("an MR was created (%q) although the revert failed", calls.created.Title)
+	}
+}
+
+func TestRevertTarget(t *testing.T) {
+	tests := []struct {
+		name      string
+		mr        MergeRequest
+		want      string
+		errSubstr string
+	}{
+		{
+			name: "merge commit",
+			mr:   MergeRequest{IID: 1, State: "merged", MergeCommitSHA: "m", SquashCommitSHA: "s"},
+			want: "m",
+		},
+		{
+			name: "fast-forward with squash",
+			mr:   MergeRequest{IID: 1, State: "merged", SquashCommitSHA: "s"},
+			want: "s",
+		},
+		{
+			name:      "fast-forward without squash",
+			mr:        MergeRequest{IID: 1, State: "merged"},
+			errSubstr: "no single commit to revert",
+		},
+		{
+			name:      "not merged",
+			mr:        MergeRequest{IID: 1, State: "opened", MergeCommitSHA: "m"},
+			errSubstr: "is opened, only a merged MR",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := revertTarget(&tt.mr)
+			if tt.errSubstr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.errSubstr) {
+					t.Fatalf("revertTarget() error = %v, want it to contain %q", err, tt.errSubstr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("revertTarget() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("revertTarget() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// commitFilesCalls records what --commit-file asked commitFilesServer for. The
+// pointers stay nil when the request was never made.
+type commitFilesCalls struct {
+	branch *BranchCreateRequest
+	commit *CommitCreateRequest
+}
+
+// commitFilesServer mocks the branch, file and commit endpoints behind
+// --commit-file, plus the MR flow run() continues with. remoteFiles is the
+// content of the source branch; branchExists controls the branch lookup.
+func commitFilesServer(t *testing.T, remoteFiles map[string]string, branchExists bool) (*httptest.Server, *commitFilesCalls) {
+	t.Helper()
+
+	calls := &commitFilesCalls{}
+	const base = "/api/v4/projects/123"
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		switch {
+		case r.URL.Path == base:
+			writeTestJSON(t, w, Project{ID: 123, DefaultBranch: "main"})
+
+		case r.URL.Path == base+"/repository/branches/feature/bot" && r.Method == http.MethodGet:
+			if !branchExists {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			writeTestJSON(t, w, map[string]string{"name": "feature/bot"})
+
+		case r.URL.Path == base+"/repository/branches" && r.Method == http.MethodPost:
+			calls.branch = &BranchCreateRequest{}
+			if err := json.NewDecoder(r.Body).Decode(calls.branch); err != nil {
+				t.Errorf("decode branch request: %v", err)
+			}
+			w.WriteHeader(http.StatusCreated)
+
+		case strings.HasPrefix(r.URL.Path, base+"/repository/files/"):
+			if r.URL.Query().Get("ref") != "feature/bot" {
+				t.Errorf("file read at ref %q, want feature/bot", r.URL.Query().Get("ref"))
+			}
+			name := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, base+"/repository/files/"), "/raw")
+			content, ok := remoteFiles[name]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			if _, err := io.WriteString(w, content); err != nil {
+				t.Errorf("write file: %v", err)
+			}
+
+		case r.URL.Path == base+"/repository/commits" && r.Method == http.MethodPost:
+			calls.commit = &CommitCreateRequest{}
+			if err := json.NewDecoder(r.Body).Decode(calls.commit); err != nil {
+				t.Errorf("decode commit request: %v", err)
+			}
+			w.WriteHeader(http.StatusCreated)
+			writeTestJSON(t, w, Commit{ID: "0123456789abcdef"})
+
+		case r.URL.Path == base+"/merge_requests" && r.Method == http.MethodGet:
+			writeTestJSON(t, w, []MergeRequest{})
+
+		case r.URL.Path == base+"/merge_requests" && r.Method == http.MethodPost:
+			w.WriteHeader(http.StatusCreated)
+			writeTestJSON(t, w, MergeRequest{ID: 1, IID: 1})
+
+		default:
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	return server, calls
+}
+
+// writeWorkFiles creates the given files in a fresh directory and makes it the
+// working directory, which is where --commit-file paths are read from.
+func writeWorkFiles(t *testing.T, files map[string]string) {
+	t.Helper()
+	dir := t.TempDir()
+	for name, content := range files {
+		full := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(full), 0o750); err != nil {
+			t.Fatalf("mkdir: %v", err)
+		}
+		if err := os.WriteFile(full, []byte(content), 0o600); err != nil {
+			t.Fatalf("write %s: %v", name, err)
+		}
+	}
+	t.Chdir(dir)
+}
+
+// TestRunCommitFiles pins that --commit-file turns local files into one commit
+// on a branch created from the target: new files are created, changed ones
+// updated, missing ones deleted, and unchanged ones left out of the commit.
+func TestRunCommitFiles(t *testing.T) {
+	writeWorkFiles(t, map[string]string{
+		"go.sum":           "same\n",
+		"deps/versions.go": "new content\n",
+		"docs/api.md":      "generated\n",
+	})
+	server, calls := commitFilesServer(t, map[string]string{
+		"go.sum":           "same\n",
+		"deps/versions.go": "old content\n",
+		"obsolete.txt":     "bye\n",
+	}, false)
+
+	config := &Config{
+		GitLabURL: server.URL, ProjectID: 123, PrivateToken: "test-token",
+		SourceBranch: "feature/bot", UserIDs: []int{1},
+		CommitFiles:   []string{"go.sum", "deps/versions.go", "docs/api.md", "obsolete.txt", "./never-existed"},
+		CommitMessage: "chore: sync generated files",
+	}
+
+	var err error
+	out := captureOutput(t, func() { err = run(context.Background(), config) })
+	if err != nil {
+		t.Fatalf("run() error = %v", err)
+	}
+
+	if calls.branch == nil || calls.branch.Branch != "feature/bot" || calls.branch.Ref != "main" {
+		t.Errorf("branch request = %+v, want feature/bot from main", calls.branch)
+	}
+	if calls.commit == nil {
+		t.Fatal("no commit was created")
+	}
+	if calls.commit.Branch != "feature/bot" || calls.commit.CommitMessage != "chore: sync generated files" {
+		t.Errorf("commit = %+v, want feature/bot with the given message", calls.commit)
+	}
+
+	got := map[string]string{}
+	for _, action := range calls.commit.Actions {
+		got[action.FilePath] = action.Action
+		if action.Action != "delete" && action.Encoding != "base64" {
+			t.Errorf("%s sent with encoding %q, want base64", action.FilePath, action.Encoding)
+		}
+	}
+	want := map[string]string{"deps/versions.go": "update", "docs/api.md": "create", "obsolete.txt": "delete"}
+	if len(got) != len(want) {
+		t.Errorf("actions = %v, want %v", got, want)
+	}
+	for file, action := range want {
+		if got[file] != action {
+			t.Errorf("action for %s = %q, want %q", file, got[file], action)
+		}
+	}
+	if !strings.Contains(out, "Committed 3 file change(s) to feature/bot (commit 01234567)") {
+		t.Errorf("output %q does not report the commit", out)
+	}
+}
+
+// TestRunCommitFilesUpToDate pins that a re-run whose files are already on the
+// branch goes on to the MR without creating an empty commit.
+func TestRunCommitFilesUpToDate(t *testing.T) {
+	writeWorkFiles(t, map[string]string{"go.sum": "same\n"})
+	server, calls := commitFilesServer(t, map[string]string{"go.sum": "same\n"}, true)
+
+	config := &Config{
+		GitLabURL: server.URL, ProjectID: 123, PrivateToken: "test-token",
+		SourceBranch: "feature/bot", UserIDs: []int{1},
+		CommitFiles: []string{"go.sum"}, CommitMessage: "chore: sync",
+	}
+
+	var err error
+	out := captureOutput(t, func() { err = run(context.Background(), config) })
+	if err != nil {
+		t.Fatalf("run() error = %v", err)
+	}
+	if calls.branch != nil {
+		t.Errorf("branch %+v created although it exists", calls.branch)
+	}
+	if calls.commit != nil {
+		t.Errorf("commit %+v created although nothing changed", calls.commit)
+	}
+	if !strings.Contains(out, "No file changes to commit") {
+		t.Errorf("output %q does not report the skipped commit", out)
+	}
+}
+
+// TestRunCommitFilesModeFails pins that a run whose mode check fails, here
+// --update-mr with no MR to update, pushes nothing to the branch.
+func TestRunCommitFilesModeFails(t *testing.T) {
+	writeWorkFiles(t, map[string]string{"go.sum": "new\n"})
+	server, calls := commitFilesServer(t, map[string]string{"go.sum": "old\n"}, false)
+
+	config := &Config{
+		GitLabURL: server.URL, ProjectID: 123, PrivateToken: "test-token",
+		SourceBranch: "feature/bot", UserIDs: []int{1}, UpdateMR: true,
+		CommitFiles: []string{"go.sum"}, CommitMessage: "chore: sync",
+	}
+
+	var err error
+	captureOutput(t, func() { err = run(context.Background(), config) })
+	if err == nil || !strings.Contains(err.Error(), "cannot update non-existent MR") {
+		t.Errorf("run() error = %v, want the missing MR reported", err)
+	}
+	if calls.branch != nil || calls.commit != nil {
+		t.Errorf("branch %+v and commit %+v pushed for a run that failed", calls.branch, calls.commit)
+	}
+}
+
+func TestValidateCommitFiles(t *testing.T) {
+	tests := []struct {
+		name      string
+		config    Config
+		errSubstr string
+	}{
+		{name: "no files", config: Config{}},
+		{name: "relative paths", config: Config{CommitFiles: []string{"a.txt", "dir/../b.txt"}, CommitMessage: "m"}},
+		{name: "missing message", config: Config{CommitFiles: []string{"a.txt"}}, errSubstr: "--commit-message"},
+		{
+			name:      "dry run",
+			config:    Config{CommitFiles: []string{"a.txt"}, CommitMessage: "m", MRExists: true},
+			errSubstr: "--mr-exists",
+		},
+		{
+			name:      "absolute path",
+			config:    Config{CommitFiles: []string{"/etc/passwd"}, CommitMessage: "m"},
+			errSubstr: "inside the working directory",
+		},
+		{
+			name:      "parent directory",
+			config:    Config{CommitFiles: []string{"../secret"}, CommitMessage: "m"},
+			errSubstr: "inside the working directory",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateCommitFiles(&tt.config)
+			if tt.errSubstr == "" {
+				if err != nil {
+					t.Errorf("validateCommitFiles() error = %v, want nil", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.errSubstr) {
+				t.Errorf("validateCommitFiles() error = %v, want it to contain %q", err, tt.errSubstr)
+			}
+		})
+	}
+}
+
+// TestRunCreateBranchFrom pins --create-branch-from: a missing source branch is
+// created from the given ref before the MR is opened, instead of failing the
+// preflight.
+func TestRunCreateBranchFrom(t *testing.T) {
+	var created *BranchCreateRequest
+	const base = "/api/v4/projects/123"
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case r.URL.Path == base:
+			writeTestJSON(t, w, Project{ID: 123, DefaultBranch: "main"})
+		case r.URL.Path == base+"/merge_requests" && r.Method == http.MethodGet:
+			writeTestJSON(t, w, []MergeRequest{})
+		case r.URL.Path == base+"/repository/branches/feature/test" && r.Method == http.MethodGet:
+			if created == nil {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			writeTestJSON(t, w, map[string]string{"name": "feature/test"})
+		case r.URL.Path == base+"/repository/branches" && r.Method == http.MethodPost:
+			created = &BranchCreateRequest{}
+			if err := json.NewDecoder(r.Body).Decode(created); err != nil {
+				t.Errorf("decode branch request: %v", err)
+			}
+			w.WriteHeader(http.StatusCreated)
+		case r.URL.Path == base+"/merge_requests" && r.Method == http.MethodPost:
+			if created == nil {
+				t.Error("MR created before its source branch")
+			}
+			w.WriteHeader(http.StatusCreated)
+			writeTestJSON(t, w, MergeRequest{ID: 1, IID: 1})
+		default:
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	config := &Config{
+		GitLabURL: server.URL, ProjectID: 123, PrivateToken: "test-token",
+		SourceBranch: "feature/test", TargetBranch: "main", UserIDs: []int{1},
+		CreateBranchFrom: "v1.2.0",
+	}
+
+	var err error
+	out := captureOutput(t, func() { err = run(context.Background(), config) })
+	if err != nil {
+		t.Fatalf("run() error = %v", err)
+	}
+	if created == nil || created.Branch != "feature/test" || created.Ref != "v1.2.0" {
+		t.Errorf("branch request = %+v, want feature/test from v1.2.0", created)
+	}
+	if !strings.Contains(out, "Created branch feature/test from v1.2.0") {
+		t.Errorf("output %q does not report the created branch", out)
+	}
+}
+
+// rebaseServer mocks the single-MR and rebase endpoints for MR 42. The MR is
+// behind by `behind` commits; once a rebase is requested it reports
+// rebase_in_progress for `polls` lookups and then mergeError and the new head.
+func rebaseServer(t *testing.T, behind, polls int, mergeError string) (*httptest.Server, *int) {
+	t.Helper()
+
+	rebases := 0
+	lookups := 0
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		switch {
+		case r.URL.Path == "/api/v4/projects/123/merge_requests/42/rebase" && r.Method == http.MethodPut:
+			rebases++
+			w.WriteHeader(http.StatusAccepted)
+			writeTestJSON(t, w, map[string]bool{"rebase_in_progress": true})
+
+		case r.URL.Path == "/api/v4/projects/123/merge_requests/42" && r.Method == http.MethodGet:
+			mr := MergeRequest{IID: 42, TargetBranch: "main", SHA: "0ldhead0000"}
+			switch {
+			case r.URL.Query().Get("include_diverged_commits_count") == "true":
+				mr.DivergedCommitsCount = behind
+			case r.URL.Query().Get("include_rebase_in_progress") == "true":
+				lookups++
+				if lookups <= polls {
+					mr.RebaseInProgress = true
+				} else {
+					mr.MergeError = mergeError
+					mr.SHA = "rebasedhead1234"
+				}
+			default:
+				t.Errorf("MR lookup without the attribute it needs: %s", r.URL.RawQuery)
+			}
+			writeTestJSON(t, w, mr)
+
+		default:
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	return server, &rebases
+}
+
+// TestRebaseMR pins the --rebase flow: a branch that is behind is rebased and
+// waited for, and the MR's head SHA follows the rebase so the pipeline and
+// auto-merge that come after act on the rebased commit.
+func TestRebaseMR(t *testing.T) {
+	server, rebases := rebaseServer(t, 3, 2, "")
+	config := &Config{
+		GitLabURL: server.URL, ProjectID: 123, PrivateToken: "test-token", PollInterval: time.Millisecond,
+	}
+	mr := &MergeRequest{IID: 42, SHA: "0ldhead0000"}
+
+	var err error
+	out := captureOutput(t, func() { err = rebaseMR(context.Background(), &http.Client{}, config, mr) })
+	if err != nil {
+		t.Fatalf("rebaseMR() error = %v", err)
+	}
+	if *rebases != 1 {
+		t.Errorf("rebase requested %d times, want 1", *rebases)
+	}
+	if mr.SHA != "rebasedhead1234" {
+		t.Errorf("mr.SHA = %q, want the rebased head", mr.SHA)
+	}
+	if !strings.Contains(out, "3 commit(s) behind") || !strings.Contains(out, "head is now rebasedh") {
+		t.Errorf("output %q does not report the rebase", out)
+	}
+}
+
+func TestRebaseMRUpToDate(t *testing.T) {
+	server, rebases := rebaseServer(t, 0, 0, "")
+	config := &Config{GitLabURL: server.URL, ProjectID: 123, PrivateToken: "test-token"}
+	mr := &MergeRequest{IID: 42, SHA: "0ldhead0000"}
+
+	var err error
+	out := captureOutput(t, func() { err = rebaseMR(context.Background(), &http.Client{}, config, mr) })
+	if err != nil {
+		t.Fatalf("rebaseMR() error = %v", err)
+	}
+	if *rebases != 0 {
+		t.Errorf("rebase requested %d times for a branch that is not behind", *rebases)
+	}
+	if mr.SHA != "0ldhead0000" {
+		t.Errorf("mr.SHA = %q, want it unchanged", mr.SHA)
+	}
+	if !strings.Contains(out, "no rebase needed") {
+		t.Errorf("output %q does not report the skipped rebase", out)
+	}
+}
+
+// TestRebaseMRConflict pins that a rebase GitLab gave up on fails with the
+// reason it reported, rather than passing as done once it is no longer running.
+func TestRebaseMRConflict(t *testing.T) {
+	server, _ := rebaseServer(t, 1, 0, "Rebase failed: Rebase locally, resolve all conflicts, then push the branch.")
+	config := &Config{
+		GitLabURL: server.URL, ProjectID: 123, PrivateToken: "test-token", PollInterval: time.Millisecond,
+	}
+
+	var err error
+	captureOutput(t, func() {
+		err = rebaseMR(context.Background(), &http.Client{}, config, &MergeRequest{IID: 42})
+	})
+	if err == nil {
+		t.Fatal("rebaseMR() error = nil, want the conflict")
+	}
+	if !strings.Contains(err.Error(), "resolve all conflicts") {
+		t.Errorf("error = %q, want GitLab's merge_error in it", err)
+	}
+}
+
+// TestRebaseMRStaleError pins that a merge_error left over from an earlier
+// attempt, which GitLab does not clear, fails a rebase only when the rebase
+// did not move the head.
+func TestRebaseMRStaleError(t *testing.T) {
+	const stale = "Rebase failed: Rebase locally, resolve all conflicts, then push the branch."
+
+	for _, tt := range []struct {
+		name    string
+		newHead string
+		wantErr bool
+	}{
+		{name: "head moved", newHead: "rebasedhead1234"},
+		{name: "head unchanged", newHead: "0ldhead0000", wantErr: true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				switch {
+				case r.URL.Path == "/api/v4/projects/123/merge_requests/42/rebase" && r.Method == http.MethodPut:
+					w.WriteHeader(http.StatusAccepted)
+					writeTestJSON(t, w, map[string]bool{"rebase_in_progress": true})
+				case r.URL.Path == "/api/v4/projects/123/merge_requests/42" && r.Method == http.MethodGet:
+					mr := MergeRequest{IID: 42, TargetBranch: "main", SHA: "0ldhead0000", MergeError: stale}
+					if r.URL.Query().Get("include_diverged_commits_count") == "true" {
+						mr.DivergedCommitsCount = 2
+					} else {
+						mr.SHA = tt.newHead
+					}
+					writeTestJSON(t, w, mr)
+				default:
+					t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+					w.WriteHeader(http.StatusNotFound)
+				}
+			}))
+			defer server.Close()
+
+			config := &Config{
+				GitLabURL: server.URL, ProjectID: 123, PrivateToken: "test-token", PollInterval: time.Millisecond,
+			}
+
+			var err error
+			captureOutput(t, func() {
+				err = rebaseMR(context.Background(), &http.Client{}, config, &MergeRequest{IID: 42})
+			})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("rebaseMR() error = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestPoll(t *testing.T) {
+	t.Run("done", func(t *testing.T) {
+		calls := 0
+		err := poll(context.Background(), time.Millisecond, time.Second, func() (bool, error) {
+			calls++
+			return calls == 3, nil
+		})
+		if err != nil || calls != 3 {
+			t.Errorf("poll() = %v after %d calls, want nil after 3", err, calls)
+		}
+	})
+
+	t.Run("check error", func(t *testing.T) {
+		boom := errors.New("boom")
+		err := poll(context.Background(), time.Millisecond, time.Second, func() (bool, error) {
+			return false, boom
+		})
+		if !errors.Is(err, boom) {
+			t.Errorf("poll() = %v, want the check's error", err)
+		}
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		err := poll(context.Background(), 10*time.Millisecond, 25*time.Millisecond, func() (bool, error) {
+			return false, nil
+		})
+		if !errors.Is(err, errWaitTimeout) {
+			t.Errorf("poll() = %v, want errWaitTimeout", err)
+		}
+	})
+
+	t.Run("canceled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		err := poll(ctx, time.Hour, 2*time.Hour, func() (bool, error) { return false, nil })
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("poll() = %v, want context.Canceled", err)
+		}
+	})
+}
+
+// mergeStatusServer serves MR 42 with the given detailed_merge_status values in
+// turn, repeating the last one, and counts the lookups.
+func mergeStatusServer(t *testing.T, statuses []string, headPipelineFrom int, oldHead bool) (*httptest.Server, *int) {
+	t.Helper()
+
+	lookups := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v4/projects/123/merge_requests/42" || r.Method != http.MethodGet {
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		mr := MergeRequest{IID: 42, DetailedMergeStatus: statuses[min(lookups, len(statuses)-1)]}
+		switch {
+		case lookups >= headPipelineFrom:
+			mr.HeadPipeline = &Pipeline{ID: 9, Status: "running"}
+		case oldHead:
+			mr.HeadPipeline = &Pipeline{ID: 5, Status: "success"}
+		}
+		lookups++
+		writeTestJSON(t, w, mr)
+	}))
+	t.Cleanup(server.Close)
+
+	return server, &lookups
+}
+
+// TestWaitMergeable pins how auto-merge waits on detailed_merge_status: the
+// transient states are waited out, the blocking ones fail with their own
+// reason, and the CI states auto-merge exists for go straight through.
+func TestWaitMergeable(t *testing.T) {
+	tests := []struct {
+		name             string
+		statuses         []string
+		headPipelineFrom int
+		oldHead          bool
+		requested        *Pipeline
+		trigger          bool
+		wantLookups      int
+		errSubstr        string
+	}{
+		{name: "mergeable", statuses: []string{"mergeable"}, wantLookups: 1},
+		{name: "pipeline running", statuses: []string{"ci_still_running"}, wantLookups: 1},
+		{name: "checking then mergeable", statuses: []string{"checking", "preparing", "mergeable"}, wantLookups: 3},
+		{
+			name: "conflict", statuses: []string{"checking", "conflict"}, wantLookups: 2,
+			errSubstr: "conflicts with the target branch",
+		},
+		{
+			name: "unresolved threads", statuses: []string{"discussions_not_resolved"}, wantLookups: 1,
+			errSubstr: "unresolved threads",
+		},
+		{
+			name: "not approved", statuses: []string{"not_approved"}, wantLookups: 1,
+			errSubstr: "approvals",
+		},
+		{
+			// The pipeline --trigger-pipeline just asked for is not the MR's head
+			// pipeline yet; accepting now would merge without waiting for it.
+			name: "waits for the triggered pipeline", statuses: []string{"ci_must_pass"},
+			headPipelineFrom: 2, trigger: true, wantLookups: 3,
+		},
+		{
+			// An older head pipeline, say the one that ran before the push, is
+			// not the one requested either.
+			name: "waits past an older head pipeline", statuses: []string{"ci_must_pass"},
+			headPipelineFrom: 2, oldHead: true, requested: &Pipeline{ID: 9}, trigger: true, wantLookups: 3,
+		},
+		{name: "unknown status left to GitLab", statuses: []string{"something_new"}, wantLookups: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, lookups := mergeStatusServer(t, tt.statuses, tt.headPipelineFrom, tt.oldHead)
+			config := &Config{
+				GitLabURL: server.URL, ProjectID: 123, PrivateToken: "test-token",
+				PollInterval: time.Millisecond, TriggerPipeline: tt.trigger,
+			}
+
+			err := waitMergeable(context.Background(), &http.Client{}, config,
+				&MergeRequest{IID: 42, HeadPipeline: tt.requested})
+
+			if tt.errSubstr == "" && err != nil {
+				t.Errorf("waitMergeable() error = %v, want nil", err)
+			}
+			if tt.errSubstr != "" && (err == nil || !strings.Contains(err.Error(), tt.errSubstr)) {
+				t.Errorf("waitMergeable() error = %v, want it to contain %q", err, tt.errSubstr)
+			}
+			if *lookups != tt.wantLookups {
+				t.Errorf("status looked up %d times, want %d", *lookups, tt.wantLookups)
+			}
+		})
+	}
+}
+
+// TestWaitMergeableLookupFails pins that an unreadable status fails the run
+// rather than letting the merge go ahead on checks that were never made.
+func TestWaitMergeableLookupFails(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer server.Close()
+
+	config := &Config{GitLabURL: server.URL, ProjectID: 123, PrivateToken: "test-token"}
+
+	err := waitMergeable(context.Background(), &http.Client{}, config, &MergeRequest{IID: 42})
+	if err == nil || !strings.Contains(err.Error(), "could not check whether MR (IID: 42) can be merged") {
+		t.Errorf("waitMergeable() error = %v, want the failed check", err)
+	}
+}
+
+func TestParseGitLabVersion(t *testing.T) {
+	tests := []struct {
+		version string
+		want    gitlabVersion
+		ok      bool
+	}{
+		{version: "17.11.2-ee", want: gitlabVersion{17, 11}, ok: true},
+		{version: "16.0.0-pre", want: gitlabVersion{16, 0}, ok: true},
+		{version: " 15.6.1 ", want: gitlabVersion{15, 6}, ok: true},
+		{version: "", ok: false},
+		{version: "unknown", ok: false},
+	}
+
+	for _, tt := range tests {
+		got, ok := parseGitLabVersion(tt.version)
+		if ok != tt.ok || got != tt.want {
+			t.Errorf("parseGitLabVersion(%q) = %v, %v, want %v, %v", tt.version, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+// TestServerSupports pins the capability table's three answers: by release
+// when the release is known, by the per-feature assumption when it is not.
+func TestServerSupports(t *testing.T) {
+	tests := []struct {
+		name    string
+		server  *serverInfo
+		feature string
+		want    bool
+	}{
+		{name: "new enough", server: &serverInfo{release: gitlabVersion{17, 11}, known: true},
+			feature: featureAutoMergeParam, want: true},
+		{name: "newer major", server: &serverInfo{release: gitlabVersion{18, 0}, known: true},
+			feature: featureAutoMergeParam, want: true},
+		{name: "too old", server: &serverInfo{release: gitlabVersion{17, 10}, known: true},
+			feature: featureAutoMergeParam, want: false},
+		{name: "unknown release, safe default off", server: &serverInfo{},
+			feature: featureAutoMergeParam, want: false},
+		{name: "nil server, safe default on", server: nil,
+			feature: featureDetailedMergeStatus, want: true},
+		{name: "old server without detailed status", server: &serverInfo{release: gitlabVersion{15, 5}, known: true},
+			feature: featureDetailedMergeStatus, want: false},
+		{name: "feature not in the table", server: &serverInfo{release: gitlabVersion{1, 0}, known: true},
+			feature: "anything", want: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.server.supports(tt.feature); got != tt.want {
+				t.Errorf("supports(%q) = %v, want %v", tt.feature, got, tt.want)
+			}
+		})
+	}
+}
+
+// TestGitLabServerAsksOnce pins that the version is fetched once per run and
+// that a failed lookup is cached as "unknown" instead of being retried by
+// every feature that asks.
+func TestGitLabServerAsksOnce(t *testing.T) {
+	for _, status := range []int{http.StatusOK, http.StatusNotFound} {
+		calls := 0
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			calls++
+			if r.URL.Path != "/api/v4/version" {
+				t.Errorf("unexpected request %s", r.URL.Path)
+			}
+			w.WriteHeader(status)
+			writeTestJSON(t, w, map[string]string{"version": "17.11.2-ee", "revision": "abc"})
+		}))
+
+		config := &Config{GitLabURL: server.URL, PrivateToken: "test-token"}
+		var first, second *serverInfo
+		captureStderr(t, func() {
+			first = gitlabServer(context.Background(), &http.Client{}, config)
+			second = gitlabServer(context.Background(), &http.Client{}, config)
+		})
+		server.Close()
+
+		if calls != 1 {
+			t.Errorf("status %d: /version asked %d times, want 1", status, calls)
+		}
+		if first != second {
+			t.Errorf("status %d: second lookup returned a different result", status)
+		}
+		if wantKnown := status == http.StatusOK; first.known != wantKnown {
+			t.Errorf("status %d: known = %v, want %v", status, first.known, wantKnown)
+		}
+	}
+}
+
+// TestAcceptMRAutoMergeParam pins the request shape per release: auto_merge on
+// a release that has it, merge_when_pipeline_succeeds everywhere else, and
+// never both.
+func TestAcceptMRAutoMergeParam(t *testing.T) {
+	tests := []struct {
+		name      string
+		server    *serverInfo
+		wantParam string
+		notParam  string
+	}{
+		{name: "17.11", server: &serverInfo{release: gitlabVersion{17, 11}, known: true},
+			wantParam: "auto_merge", notParam: "merge_when_pipeline_succeeds"},
+		{name: "16.11", server: &serverInfo{release: gitlabVersion{16, 11}, known: true},
+			wantParam: "merge_when_pipeline_succeeds", notParam: "auto_merge"},
+		{name: "unknown", server: nil,
+			wantParam: "merge_when_pipeline_succeeds", notParam: "auto_merge"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var body map[string]any
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+					t.Errorf("decode accept request: %v", err)
+				}
+				writeTestJSON(t, w, MergeRequest{IID: 42})
+			}))
+			defer server.Close()
+
+			config := &Config{GitLabURL: server.URL, ProjectID: 123, PrivateToken: "test-token", server: tt.server}
+			if err := acceptMR(context.Background(), &http.Client{}, config, 42, ""); err != nil {
+				t.Fatalf("acceptMR() error = %v", err)
+			}
+
+			if body[tt.wantParam] != true {
+				t.Errorf("%s = %v, want true (body %v)", tt.wantParam, body[tt.wantParam], body)
+			}
+			if _, ok := body[tt.notParam]; ok {
+				t.Errorf("%s sent alongside %s (body %v)", tt.notParam, tt.wantParam, body)
+			}
+		})
+	}
+}
+
+// TestWaitMergeableOldGitLab pins that a release without detailed_merge_status
+// is not polled for it at all.
+func TestWaitMergeableOldGitLab(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+	}))
+	defer server.Close()
+
+	config := &Config{
+		GitLabURL: server.URL, ProjectID: 123, PrivateToken: "test-token",
+		server: &serverInfo{release: gitlabVersion{15, 5}, known: true},
+	}
+	if err := waitMergeable(context.Background(), &http.Client{}, config, &MergeRequest{IID: 42}); err != nil {
+		t.Errorf("waitMergeable() error = %v, want nil", err)
+	}
+}
+
+// TestAcceptMRSHAGuard pins that auto-merge is pinned to the processed head and
+// that GitLab's 409 for a moved branch is reported as exactly that.
+func TestAcceptMRSHAGuard(t *testing.T) {
+	var sentSHA any
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]any
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Errorf("decode accept request: %v", err)
+		}
+		sentSHA = body["sha"]
+		w.WriteHeader(http.StatusConflict)
+		writeTestJSON(t, w, map[string]string{"message": "SHA does not match HEAD of source branch: 9999"})
+	}))
+	defer server.Close()
+
+	config := &Config{GitLabURL: server.URL, ProjectID: 123, PrivateToken: "test-token"}
+	err := acceptMR(context.Background(), &http.Client{}, config, 42, "deadbeefcafe")
+
+	if sentSHA != "deadbeefcafe" {
+		t.Errorf("sha = %v, want the processed head deadbeefcafe", sentSHA)
+	}
+	if !errors.Is(err, errBranchMoved) {
+		t.Errorf("acceptMR() error = %v, want errBranchMoved", err)
+	}
+	if err != nil && !strings.Contains(err.Error(), "moved since this job started") {
+		t.Errorf("error = %q, want it to say the branch moved", err)
+	}
+}
+
+// TestWaitMergeableBranchMoved pins that a head which moved while auto-merge
+// was waiting ends the wait right away with the moved-branch error.
+func TestWaitMergeableBranchMoved(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		writeTestJSON(t, w, MergeRequest{IID: 42, SHA: "newpush00000", DetailedMergeStatus: "checking"})
+	}))
+	defer server.Close()
+
+	config := &Config{GitLabURL: server.URL, ProjectID: 123, PrivateToken: "test-token", PollInterval: time.Hour}
+	err := waitMergeable(context.Background(), &http.Client{}, config, &MergeRequest{IID: 42, SHA: "processed000"})
+	if !errors.Is(err, errBranchMoved) {
+		t.Errorf("waitMergeable() error = %v, want errBranchMoved", err)
+	}
+}
+
+// mergeTrainCalls records what mergeTrainServer was asked for. added stays nil
+// when the MR was never added.
+type mergeTrainCalls struct {
+	added *MergeTrainAddRequest
+}
+
+// mergeTrainServer mocks the version, MR and merge train endpoints for MR 42 on
+// main. train lists the IIDs on the active train after the addition.
+func mergeTrainServer(t *testing.T, version string, train []int) (*httptest.Server, *mergeTrainCalls) {
+	t.Helper()
+
+	calls := &mergeTrainCalls{}
+	const base = "/api/v4/projects/123"
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		switch {
+		case r.URL.Path == "/api/v4/version":
+			writeTestJSON(t, w, map[string]string{"version": version})
+
+		case r.URL.Path == base+"/merge_requests/42" && r.Method == http.MethodGet:
+			writeTestJSON(t, w, MergeRequest{IID: 42, SHA: "deadbeefcafe", DetailedMergeStatus: "ci_still_running"})
+
+		case r.URL.Path == base+"/merge_trains/merge_requests/42" && r.Method == http.MethodPost:
+			calls.added = &MergeTrainAddRequest{}
+			if err := json.NewDecoder(r.Body).Decode(calls.added); err != nil {
+				t.Errorf("decode merge train request: %v", err)
+			}
+			w.WriteHeader(http.StatusCreated)
+			writeTestJSON(t, w, []MergeTrainCar{})
+
+		case r.URL.Path == base+"/merge_trains/main" && r.Method == http.MethodGet:
+			if r.URL.Query().Get("scope") != "active" || r.URL.Query().Get("sort") != "asc" {
+				t.Errorf("train listed with %q, want the active train oldest first", r.URL.RawQuery)
+			}
+			cars := make([]MergeTrainCar, len(train))
+			for i, iid := range train {
+				cars[i].MergeRequest.IID = iid
+			}
+			writeTestJSON(t, w, cars)
+
+		default:
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	return server, calls
+}
+
+// TestAddToMergeTrain pins --merge-train: the MR is added pinned to its head,
+// with the squash setting, and its place on the train is reported; an MR not
+// on the train yet is reported as waiting for its pipeline.
+func TestAddToMergeTrain(t *testing.T) {
+	tests := []struct {
+		name    string
+		train   []int
+		wantOut string
+	}{
+		{name: "on the train", train: []int{7, 42}, wantOut: "for main, position 2 of 2"},
+		{name: "queued", train: []int{7}, wantOut: "will join the merge train for main when its pipeline succeeds"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, calls := mergeTrainServer(t, "16.11.0-ee", tt.train)
+			config := &Config{
+				GitLabURL: server.URL, ProjectID: 123, PrivateToken: "test-token",
+				TargetBranch: "main", SquashCommits: true, PollInterval: time.Millisecond,
+			}
+			mr := &MergeRequest{IID: 42, SHA: "deadbeefcafe"}
+
+			var err error
+			out := captureOutput(t, func() { err = addToMergeTrain(context.Background(), &http.Client{}, config, mr) })
+			if err != nil {
+				t.Fatalf("addToMergeTrain() error = %v", err)
+			}
+
+			added := calls.added
+			if added == nil {
+				t.Fatal("MR was not added to the merge train")
+			}
+			if !added.WhenPipelineSucceeds || added.SHA != "deadbeefcafe" || !added.Squash {
+				t.Errorf("merge train request = %+v, want when_pipeline_succeeds, the head SHA and squash", added)
+			}
+			if !strings.Contains(out, tt.wantOut) {
+				t.Errorf("output %q does not contain %q", out, tt.wantOut)
+			}
+		})
+	}
+}
+
+// TestAddToMergeTrainOldGitLab pins that a release without the merge trains API
+// is told to use --auto-merge instead of being sent a request it cannot serve.
+func TestAddToMergeTrainOldGitLab(t *testing.T) {
+	server, calls := mergeTrainServer(t, "15.10.3", nil)
+	config := &Config{GitLabURL: server.URL, ProjectID: 123, PrivateToken: "test-token", TargetBranch: "main"}
+
+	err := addToMergeTrain(context.Background(), &http.Client{}, config, &MergeRequest{IID: 42})
+	if err == nil || !strings.Contains(err.Error(), "use --auto-merge instead") {
+		t.Errorf("addToMergeTrain() error = %v, want it to point at --auto-merge", err)
+	}
+	if calls.added != nil {
+		t.Error("MR added although the release has no merge trains API")
+	}
+}
+
+// TestLeaveMergeTrain pins that leaving the train cancels auto-merge, and that
+// GitLab's 406 for an MR that is not on it succeeds with a message of its own,
+// as --cancel-auto-merge does.
+func TestLeaveMergeTrain(t *testing.T) {
+	for _, status := range []int{http.StatusOK, http.StatusNotAcceptable} {
+		canceled := false
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodPost ||
+				r.URL.Path != "/api/v4/projects/123/merge_requests/42/cancel_merge_when_pipeline_succeeds" {
+				t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+			}
+			canceled = true
+			w.WriteHeader(status)
+		}))
+
+		config := &Config{GitLabURL: server.URL, ProjectID: 123, PrivateToken: "test-token", TargetBranch: "main"}
+		var err error
+		out := captureOutput(t, func() { err = leaveMergeTrain(context.Background(), &http.Client{}, config, &MergeRequest{IID: 42}) })
+		server.Close()
+
+		if !canceled {
+			t.Errorf("status %d: auto-merge was not canceled", status)
+		}
+		if status == http.StatusOK {
+			if err != nil || !strings.Contains(out, "Removed MR (IID: 42) from the merge train for main") {
+				t.Errorf("status 200: err = %v, output %q", err, out)
+			}
+			continue
+		}
+		if err != nil || !strings.Contains(out, "MR (IID: 42) is not on the merge train, nothing to remove") {
+			t.Errorf("status 406: err = %v, output %q, want it to succeed saying there was nothing to remove", err, out)
+		}
+	}
+}
+
+func TestValidateMergeTrain(t *testing.T) {
+	tests := []struct {
+		name      string
+		config    Config
+		errSubstr string
+	}{
+		{name: "merge train", config: Config{MergeTrain: true, Ready: true, CommitPrefix: "Draft"}},
+		{name: "leave", config: Config{LeaveMergeTrain: true}},
+		{
+			name:      "with auto-merge",
+			config:    Config{MergeTrain: true, AutoMerge: true},
+			errSubstr: "--auto-merge cannot be used with --merge-train",
+		},
+		{
+			name:      "draft",
+			config:    Config{MergeTrain: true, Draft: true},
+			errSubstr: "--merge-train cannot be used with --draft",
+		},
+		{
+			name:      "draft prefix",
+			config:    Config{MergeTrain: true, CommitPrefix: "Draft"},
+			errSubstr: `--merge-train cannot be used with --commit-prefix "Draft"`,
+		},
+		{
+			name:      "join and leave",
+			config:    Config{MergeTrain: true, LeaveMergeTrain: true},
+			errSubstr: "--leave-merge-train cannot be used",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateConfig(&tt.config)
+			if tt.errSubstr == "" {
+				if err != nil {
+					t.Errorf("validateConfig() error = %v, want nil", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.errSubstr) {
+				t.Errorf("validateConfig() error = %v, want it to contain %q", err, tt.errSubstr)
+			}
+		})
+	}
+}
+
+// mergeCalls records what mergeServer was asked to merge. merged stays nil when
+// no merge was requested.
+type mergeCalls struct {
+	merged *MRAcceptRequest
+}
+
+// mergeServer mocks the endpoints the merge command reads for MR 42 of project
+// 123, which is the open MR from feature to main with unresolved threads still
+// open, and its merge endpoint.
+func mergeServer(
+	t *testing.T, mr MergeRequest, approvals MRApprovals, unresolved int,
+) (*httptest.Server, *mergeCalls) {
+	t.Helper()
+
+	calls := &mergeCalls{}
+	const base = "/api/v4/projects/123"
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		switch {
+		case r.URL.Path == base && r.Method == http.MethodGet:
+			writeTestJSON(t, w, Project{ID: 123, DefaultBranch: "main"})
+
+		case r.URL.Path == base+"/merge_requests" && r.Method == http.MethodGet:
+			writeTestJSON(t, w, []MergeRequest{{IID: 42}})
+
+		case r.URL.Path == base+"/merge_requests/42" && r.Method == http.MethodGet:
+			writeTestJSON(t, w, mr)
+
+		case r.URL.Path == base+"/merge_requests/42/approvals" && r.Method == http.MethodGet:
+			writeTestJSON(t, w, approvals)
+
+		case r.URL.Path == base+"/merge_requests/42/discussions" && r.Method == http.MethodGet:
+			discussions := `[{"id":"a","notes":[{"resolvable":false}]},` +
+				`{"id":"b","notes":[{"resolvable":true,"resolved":true}]}`
+			for i := range unresolved {
+				discussions += fmt.Sprintf(`,{"id":"open%d","notes":[{"resolvable":true,"resolved":false},`+
+					`{"resolvable":true}]}`, i)
+			}
+			_, _ = w.Write([]byte(discussions + "]"))
+
+		case r.URL.Path == base+"/merge_requests/42/commits" && r.Method == http.MethodGet:
+			writeTestJSON(t, w, []Commit{
+				{ID: "c2", AuthorName: "Bob", AuthorEmail: "bob@example.com"},
+				{ID: "c1", AuthorName: "Alice", AuthorEmail: "alice@example.com"},
+			})
+
+		case r.URL.Path == base+"/merge_requests/42/merge" && r.Method == http.MethodPut:
+			calls.merged = &MRAcceptRequest{}
+			if err := json.NewDecoder(r.Body).Decode(calls.merged); err != nil {
+				t.Errorf("decode merge request: %v", err)
+			}
+			merged := mr
+			merged.State = "merged"
+			merged.MergeCommitSHA = "feedface00000000"
+			writeTestJSON(t, w, merged)
+
+		default:
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	return server, calls
+}
+
+// mergeableMR is an MR that passes every gate of the merge command.
+func mergeableMR() MergeRequest {
+	return MergeRequest{
+		IID: 42, Title: "Add caching", Description: "Closes #12", State: "opened",
+		SourceBranch: "feature", TargetBranch: "main", SHA: "deadbeefcafe0000",
+		DetailedMergeStatus: "mergeable",
+		HeadPipeline:        &Pipeline{ID: 9, Status: "success", SHA: "deadbeefcafe0000"},
+	}
+}
+
+// TestRunMerge pins the merge command's happy path, with the MR found by IID
+// and by source branch: every gate is checked off, and the merge is pinned to
+// the head they were checked at and carries the commit messages.
+func TestRunMerge(t *testing.T) {
+	for _, byIID := range []bool{true, false} {
+		server, calls := mergeServer(t, mergeableMR(), MRApprovals{Approved: true}, 0)
+		config := &Config{
+			Command: commandMerge, GitLabURL: server.URL, ProjectID: 123, PrivateToken: "test-token",
+			SquashCommits: true, MergeCommitMessage: "Release 2.0",
+			SquashCommitMessage: "{{.Title}} (!{{.IID}})\n\n{{range .CoAuthors}}Co-authored-by: {{.}}\n{{end}}",
+			PollInterval:        time.Millisecond,
+		}
+		if byIID {
+			config.MRIID = 42
+		} else {
+			config.SourceBranch = "feature"
+		}
+
+		var err error
+		out := captureOutput(t, func() { err = run(context.Background(), config) })
+		if err != nil {
+			t.Fatalf("byIID=%v: run() error = %v", byIID, err)
+		}
+
+		merged := calls.merged
+		if merged == nil {
+			t.Fatalf("byIID=%v: MR was not merged", byIID)
+		}
+		if merged.SHA != "deadbeefcafe0000" || !merged.Squash || merged.AutoMerge || merged.MergeWhenPipelineSucceeds {
+			t.Errorf("byIID=%v: merge request = %+v, want an immediate squash merge at the head", byIID, merged)
+		}
+		wantSquash := "Add caching (!42)\n\nCo-authored-by: Alice <alice@example.com>\nCo-authored-by: Bob <bob@example.com>"
+		if merged.MergeCommitMessage != "Release 2.0" || merged.SquashCommitMessage != wantSquash {
+			t.Errorf("byIID=%v: commit messages = %q, %q", byIID, merged.MergeCommitMessage, merged.SquashCommitMessage)
+		}
+		if strings.Contains(out, "[ ]") {
+			t.Errorf("byIID=%v: output %q has an unmet condition", byIID, out)
+		}
+		if !strings.Contains(out, "[x] pipeline succeeded for deadbeef (pipeline 9: success)") ||
+			!strings.Contains(out, "Merged MR !42 into main as commit feedface") {
+			t.Errorf("byIID=%v: output %q does not report the checks and the merge", byIID, out)
+		}
+	}
+}
+
+// TestRunMergeGatesUnmet pins that an MR failing its gates is not merged, and
+// that the error names every unmet condition rather than only the first.
+func TestRunMergeGatesUnmet(t *testing.T) {
+	mr := mergeableMR()
+	mr.HasConflicts = true
+	server, calls := mergeServer(t, mr, MRApprovals{Approved: false, ApprovalsLeft: 1}, 1)
+
+	config := &Config{
+		Command: commandMerge, MRIID: 42, GitLabURL: server.URL, ProjectID: 123,
+		PrivateToken: "test-token", PollInterval: time.Millisecond,
+	}
+
+	var err error
+	out := captureOutput(t, func() { err = run(context.Background(), config) })
+	if err == nil {
+		t.Fatal("run() error = nil, want the unmet conditions")
+	}
+	if calls.merged != nil {
+		t.Error("MR was merged although its conditions were not met")
+	}
+
+	for _, want := range []string{
+		"is approved (1 more approval(s) required)", "has no unresolved threads", "has no conflicts with main",
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error %q does not name %q", err, want)
+		}
+		if !strings.Contains(out, "[ ] "+want) {
+			t.Errorf("checklist %q does not mark %q unmet", out, want)
+		}
+	}
+	if strings.Contains(err.Error(), "pipeline") {
+		t.Errorf("error %q names the pipeline, which succeeded", err)
+	}
+}
+
+// TestRunStatus pins the status command on a mergeable MR in each format: the
+// report covers the MR's state, nothing is merged, and the run succeeds.
+func TestRunStatus(t *testing.T) {
+	mr := mergeableMR()
+	mr.Labels = []string{"backend", "cache"}
+	approvals := MRApprovals{Approved: true, ApprovalsRequired: 1, ApprovedBy: []MRApprover{{User: User{ID: 7}}}}
+
+	tests := []struct {
+		format string
+		want   []string
+	}{
+		{format: formatText, want: []string{
+			"MR !42: Add caching", "Merge status: mergeable", "Pipeline: 9, success",
+			"Approvals: 1 given, 1 required", "Unresolved threads: 0", "Labels: backend, cache",
+			"[x] GitLab reports it mergeable", "MR !42 is mergeable",
+		}},
+		{format: formatJSON, want: []string{
+			`"mergeable": true`, `"blockers": []`, `"pipeline_status": "success"`, `"approvals_given": 1`,
+			`"unresolved_threads": 0`, `"labels": [`,
+		}},
+		{format: formatJUnit, want: []string{
+			`<testsuite name="merge request !42" tests="7" failures="0">`, `name="is approved"></testcase>`,
+		}},
+	}
+
+	for _, tt := range tests {
+		server, calls := mergeServer(t, mr, approvals, 0)
+		config := &Config{
+			Command: commandStatus, MRIID: 42, Format: tt.format, GitLabURL: server.URL, ProjectID: 123,
+			PrivateToken: "test-token", PollInterval: time.Millisecond,
+		}
+
+		var err error
+		out := captureOutput(t, func() { err = run(context.Background(), config) })
+		if err != nil {
+			t.Fatalf("%s: run() error = %v", tt.format, err)
+		}
+		if calls.merged != nil {
+			t.Errorf("%s: the status command merged the MR", tt.format)
+		}
+		for _, want := range tt.want {
+			if !strings.Contains(out, want) {
+				t.Errorf("%s: output %q does not contain %q", tt.format, out, want)
+			}
+		}
+	}
+}
+
+// TestRunStatusOpenThreads pins that the thread check goes by the same count
+// the report prints: open threads block the MR even when GitLab, in a project
+// that does not require them resolved, calls it mergeable.
+func TestRunStatusOpenThreads(t *testing.T) {
+	server, _ := mergeServer(t, mergeableMR(), MRApprovals{Approved: true}, 3)
+	config := &Config{
+		Command: commandStatus, MRIID: 42, Format: formatText, GitLabURL: server.URL, ProjectID: 123,
+		PrivateToken: "test-token", PollInterval: time.Millisecond,
+	}
+
+	var err error
+	out := captureOutput(t, func() { err = run(context.Background(), config) })
+	if !errors.Is(err, errMRBlocked) {
+		t.Errorf("run() error = %v, want errMRBlocked", err)
+	}
+	for _, want := range []string{"Unresolved threads: 3", "[ ] has no unresolved threads (3 unresolved)"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("output %q does not contain %q", out, want)
+		}
+	}
+	if strings.Contains(out, "is mergeable") {
+		t.Errorf("output %q calls the MR mergeable", out)
+	}
+}
+
+// TestRunStatusBlocked pins that a blocked MR ends the run with errMRBlocked,
+// which main turns into exitBlocked, and that every report names the blockers.
+func TestRunStatusBlocked(t *testing.T) {
+	mr := mergeableMR()
+	mr.Draft = true
+	mr.DetailedMergeStatus = "draft_status"
+
+	for _, format := range []string{formatText, formatJSON, formatJUnit} {
+		server, _ := mergeServer(t, mr, MRApprovals{Approved: true}, 1)
+		config := &Config{
+			Command: commandStatus, MRIID: 42, Format: format, GitLabURL: server.URL, ProjectID: 123,
+			PrivateToken: "test-token", PollInterval: time.Millisecond,
+		}
+
+		var err error
+		out := captureOutput(t, func() { err = run(context.Background(), config) })
+		if !errors.Is(err, errMRBlocked) {
+			t.Errorf("%s: run() error = %v, want errMRBlocked", format, err)
+		}
+		for _, want := range []string{"is not a draft", "has no unresolved threads", "status: draft_status"} {
+			if !strings.Contains(out, want) {
+				t.Errorf("%s: output %q does not name %q", format, out, want)
+			}
+		}
+	}
+
+	server, _ := mergeServer(t, mr, MRApprovals{Approved: true}, 1)
+	config := &Config{
+		Command: commandStatus, MRIID: 42, Format: formatJSON, GitLabURL: server.URL, ProjectID: 123,
+		PrivateToken: "test-token", PollInterval: time.Millisecond,
+	}
+	var status mrStatus
+	out := captureOutput(t, func() { _ = run(context.Background(), config) })
+	if err := json.Unmarshal([]byte(out), &status); err != nil {
+		t.Fatalf("JSON report %q: %v", out, err)
+	}
+	if status.Mergeable || !status.Draft || status.UnresolvedThreads != 1 || len(status.Blockers) != 3 {
+		t.Errorf("JSON report = %+v, want a blocked draft with 1 unresolved thread and 3 blockers", status)
+	}
+}
+
+// policyServer serves an MR with one unresolved thread, approved by alice, a
+// member of group team, and by bob, who is not.
+func policyServer(t *testing.T) *httptest.Server {
+	t.Helper()
+
+	const base = "/api/v4/projects/123/merge_requests/42"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		switch r.URL.EscapedPath() {
+		case base + "/discussions":
+			_, _ = w.Write([]byte(`[{"id":"a","notes":[{"resolvable":true,"resolved":false}]},` +
+				`{"id":"b","notes":[{"resolvable":true,"resolved":true}]}]`))
+		case base + "/approvals":
+			writeTestJSON(t, w, MRApprovals{ApprovedBy: []MRApprover{
+				{User: User{ID: 1, Username: "alice"}}, {User: User{ID: 2, Username: "bob"}},
+			}})
+		case "/api/v4/groups/org%2Fteam", "/api/v4/groups/org%2Fteam/members/all/1":
+			_, _ = w.Write([]byte(`{"id":1}`))
+		case "/api/v4/groups/org%2Fteam/members/all/2", "/api/v4/groups/nope":
+			w.WriteHeader(http.StatusNotFound)
+		default:
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	return server
+}
+
+func TestRunCheck(t *testing.T) {
+	tests := []struct {
+		name      string
+		config    Config
+		wantOut   []string
+		errSubstr string
+	}{
+		{
+			name:    "policy met",
+			config:  Config{MinApprovals: 2},
+			wantOut: []string{"[x] has at least 2 approval(s) (2 given)"},
+		},
+		{
+			name:   "unresolved threads and approvals from outside the group",
+			config: Config{RequireResolvedThreads: true, MinApprovals: 2, ApproverGroup: "org/team"},
+			wantOut: []string{
+				"[ ] has no unresolved threads (1 unresolved)",
+				"[ ] has at least 2 approval(s) from members of group org/team " +
+					"(1 given, not counted from outside the group: bob)",
+			},
+			errSubstr: "merge request !42 does not meet the policy: has no unresolved threads (1 unresolved); has at least 2",
+		},
+		{
+			name:    "group without a minimum",
+			config:  Config{ApproverGroup: "org/team"},
+			wantOut: []string{"[x] has at least 1 approval(s) from members of group org/team"},
+		},
+		{
+			name:    "warn mode",
+			config:  Config{RequireResolvedThreads: true, PolicyMode: policyWarn},
+			wantOut: []string{"[ ] has no unresolved threads (1 unresolved)"},
+		},
+		{
+			name:      "unknown group",
+			config:    Config{ApproverGroup: "nope"},
+			errSubstr: "group nope not found",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := policyServer(t)
+			config := tt.config
+			config.Command = commandCheck
+			config.MRIID = 42
+			config.GitLabURL = server.URL
+			config.ProjectID = 123
+			config.PrivateToken = "test-token"
+
+			var err error
+			out := captureOutput(t, func() { err = run(context.Background(), &config) })
+			if tt.errSubstr == "" && err != nil {
+				t.Fatalf("run() error = %v, want nil", err)
+			}
+			if tt.errSubstr != "" && (err == nil || !strings.Contains(err.Error(), tt.errSubstr)) {
+				t.Fatalf("run() error = %v, want it to contain %q", err, tt.errSubstr)
+			}
+			for _, want := range tt.wantOut {
+				if !strings.Contains(out, want) {
+					t.Errorf("output %q does not contain %q", out, want)
+				}
+			}
+		})
+	}
+}
+
+func TestValidatePolicyFlags(t *testing.T) {
+	tests := []struct {
+		config    Config
+		errSubstr string
+	}{
+		{config: Config{Command: commandCheck, MinApprovals: 1, PolicyMode: policyWarn}},
+		{config: Config{Command: commandCheck}, errSubstr: "the check command needs at least one of"},
+		{config: Config{RequireResolvedThreads: true}, errSubstr: "--require-resolved-threads only applies to the check command"},
+		{
+			config:    Config{Command: commandCheck, ApproverGroup: "team", PolicyMode: "block"},
+			errSubstr: `unknown --policy-mode "block"`,
+		},
+		{
+			config:    Config{Command: commandCheck, MinApprovals: 1, AutoMerge: true},
+			errSubstr: "the check command only reads the MR, it cannot be used with --auto-merge",
+		},
+	}
+
+	for _, tt := range tests {
+		err := validateConfig(&tt.config)
+		if tt.errSubstr == "" {
+			if err != nil {
+				t.Errorf("validateConfig(%+v) error = %v, want nil", tt.config, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tt.errSubstr) {
+			t.Errorf("validateConfig(%+v) error = %v, want it to contain %q", tt.config, err, tt.errSubstr)
+		}
+	}
+}
+
+// approveCalls records what approveServer was asked to do.
+type approveCalls struct {
+	approved *MRApproveRequest
+}
+
+// approveServer serves MR 42, opened by author, for a token owned by bot (ID
+// 5). The MR changes go.sum and renames docs/old.md to docs/api.md, and GitLab
+// counts changesCount changed files in it. A settingsStatus other than 0
+// answers the project's approval settings with that status instead.
+func approveServer(
+	t *testing.T, author User, authorApproval bool, approvedBy []MRApprover, approveStatus int, changesCount string,
+	settingsStatus int,
+) (*httptest.Server, *approveCalls) {
+	t.Helper()
+
+	calls := &approveCalls{}
+	const base = "/api/v4/projects/123"
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		switch {
+		case r.URL.Path == "/api/v4/user":
+			writeTestJSON(t, w, User{ID: 5, Username: "bot"})
+		case r.URL.Path == base+"/merge_requests/42":
+			writeTestJSON(t, w, MergeRequest{
+				IID: 42, SHA: "deadbeefcafe0000", TargetBranch: "main", Author: author,
+				ChangesCount: changesCount, DiffRefs: DiffRefs{HeadSHA: "deadbeefcafe0000"},
+			})
+		case r.URL.Path == base+"/merge_requests/42/approvals":
+			writeTestJSON(t, w, MRApprovals{ApprovedBy: approvedBy})
+		case r.URL.Path == base+"/approvals" && settingsStatus != 0:
+			w.WriteHeader(settingsStatus)
+			_, _ = w.Write([]byte(`{"message":"403 Forbidden"}`))
+		case r.URL.Path == base+"/approvals":
+			writeTestJSON(t, w, ProjectApprovalSettings{MergeRequestsAuthorApproval: authorApproval})
+		case r.URL.Path == base+"/merge_requests/42/diffs":
+			_, _ = w.Write([]byte(`[{"old_path":"go.sum","new_path":"go.sum"},` +
+				`{"old_path":"docs/old.md","new_path":"docs/api.md"}]`))
+		case r.URL.Path == base+"/merge_requests/42/approve" && r.Method == http.MethodPost:
+			calls.approved = &MRApproveRequest{}
+			if err := json.NewDecoder(r.Body).Decode(calls.approved); err != nil {
+				t.Errorf("decode approve request: %v", err)
+			}
+			w.WriteHeader(approveStatus)
+			_, _ = w.Write([]byte(`{}`))
+		default:
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	return server, calls
+}
+
+func TestApproveMR(t *testing.T) {
+	bot := User{ID: 5, Username: "bot"}
+
+	tests := []struct {
+		name           string
+		author         User
+		authorApproval bool
+		approvedBy     []MRApprover
+		approvePaths   []string
+		approveStatus  int
+		changesCount   string
+		settingsStatus int
+		wantApproved   bool
+		wantOut        string
+		errSubstr      string
+	}{
+		{
+			name: "approved", author: bot, authorApproval: true, approvePaths: []string{"go.sum", "docs/*"},
+			wantApproved: true, wantOut: "Approved MR (IID: 42) as bot at deadbeef",
+		},
+		{
+			name: "already approved", author: bot, authorApproval: true, approvePaths: []string{"**"},
+			approvedBy: []MRApprover{{User: bot}}, wantOut: "MR (IID: 42) is already approved by bot",
+		},
+		{
+			name: "opened by someone else", author: User{ID: 9, Username: "alice"}, authorApproval: true,
+			approvePaths: []string{"**"}, errSubstr: "refusing to approve MR !42: it was opened by alice, not by bot",
+		},
+		{
+			name: "project forbids self-approval", author: bot, approvePaths: []string{"**"},
+			errSubstr: "the project does not let authors approve their own MRs",
+		},
+		{
+			name: "approval settings not on this tier", author: bot, approvePaths: []string{"**"},
+			settingsStatus: http.StatusForbidden, wantApproved: true, wantOut: "Approved MR (IID: 42) as bot at deadbeef",
+		},
+		{
+			name: "approval settings not found", author: bot, approvePaths: []string{"**"},
+			settingsStatus: http.StatusNotFound, wantApproved: true, wantOut: "Approved MR (IID: 42) as bot at deadbeef",
+		},
+		{
+			name: "approval settings unreadable", author: bot, approvePaths: []string{"**"},
+			settingsStatus: http.StatusInternalServerError, errSubstr: "unable to read whether the project lets authors",
+		},
+		{
+			name: "path outside the allowlist", author: bot, authorApproval: true, approvePaths: []string{"go.sum"},
+			errSubstr: "it changes 2 path(s) outside --approve-paths: docs/api.md, docs/old.md",
+		},
+		{
+			name: "diff past GitLab's limits", author: bot, authorApproval: true, approvePaths: []string{"**"},
+			changesCount: "1000+", errSubstr: "GitLab lists 2 of the MR's 1000+ changed files",
+		},
+		{
+			name: "star within one directory", author: bot, authorApproval: true, approvePaths: []string{"*"},
+			errSubstr: "it changes 2 path(s) outside --approve-paths: docs/api.md, docs/old.md",
+		},
+		{
+			name: "GitLab refuses", author: bot, authorApproval: true, approvePaths: []string{"**"},
+			approveStatus: http.StatusUnauthorized, wantApproved: true, errSubstr: "GitLab does not let bot approve it",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status := tt.approveStatus
+			if status == 0 {
+				status = http.StatusCreated
+			}
+			changesCount := tt.changesCount
+			if changesCount == "" {
+				changesCount = "2"
+			}
+			server, calls := approveServer(t, tt.author, tt.authorApproval, tt.approvedBy, status, changesCount,
+				tt.settingsStatus)
+			config := &Config{
+				GitLabURL: server.URL, ProjectID: 123, PrivateToken: "test-token",
+				Approve: true, ApprovePaths: tt.approvePaths,
+			}
+
+			var err error
+			out := captureOutput(t, func() {
+				err = approveMR(context.Background(), &http.Client{}, config, &MergeRequest{IID: 42})
+			})
+			if tt.errSubstr == "" && err != nil {
+				t.Fatalf("approveMR() error = %v, want nil", err)
+			}
+			if tt.errSubstr != "" && (err == nil || !strings.Contains(err.Error(), tt.errSubstr)) {
+				t.Fatalf("approveMR() error = %v, want it to contain %q", err, tt.errSubstr)
+			}
+			if (calls.approved != nil) != tt.wantApproved {
+				t.Fatalf("approved = %v, want %v", calls.approved != nil, tt.wantApproved)
+			}
+			if calls.approved != nil && calls.approved.SHA != "deadbeefcafe0000" {
+				t.Errorf("approval SHA = %q, want it pinned to the head", calls.approved.SHA)
+			}
+			if tt.wantOut != "" && !strings.Contains(out, tt.wantOut) {
+				t.Errorf("output %q does not contain %q", out, tt.wantOut)
+			}
+		})
+	}
+}
+
+// TestApproveMRBranchMoved pins that a head pushed since the run saw the MR is
+// not approved.
+func TestApproveMRBranchMoved(t *testing.T) {
+	server, calls := approveServer(t, User{ID: 5}, true, nil, http.StatusCreated, "2", 0)
+	config := &Config{GitLabURL: server.URL, ProjectID: 123, PrivateToken: "test-token", ApprovePaths: []string{"**"}}
+
+	err := approveMR(context.Background(), &http.Client{}, config, &MergeRequest{IID: 42, SHA: "0123456789abcdef"})
+	if !errors.Is(err, errBranchMoved) {
+		t.Errorf("approveMR() error = %v, want errBranchMoved", err)
+	}
+	if calls.approved != nil {
+		t.Error("the MR was approved although its head moved")
+	}
+}
+
+func TestParseApprovePaths(t *testing.T) {
+	got, err := parseApprovePaths("go.sum, docs/**")
+	if err != nil {
+		t.Fatalf("parseApprovePaths() error = %v", err)
+	}
+	if want := []string{"go.sum", "docs/**"}; !slices.Equal(got, want) {
+		t.Errorf("parseApprovePaths() = %v, want %v", got, want)
+	}
+
+	if _, err := parseApprovePaths("go.sum,docs/["); err == nil || !strings.Contains(err.Error(), "invalid --approve-paths") {
+		t.Errorf("parseApprovePaths() error = %v, want the bad glob rejected", err)
+	}
+}
+
+func TestValidateApproveFlags(t *testing.T) {
+	tests := []struct {
+		config    Config
+		errSubstr string
+	}{
+		{config: Config{Approve: true, ApprovePaths: []string{"go.sum"}}},
+		{config: Config{Approve: true}, errSubstr: "--approve needs --approve-paths"},
+		{config: Config{ApprovePaths: []string{"go.sum"}}, errSubstr: "--approve-paths has no effect without --approve"},
+		{
+			config:    Config{Approve: true, ApprovePaths: []string{"*"}, MRExists: true},
+			errSubstr: "--approve cannot be used with --mr-exists",
+		},
+		{
+			config:    Config{Command: commandMerge, Approve: true, ApprovePaths: []string{"*"}},
+			errSubstr: "--approve cannot be used with the merge command",
+		},
+		{
+			config:    Config{Command: commandStatus, ApprovalRules: []ApprovalRuleConfig{{Name: "Security"}}},
+			errSubstr: "--approval-rules cannot be used with the status command",
+		},
+	}
+
+	for _, tt := range tests {
+		err := validateConfig(&tt.config)
+		if tt.errSubstr == "" {
+			if err != nil {
+				t.Errorf("validateConfig(%+v) error = %v, want nil", tt.config, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tt.errSubstr) {
+			t.Errorf("validateConfig(%+v) error = %v, want it to contain %q", tt.config, err, tt.errSubstr)
+		}
+	}
+}
+
+func TestMergeStatusCheck(t *testing.T) {
+	tests := []struct {
+		status     string
+		wantPassed bool
+		wantDetail string
+	}{
+		{status: "mergeable", wantPassed: true},
+		{status: "", wantPassed: true},
+		{status: "need_rebase", wantDetail: "the target branch requires a rebase first, pass --rebase, status: need_rebase"},
+		{status: "ci_still_running", wantDetail: "ci_still_running"},
+	}
+
+	for _, tt := range tests {
+		check := mergeStatusCheck(&MergeRequest{DetailedMergeStatus: tt.status})
+		if check.passed != tt.wantPassed || check.detail != tt.wantDetail {
+			t.Errorf("mergeStatusCheck(%q) = %v, %q, want %v, %q",
+				tt.status, check.passed, check.detail, tt.wantPassed, tt.wantDetail)
+		}
+	}
+}
+
+func TestPipelineCheck(t *testing.T) {
+	const head = "deadbeefcafe0000"
+
+	tests := []struct {
+		name       string
+		pipeline   *Pipeline
+		wantPassed bool
+		wantDetail string
+	}{
+		{name: "none", wantDetail: "no pipeline has run for it"},
+		{
+			name:       "older commit",
+			pipeline:   &Pipeline{ID: 8, Status: "success", SHA: "0123456789abcdef"},
+			wantDetail: "the latest pipeline, 8, ran for 01234567",
+		},
+		{name: "failed", pipeline: &Pipeline{ID: 9, Status: "failed", SHA: head}, wantDetail: "pipeline 9: failed"},
+		{name: "running", pipeline: &Pipeline{ID: 9, Status: "running", SHA: head}, wantDetail: "pipeline 9: running"},
+		{
+			name:       "success",
+			pipeline:   &Pipeline{ID: 9, Status: "success", SHA: head},
+			wantPassed: true,
+			wantDetail: "pipeline 9: success",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			check := pipelineCheck(&MergeRequest{SHA: head, HeadPipeline: tt.pipeline})
+			if check.passed != tt.wantPassed || check.detail != tt.wantDetail {
+				t.Errorf("pipelineCheck() = %v, %q, want %v, %q", check.passed, check.detail, tt.wantPassed, tt.wantDetail)
+			}
+		})
+	}
+}
+
+func TestValidateStatusFormat(t *testing.T) {
+	tests := []struct {
+		config    Config
+		errSubstr string
+	}{
+		{config: Config{Command: commandStatus, Format: formatJUnit}},
+		{config: Config{Format: formatText}},
+		{config: Config{Format: formatJSON}, errSubstr: "--format json only applies to the status command"},
+		{config: Config{Command: commandStatus, Format: "yaml"}, errSubstr: `unknown --format "yaml"`},
+	}
+
+	for _, tt := range tests {
+		err := validateConfig(&tt.config)
+		if tt.errSubstr == "" {
+			if err != nil {
+				t.Errorf("validateConfig(%q, %q) error = %v, want nil", tt.config.Command, tt.config.Format, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tt.errSubstr) {
+			t.Errorf("validateConfig(%q, %q) error = %v, want it to contain %q",
+				tt.config.Command, tt.config.Format, err, tt.errSubstr)
+		}
+	}
+}
+
+func TestValidateMergeCommand(t *testing.T) {
+	config := &Config{Command: commandMerge, AutoMerge: true}
+	err := validateConfig(config)
+	if err == nil || !strings.Contains(err.Error(), "the merge command merges right away") {
+		t.Errorf("validateConfig() error = %v, want --auto-merge refused for the merge command", err)
+	}
+}
+
+// TestDisableAutoMerge pins --cancel-auto-merge: the cancel endpoint is called,
+// and an MR without auto-merge, which GitLab answers with 406, is not a failure.
+func TestDisableAutoMerge(t *testing.T) {
+	tests := []struct {
+		status  int
+		wantOut string
+	}{
+		{status: http.StatusOK, wantOut: "Auto-merge canceled for MR (IID: 42)"},
+		{status: http.StatusNotAcceptable, wantOut: "Auto-merge is not set for MR (IID: 42), nothing to cancel"},
+	}
+
+	for _, tt := range tests {
+		canceled := false
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == http.MethodPost &&
+				r.URL.Path == "/api/v4/projects/123/merge_requests/42/cancel_merge_when_pipeline_succeeds" {
+				canceled = true
+			}
+			w.WriteHeader(tt.status)
+		}))
+
+		config := &Config{GitLabURL: server.URL, ProjectID: 123, PrivateToken: "test-token"}
+		var err error
+		out := captureOutput(t, func() { err = disableAutoMerge(context.Background(), &http.Client{}, config, &MergeRequest{IID: 42}) })
+		server.Close()
+
+		if err != nil {
+			t.Errorf("status %d: disableAutoMerge() error = %v", tt.status, err)
+		}
+		if !canceled {
+			t.Errorf("status %d: cancel endpoint not called", tt.status)
+		}
+		if !strings.Contains(out, tt.wantOut) {
+			t.Errorf("status %d: output %q does not contain %q", tt.status, out, tt.wantOut)
+		}
+	}
+}
+
+// TestUpdateToDraftCancelsAutoMerge pins that --draft on an MR with auto-merge
+// set also withdraws the auto-merge, and that neither an update leaving it
+// ready nor one under the default draft --commit-prefix does.
+func TestUpdateToDraftCancelsAutoMerge(t *testing.T) {
+	tests := []struct {
+		name         string
+		config       Config
+		wantCanceled bool
+	}{
+		{name: "draft", config: Config{Draft: true, UpdateMR: true}, wantCanceled: true},
+		{name: "draft prefix", config: Config{CommitPrefix: "Draft", UpdateMR: true}},
+		{name: "ready", config: Config{Ready: true, UpdateMR: true}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			canceled := false
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				switch {
+				case r.Method == http.MethodPut && r.URL.Path == "/api/v4/projects/123/merge_requests/42":
+					writeTestJSON(t, w, MergeRequest{IID: 42})
+				case r.Method == http.MethodPost &&
+					r.URL.Path == "/api/v4/projects/123/merge_requests/42/cancel_merge_when_pipeline_succeeds":
+					canceled = true
+					writeTestJSON(t, w, MergeRequest{IID: 42})
+				default:
+					t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+					w.WriteHeader(http.StatusNotFound)
+				}
+			}))
+			defer server.Close()
+
+			config := tt.config
+			config.GitLabURL, config.ProjectID, config.PrivateToken, config.SourceBranch = server.URL, 123, "test-token", "feature"
+			existingMR := &MergeRequest{IID: 42, Title: "Add caching", MergeWhenPipelineSucceeds: true}
+
+			var err error
+			out := captureOutput(t, func() {
+				_, err = handleUpdateMR(context.Background(), &http.Client{}, &config, existingMR,
+					mrTitle(&config, existingMR), "")
+			})
+			if err != nil {
+				t.Fatalf("handleUpdateMR() error = %v", err)
+			}
+			if canceled != tt.wantCanceled {
+				t.Errorf("auto-merge canceled = %v, want %v", canceled, tt.wantCanceled)
+			}
+			if tt.wantCanceled && !strings.Contains(out, "Canceled auto-merge for MR (IID: 42), it is a draft now") {
+				t.Errorf("output %q does not report the cancellation", out)
+			}
+		})
+	}
+}
+
+func TestValidateCancelAutoMerge(t *testing.T) {
+	tests := []struct {
+		name      string
+		config    Config
+		errSubstr string
+	}{
+		{name: "alone", config: Config{CancelAutoMerge: true}},
+		{
+			name:      "with auto-merge",
+			config:    Config{CancelAutoMerge: true, AutoMerge: true, Ready: true},
+			errSubstr: "--cancel-auto-merge cannot be used with --auto-merge",
+		},
+		{
+			name:      "dry run",
+			config:    Config{CancelAutoMerge: true, MRExists: true},
+			errSubstr: "--cancel-auto-merge cannot be used with --mr-exists",
+		},
+		{
+			name:      "merge command",
+			config:    Config{Command: commandMerge, CancelAutoMerge: true},
+			errSubstr: "the merge command merges right away, it cannot be used with --cancel-auto-merge",
+		},
+		{
+			name:      "status command",
+			config:    Config{Command: commandStatus, CancelAutoMerge: true},
+			errSubstr: "the status command only reads the MR, it cannot be used with --cancel-auto-merge",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateConfig(&tt.config)
+			if tt.errSubstr == "" {
+				if err != nil {
+					t.Errorf("validateConfig() error = %v, want nil", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.errSubstr) {
+				t.Errorf("validateConfig() error = %v, want it to contain %q", err, tt.errSubstr)
+			}
+		})
+	}
+}
+
+func TestRenderCommitMessage(t *testing.T) {
+	data := &commitMessageData{
+		Title: "Add caching", IID: 42, SourceBranch: "feature/#7-cache", TargetBranch: "main",
+		Issues: []string{"#7", "#12"}, CoAuthors: []string{"Alice <alice@example.com>"},
+	}
+
+	tests := []struct {
+		name      string
+		text      string
+		want      string
+		errSubstr string
+	}{
+		{name: "empty", text: "", want: ""},
+		{name: "plain text", text: "Release 2.0", want: "Release 2.0"},
+		{
+			name: "fields",
+			text: "{{.Title}} (!{{.IID}}) from {{.SourceBranch}} into {{.TargetBranch}}",
+			want: "Add caching (!42) from feature/#7-cache into main",
+		},
+		{
+			name: "issues and co-authors",
+			text: "{{.Title}}\n\n{{range .Issues}}Closes {{.}}\n{{end}}{{range .CoAuthors}}Co-authored-by: {{.}}\n{{end}}",
+			want: "Add caching\n\nCloses #7\nCloses #12\nCo-authored-by: Alice <alice@example.com>",
+		},
+		{name: "unknown field", text: "{{.Author}}", errSubstr: "invalid --squash-commit-message template"},
+		{name: "syntax error", text: "{{.Title", errSubstr: "invalid --squash-commit-message template"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := renderCommitMessage("--squash-commit-message", tt.text, data)
+			if tt.errSubstr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.errSubstr) {
+					t.Errorf("renderCommitMessage() error = %v, want it to contain %q", err, tt.errSubstr)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Errorf("renderCommitMessage() = %q, %v, want %q", got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestIssueReferences(t *testing.T) {
+	got := issueReferences("feature/#7-cache", "Cache lookups (#12)", "Closes #12, relates to #7 and #30")
+	want := []string{"#7", "#12", "#30"}
+	if !slices.Equal(got, want) {
+		t.Errorf("issueReferences() = %v, want %v", got, want)
+	}
+}
+
+func TestCoAuthors(t *testing.T) {
+	commits := []Commit{
+		{AuthorName: "Alice", AuthorEmail: "Alice@example.com"},
+		{AuthorName: "Bob", AuthorEmail: "bob@example.com"},
+		{AuthorName: "Alice", AuthorEmail: "alice@example.com"},
+		{AuthorName: "Nobody"},
+	}
+	got := coAuthors(commits, User{})
+	want := []string{"Alice <alice@example.com>", "Bob <bob@example.com>"}
+	if !slices.Equal(got, want) {
+		t.Errorf("coAuthors() = %v, want %v", got, want)
+	}
+
+	// The MR author's own commits give no trailer, matched by name or username.
+	for _, author := range []User{{Name: "alice"}, {Username: "Alice"}} {
+		if got := coAuthors(commits, author); !slices.Equal(got, []string{"Bob <bob@example.com>"}) {
+			t.Errorf("coAuthors(author %+v) = %v, want only Bob", author, got)
+		}
+	}
+}
+
+// TestGetMRCommitsPages pins that a co-author whose commit is past the first
+// page of the MR's commits still gets a trailer.
+func TestGetMRCommitsPages(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v4/projects/123/merge_requests/42/commits" {
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		var page []Commit
+		switch r.URL.Query().Get("page") {
+		case "1":
+			for i := range listPageSize {
+				page = append(page, Commit{ID: fmt.Sprint(i), AuthorName: "Bob", AuthorEmail: "bob@example.com"})
+			}
+		case "2":
+			page = append(page, Commit{ID: "first", AuthorName: "Alice", AuthorEmail: "alice@example.com"})
+		}
+		writeTestJSON(t, w, page)
+	}))
+	defer server.Close()
+
+	config := &Config{GitLabURL: server.URL, ProjectID: 123, PrivateToken: "test-token"}
+	commits, err := getMRCommits(context.Background(), &http.Client{}, config, 42)
+	if err != nil {
+		t.Fatalf("getMRCommits() error = %v", err)
+	}
+	want := []string{"Alice <alice@example.com>", "Bob <bob@example.com>"}
+	if got := coAuthors(commits, User{}); !slices.Equal(got, want) {
+		t.Errorf("coAuthors() = %v, want %v", got, want)
+	}
+}
+
+func TestValidateCommitMessageTemplates(t *testing.T) {
+	config := &Config{MergeCommitMessage: "Merge {{.Title"}
+	err := validateConfig(config)
+	if err == nil || !strings.Contains(err.Error(), "invalid --merge-commit-message template") {
+		t.Errorf("validateConfig() error = %v, want the syntax error rejected", err)
+	}
+
+	// With both broken, the merge template is the one reported, every time.
+	for range 20 {
+		config = &Config{MergeCommitMessage: "{{.Title", SquashCommitMessage: "{{.Title"}
+		err = validateConfig(config)
+		if err == nil || !strings.Contains(err.Error(), "invalid --merge-commit-message template") {
+			t.Fatalf("validateConfig() error = %v, want the merge template reported first", err)
+		}
+	}
+
+	// Only parsed: indexing into data that is empty until the merge is fine.
+	config = &Config{MergeCommitMessage: "Merge {{.Title}}", SquashCommitMessage: "{{index .CoAuthors 0}}"}
+	if err := validateConfig(config); err != nil {
+		t.Errorf("validateConfig() error = %v, want valid templates accepted", err)
+	}
+}
+
+// pipelineStatusServer serves pipeline 9 of project 123, moving through
+// statuses one check at a time and staying on the last. From the check at
+// failAt on, counting from 1, job 31 is listed as failed; 0 never fails it.
+func pipelineStatusServer(t *testing.T, statuses []string, failAt int) *httptest.Server {
+	t.Helper()
+
+	var checks atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		switch r.URL.Path {
+		case "/api/v4/projects/123/pipelines/9":
+			n := int(checks.Add(1))
+			writeTestJSON(t, w, Pipeline{ID: 9, Status: statuses[min(n, len(statuses))-1]})
+
+		case "/api/v4/projects/123/pipelines/9/jobs":
+			if r.URL.Query().Get("scope[]") != "failed" {
+				t.Errorf("jobs listed with %q, want only the failed ones", r.URL.RawQuery)
+			}
+			jobs := []Job{}
+			if failAt > 0 && int(checks.Load()) >= failAt {
+				jobs = append(jobs, Job{ID: 31, Name: "unit", Stage: "test", Status: "failed"})
+			}
+			writeTestJSON(t, w, jobs)
+
+		default:
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	return server
+}
+
+// TestWaitPipeline pins --wait-pipeline: every status the pipeline moves through
+// is printed once, a failed job is reported as soon as it fails and only once,
+// and only a successful pipeline lets the run go on.
+func TestWaitPipeline(t *testing.T) {
+	tests := []struct {
+		name      string
+		statuses  []string
+		failAt    int
+		errSubstr string
+		wantOut   []string
+	}{
+		{
+			name:     "success",
+			statuses: []string{"pending", "running", "running", "success"},
+			wantOut:  []string{"Pipeline 9: pending\nPipeline 9: running\nPipeline 9: success\n"},
+		},
+		{
+			name:      "failed",
+			statuses:  []string{"running", "running", "running", "failed"},
+			failAt:    2,
+			errSubstr: "pipeline 9 did not succeed, it is failed",
+			wantOut:   []string{"Pipeline 9: running\n  Job failed: unit (stage: test)\nPipeline 9: failed\n"},
+		},
+		{
+			name:      "manual",
+			statuses:  []string{"manual"},
+			errSubstr: "it is manual",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := pipelineStatusServer(t, tt.statuses, tt.failAt)
+			config := &Config{
+				GitLabURL: server.URL, ProjectID: 123, PrivateToken: "test-token",
+				PollInterval: time.Millisecond, PipelineTimeout: time.Minute,
+			}
+
+			var err error
+			out := captureOutput(t, func() { err = waitPipeline(context.Background(), &http.Client{}, config, &Pipeline{ID: 9}) })
+
+			if tt.errSubstr == "" && err != nil {
+				t.Errorf("waitPipeline() error = %v, want nil", err)
+			}
+			if tt.errSubstr != "" && (err == nil || !strings.Contains(err.Error(), tt.errSubstr)) {
+				t.Errorf("waitPipeline() error = %v, want it to contain %q", err, tt.errSubstr)
+			}
+			for _, want := range tt.wantOut {
+				if !strings.Contains(out, want) {
+					t.Errorf("output %q does not contain %q", out, want)
+				}
+			}
+		})
+	}
+}
+
+func TestWaitPipelineTimeout(t *testing.T) {
+	server := pipelineStatusServer(t, []string{"running"}, 0)
+	config := &Config{
+		GitLabURL: server.URL, ProjectID: 123, PrivateToken: "test-token",
+		PollInterval: time.Millisecond, PipelineTimeout: 20 * time.Millisecond,
+	}
+
+	var err error
+	captureOutput(t, func() { err = waitPipeline(context.Background(), &http.Client{}, config, &Pipeline{ID: 9}) })
+	if err == nil || !strings.Contains(err.Error(), "pipeline 9 is still running after 20ms") {
+		t.Errorf("waitPipeline() error = %v, want the timeout", err)
+	}
+}
+
+// TestWaitPipelineUnknown pins that a pipeline the trigger step could not
+// identify fails the wait: --wait-pipeline passes only on a pipeline seen to
+// succeed.
+func TestWaitPipelineUnknown(t *testing.T) {
+	for _, pipeline := range []*Pipeline{nil, {}} {
+		err := waitPipeline(context.Background(), &http.Client{}, &Config{}, pipeline)
+		if err == nil || !strings.Contains(err.Error(), "pipeline is not known") {
+			t.Errorf("waitPipeline(%v) error = %v, want the unknown pipeline reported", pipeline, err)
+		}
+	}
+}
+
+func TestValidateWaitPipeline(t *testing.T) {
+	err := validateConfig(&Config{WaitPipeline: true})
+	if err == nil || !strings.Contains(err.Error(), "--wait-pipeline has no effect without --trigger-pipeline") {
+		t.Errorf("validateConfig() error = %v, want --wait-pipeline refused without --trigger-pipeline", err)
+	}
+	if err := validateConfig(&Config{WaitPipeline: true, TriggerPipeline: true}); err != nil {
+		t.Errorf("validateConfig() error = %v, want nil", err)
+	}
+}
+
+// TestTriggerMRPipelineWithVariables pins that a run with pipeline variables
+// creates the pipeline through the pipelines API on the MR's head ref, since the
+// merge request pipelines endpoint takes none, and logs only the keys.
+func TestTriggerMRPipelineWithVariables(t *testing.T) {
+	var request PipelineCreateRequest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		switch {
+		case r.Method == http.MethodGet && r.URL.Path == "/api/v4/projects/123/merge_requests/42/pipelines":
+			writeTestJSON(t, w, []Pipeline{})
+		case r.Method == http.MethodPost && r.URL.Path == "/api/v4/projects/123/pipeline":
+			if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+				t.Errorf("decode pipeline request: %v", err)
+			}
+			w.WriteHeader(http.StatusCreated)
+			writeTestJSON(t, w, Pipeline{ID: 11, Status: "created", Source: pipelineSourceAPI})
+		default:
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	config := &Config{
+		PrivateToken: "test-token", ProjectID: 123, GitLabURL: server.URL, TriggerPipeline: true,
+		PipelineVariables: []PipelineVariable{{Key: "DEPLOY_ENV", Value: "staging"}, {Key: "API_KEY", Value: "s3cret"}},
+	}
+
+	var pipeline *Pipeline
+	var err error
+	out := captureOutput(t, func() {
+		pipeline, err = triggerMRPipeline(context.Background(), &http.Client{}, config, &MergeRequest{IID: 42, SHA: "abc"})
+	})
+	if err != nil {
+		t.Fatalf("triggerMRPipeline() error = %v", err)
+	}
+	if pipeline == nil || pipeline.ID != 11 {
+		t.Errorf("pipeline = %+v, want the created pipeline 11", pipeline)
+	}
+	if request.Ref != "refs/merge-requests/42/head" {
+		t.Errorf("Ref = %q, want the MR's head ref", request.Ref)
+	}
+	if !slices.Equal(request.Variables, config.PipelineVariables) {
+		t.Errorf("Variables = %v, want %v", request.Variables, config.PipelineVariables)
+	}
+	if !strings.Contains(out, "Pipeline variables: DEPLOY_ENV, API_KEY") || strings.Contains(out, "s3cret") {
+		t.Errorf("output %q should list the keys and no values", out)
+	}
+}
+
+func TestIsMRPipeline(t *testing.T) {
+	tests := []struct {
+		name     string
+		pipeline Pipeline
+		want     bool
+	}{
+		{name: "merge request event", pipeline: Pipeline{Source: pipelineSourceMergeRequest}, want: true},
+		{name: "api on the MR ref", pipeline: Pipeline{Source: pipelineSourceAPI, Ref: "refs/merge-requests/42/head"}, want: true},
+		{name: "api on another MR", pipeline: Pipeline{Source: pipelineSourceAPI, Ref: "refs/merge-requests/7/head"}},
+		{name: "api on the branch", pipeline: Pipeline{Source: pipelineSourceAPI, Ref: "feature"}},
+		{name: "branch push", pipeline: Pipeline{Source: "push", Ref: "feature"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isMRPipeline(&tt.pipeline, 42); got != tt.want {
+				t.Errorf("isMRPipeline() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadPipelineVariables(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "vars.env")
+	content := "# deploy settings\nDEPLOY_ENV=staging\n\nURL=https://example.com/?a=b\nEMPTY=\n"
+	if err := os.WriteFile(file, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := loadPipelineVariables(file, []string{"DEPLOY_ENV=production", "LIST=a,b"})
+	if err != nil {
+		t.Fatalf("loadPipelineVariables() error = %v", err)
+	}
+	want := []PipelineVariable{
+		{Key: "DEPLOY_ENV", Value: "production"},
+		{Key: "URL", Value: "https://example.com/?a=b"},
+		{Key: "EMPTY", Value: ""},
+		{Key: "LIST", Value: "a,b"},
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("loadPipelineVariables() = %v, want %v", got, want)
+	}
+
+	for _, bad := range []string{"NOVALUE", "1ABC=x", "BAD KEY=x"} {
+		if _, err := loadPipelineVariables("", []string{bad}); err == nil || !strings.Contains(err.Error(), "want KEY=VALUE") {
+			t.Errorf("loadPipelineVariables(%q) error = %v, want it rejected", bad, err)
+		}
+	}
+
+	_, err = loadPipelineVariables("", []string{"bad-key=s3cret"})
+	if err == nil || strings.Contains(err.Error(), "s3cret") {
+		t.Errorf("error = %v, want the key rejected without echoing the value", err)
+	}
+
+	// A secret pasted without KEY= is not echoed either, and the error points
+	// at the line it is on.
+	_, err = loadPipelineVariables(file, []string{"OK=1", "glpat-s3cret"})
+	if err == nil || strings.Contains(err.Error(), "s3cret") ||
+		!strings.Contains(err.Error(), "--pipeline-variable number 2") {
+		t.Errorf("error = %v, want the entry's position without its content", err)
+	}
+	badFile := filepath.Join(t.TempDir(), "bad.env")
+	if err := os.WriteFile(badFile, []byte("# comment\nOK=1\nglpat-s3cret\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	_, err = loadPipelineVariables(badFile, nil)
+	if err == nil || strings.Contains(err.Error(), "s3cret") ||
+		!strings.Contains(err.Error(), "line 3 of --pipeline-variables-file") {
+		t.Errorf("error = %v, want the file's line without its content", err)
+	}
+
+	if _, err := loadPipelineVariables(filepath.Join(t.TempDir(), "missing"), nil); err == nil {
+		t.Error("loadPipelineVariables() error = nil, want the missing file reported")
+	}
+}
+
+func TestLoadApprovalRules(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		file := filepath.Join(dir, name)
+		if err := os.WriteFile(file, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		return file
+	}
+
+	rules, err := loadApprovalRules(write("rules.json",
+		`[{"name":"Security","approvals_required":2,"group_ids":[7],"paths":["auth/*"]},{"name":"Anyone"}]`))
+	if err != nil {
+		t.Fatalf("loadApprovalRules() error = %v", err)
+	}
+	if len(rules) != 2 || rules[0].ApprovalsRequired != 2 || !slices.Equal(rules[0].Paths, []string{"auth/*"}) {
+		t.Errorf("loadApprovalRules() = %+v", rules)
+	}
+
+	for content, errSubstr := range map[string]string{
+		`[{"name":"Security","path":["auth/*"]}]`: `unknown field "path"`,
+		`[{"approvals_required":1}]`:              "rule 1 has no name",
+		`[{"name":"A"},{"name":"A"}]`:             `rule "A" appears twice`,
+		`[{"name":"A","approvals_required":-1}]`:  `rule "A" requires -1 approvals`,
+		`[{"name":"A","paths":["auth/["]}]`:       `rule "A" has a bad glob auth/[`,
+		`{"name":"A"}`:                            "cannot unmarshal object",
+	} {
+		if _, err := loadApprovalRules(write("bad.json", content)); err == nil || !strings.Contains(err.Error(), errSubstr) {
+			t.Errorf("loadApprovalRules(%s) error = %v, want it to contain %q", content, err, errSubstr)
+		}
+	}
+}
+
+// TestApplyApprovalRules pins that the MR's rules end up as the file says:
+// a new rule is added, a changed one updated, one that no longer applies
+// removed, and a rule already in shape, or one the file does not name, left
+// alone, so a rerun changes nothing.
+func TestApplyApprovalRules(t *testing.T) {
+	const base = "/api/v4/projects/123/merge_requests/42"
+	var calls []string
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		switch {
+		case r.URL.Path == base && r.Method == http.MethodGet:
+			writeTestJSON(t, w, MergeRequest{
+				IID: 42, SHA: "deadbeef", TargetBranch: "main", Labels: []string{"Docs"},
+				ChangesCount: "1", DiffRefs: DiffRefs{HeadSHA: "deadbeef"},
+			})
+		case r.URL.Path == base+"/diffs":
+			_, _ = w.Write([]byte(`[{"old_path":"auth/login.go","new_path":"auth/login.go"}]`))
+		case r.URL.Path == base+"/approval_rules" && r.Method == http.MethodGet:
+			_, _ = w.Write([]byte(`[
+				{"id":1,"name":"Security","approvals_required":1,"users":[],"groups":[{"id":7}]},
+				{"id":2,"name":"Database","approvals_required":1,"users":[{"id":3}],"groups":[]},
+				{"id":3,"name":"Backend","approvals_required":1,"users":[{"id":5},{"id":4}],"groups":[]},
+				{"id":4,"name":"Manual","approvals_required":3,"users":[],"groups":[]}]`))
+		default:
+			var request ApprovalRuleRequest
+			if r.Method != http.MethodDelete {
+				if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+					t.Errorf("decode approval rule request: %v", err)
+				}
+			}
+			calls = append(calls, fmt.Sprintf("%s %s %s %d", r.Method,
+				strings.TrimPrefix(r.URL.Path, base), request.Name, request.ApprovalsRequired))
+			_, _ = w.Write([]byte(`{}`))
+		}
+	}))
+	defer server.Close()
+
+	config := &Config{
+		GitLabURL: server.URL, ProjectID: 123, PrivateToken: "test-token",
+		ApprovalRules: []ApprovalRuleConfig{
+			{Name: "Security", ApprovalsRequired: 2, GroupIDs: []int{7}, Paths: []string{"auth/*"}},
+			{Name: "Docs", ApprovalsRequired: 1, UserIDs: []int{9}, Labels: []string{"docs"}},
+			{Name: "Database", ApprovalsRequired: 1, UserIDs: []int{3}, Paths: []string{"db/*"}},
+			{Name: "Backend", ApprovalsRequired: 1, UserIDs: []int{4, 5}},
+		},
+	}
+
+	var err error
+	out := captureOutput(t, func() {
+		err = applyApprovalRules(context.Background(), &http.Client{}, config, &MergeRequest{IID: 42})
+	})
+	if err != nil {
+		t.Fatalf("applyApprovalRules() error = %v", err)
+	}
+
+	want := []string{
+		"PUT /approval_rules/1 Security 2",
+		"POST /approval_rules Docs 1",
+		"DELETE /approval_rules/2  0",
+	}
+	if !slices.Equal(calls, want) {
+		t.Errorf("calls = %q, want %q", calls, want)
+	}
+	if !strings.Contains(out, `Removed approval rule "Database" from MR (IID: 42), it no longer applies`) {
+		t.Errorf("output %q does not report the removed rule", out)
+	}
+}
+
+func TestListApprovalRulesPages(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v4/projects/123/merge_requests/42/approval_rules" {
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		var page []ApprovalRule
+		switch r.URL.Query().Get("page") {
+		case "1":
+			for i := range listPageSize {
+				page = append(page, ApprovalRule{ID: i + 1, Name: fmt.Sprintf("Rule %d", i+1)})
+			}
+		case "2":
+			page = append(page, ApprovalRule{ID: 101, Name: "Security"})
+		}
+		writeTestJSON(t, w, page)
+	}))
+	defer server.Close()
+
+	config := &Config{GitLabURL: server.URL, ProjectID: 123, PrivateToken: "test-token"}
+	rules, err := listApprovalRules(context.Background(), &http.Client{}, config, 42)
+	if err != nil {
+		t.Fatalf("listApprovalRules() error = %v", err)
+	}
+	if len(rules) != listPageSize+1 || rules[listPageSize].Name != "Security" {
+		t.Errorf("listApprovalRules() returned %d rules, want the %d on both pages", len(rules), listPageSize+1)
+	}
+}
+
+func TestApplyApprovalRulesForbidden(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/approval_rules") {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		writeTestJSON(t, w, MergeRequest{IID: 42})
+	}))
+	defer server.Close()
+
+	config := &Config{
+		GitLabURL: server.URL, ProjectID: 123, PrivateToken: "test-token",
+		ApprovalRules: []ApprovalRuleConfig{{Name: "Anyone", ApprovalsRequired: 1}},
+	}
+	err := applyApprovalRules(context.Background(), &http.Client{}, config, &MergeRequest{IID: 42})
+	if err == nil || !strings.Contains(err.Error(), "MR approval rules need GitLab Premium") {
+		t.Errorf("applyApprovalRules() error = %v, want the 403 explained", err)
+	}
+}
+
+// TestApplyApprovalRulesTruncatedDiff pins that a diff GitLab cut short fails
+// the run before any rule is touched: a path past the cut could be the one a
+// rule applies by, and the rule would otherwise be removed.
+func TestApplyApprovalRulesTruncatedDiff(t *testing.T) {
+	const base = "/api/v4/projects/123/merge_requests/42"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case base:
+			writeTestJSON(t, w, MergeRequest{
+				IID: 42, SHA: "deadbeef", ChangesCount: "1000+", DiffRefs: DiffRefs{HeadSHA: "deadbeef"},
+			})
+		case base + "/diffs":
+			_, _ = w.Write([]byte(`[{"old_path":"README.md","new_path":"README.md"}]`))
+		default:
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	config := &Config{
+		GitLabURL: server.URL, ProjectID: 123, PrivateToken: "test-token",
+		ApprovalRules: []ApprovalRuleConfig{{Name: "Security", ApprovalsRequired: 2, Paths: []string{"auth/**"}}},
+	}
+	err := applyApprovalRules(context.Background(), &http.Client{}, config, &MergeRequest{IID: 42})
+	if err == nil || !strings.Contains(err.Error(), "GitLab lists 1 of the MR's 1000+ changed files") {
+		t.Errorf("applyApprovalRules() error = %v, want the truncated diff refused", err)
+	}
+}
+
+// TestCancelStalePipelines pins which pipelines --cancel-stale-pipelines
+// cancels: only the MR's own, only older than the current one, only for other
+// commits, and only those still active.
+func TestCancelStalePipelines(t *testing.T) {
+	const head = "headheadheadhead"
+	pipelines := []Pipeline{
+		{ID: 20, Status: "created", SHA: head, Source: pipelineSourceMergeRequest},
+		{ID: 19, Status: "running", SHA: head, Source: pipelineSourceMergeRequest},
+		{ID: 18, Status: "running", SHA: "0ld0ld0ld0ld0ld0", Source: pipelineSourceMergeRequest},
+		{ID: 17, Status: "pending", SHA: "0lder0lder0lder0", Source: pipelineSourceAPI, Ref: "refs/merge-requests/42/head"},
+		{ID: 16, Status: "running", SHA: "0ld0ld0ld0ld0ld0", Source: "push", Ref: "feature"},
+		{ID: 15, Status: "success", SHA: "0ldest0ldest0lde", Source: pipelineSourceMergeRequest},
+		{ID: 21, Status: "running", SHA: "n3wern3wern3wer0", Source: pipelineSourceMergeRequest},
+	}
+
+	var canceled []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		switch {
+		case r.Method == http.MethodGet && r.URL.Path == "/api/v4/projects/123/merge_requests/42/pipelines":
+			writeTestJSON(t, w, pipelines)
+		case r.Method == http.MethodPost && strings.HasSuffix(r.URL.Path, "/cancel"):
+			canceled = append(canceled, strings.TrimSuffix(
+				strings.TrimPrefix(r.URL.Path, "/api/v4/projects/123/pipelines/"), "/cancel"))
+			writeTestJSON(t, w, Pipeline{Status: "canceled"})
+		default:
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	config := &Config{GitLabURL: server.URL, ProjectID: 123, PrivateToken: "test-token"}
+	mr := &MergeRequest{IID: 42, SHA: head}
+
+	out := captureOutput(t, func() {
+		cancelStalePipelines(context.Background(), &http.Client{}, config, mr, &Pipeline{ID: 20})
+	})
+
+	if !slices.Equal(canceled, []string{"18", "17"}) {
+		t.Errorf("canceled pipelines %v, want [18 17]", canceled)
+	}
+	if !strings.Contains(out, "Canceled stale pipeline 18 for commit 0ld0ld0l (was running)") {
+		t.Errorf("output %q does not report the cancellation", out)
+	}
+}
+
+// TestCancelStalePipelinesPages pins that a stale pipeline past the first page
+// of the MR's pipelines is canceled too.
+func TestCancelStalePipelinesPages(t *testing.T) {
+	var canceled []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		switch {
+		case r.Method == http.MethodGet && r.URL.Path == "/api/v4/projects/123/merge_requests/42/pipelines":
+			var page []Pipeline
+			switch r.URL.Query().Get("page") {
+			case "1":
+				for i := range listPageSize {
+					page = append(page, Pipeline{
+						ID: 500 - i, Status: pipelineStatusSuccess, SHA: "0ld0ld0ld0ld0ld0", Source: pipelineSourceMergeRequest,
+					})
+				}
+			case "2":
+				page = append(page, Pipeline{ID: 7, Status: "running", SHA: "0ld0ld0ld0ld0ld0", Source: pipelineSourceMergeRequest})
+			}
+			writeTestJSON(t, w, page)
+		case r.Method == http.MethodPost && strings.HasSuffix(r.URL.Path, "/cancel"):
+			canceled = append(canceled, strings.TrimSuffix(
+				strings.TrimPrefix(r.URL.Path, "/api/v4/projects/123/pipelines/"), "/cancel"))
+			writeTestJSON(t, w, Pipeline{Status: "canceled"})
+		default:
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	config := &Config{GitLabURL: server.URL, ProjectID: 123, PrivateToken: "test-token"}
+	captureOutput(t, func() {
+		cancelStalePipelines(context.Background(), &http.Client{}, config,
+			&MergeRequest{IID: 42, SHA: "headheadheadhead"}, &Pipeline{ID: 600})
+	})
+
+	if !slices.Equal(canceled, []string{"7"}) {
+		t.Errorf("canceled pipelines %v, want [7] from the second page", canceled)
+	}
+}
+
+// TestCancelStalePipelinesWarns pins that the housekeeping never fails the run:
+// an unknown current pipeline, and a cancel GitLab refuses, are warnings.
+func TestCancelStalePipelinesWarns(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			writeTestJSON(t, w, []Pipeline{{ID: 5, Status: "running", SHA: "old", Source: pipelineSourceMergeRequest}})
+			return
+		}
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer server.Close()
+
+	config := &Config{GitLabURL: server.URL, ProjectID: 123, PrivateToken: "test-token"}
+	mr := &MergeRequest{IID: 42, SHA: "head"}
+
+	errOut := captureStderr(t, func() {
+		cancelStalePipelines(context.Background(), &http.Client{}, config, mr, nil)
+		cancelStalePipelines(context.Background(), &http.Client{}, config, mr, &Pipeline{ID: 9})
+	})
+	if !strings.Contains(errOut, "not canceling older ones") || !strings.Contains(errOut, "could not cancel stale pipeline 5") {
+		t.Errorf("stderr %q does not carry both warnings", errOut)
+	}
+}
+
+func TestValidateCancelStalePipelines(t *testing.T) {
+	err := validateConfig(&Config{CancelStalePipelines: true})
+	if err == nil || !strings.Contains(err.Error(), "--cancel-stale-pipelines has no effect without --trigger-pipeline") {
+		t.Errorf("validateConfig() error = %v, want it refused without --trigger-pipeline", err)
+	}
+}
+
+// retryCalls records the retries retryServer was asked for.
+type retryCalls struct {
+	pipelineRetries []string
+	jobRetries      []string
+	created         int
+}
+
+// retryServer mocks MR 42 of project 123 with one merge request pipeline, 7,
+// for the head commit in the given status, and three failed jobs in it.
+func retryServer(t *testing.T, head, status string) (*httptest.Server, *retryCalls) {
+	t.Helper()
+
+	calls := &retryCalls{}
+	const base = "/api/v4/projects/123"
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		switch {
+		case r.Method == http.MethodGet && r.URL.Path == base+"/merge_requests/42/pipelines":
+			writeTestJSON(t, w, []Pipeline{{ID: 7, Status: status, SHA: head, Source: pipelineSourceMergeRequest}})
+		case r.Method == http.MethodPost && r.URL.Path == base+"/merge_requests/42/pipelines":
+			calls.created++
+			writeTestJSON(t, w, Pipeline{ID: 8, Status: "created"})
+		case r.Method == http.MethodGet && r.URL.Path == base+"/pipelines/7/jobs":
+			writeTestJSON(t, w, []Job{
+				{ID: 31, Name: "unit", Status: "failed"},
+				{ID: 32, Name: "rspec 1/3", Status: "failed"},
+				{ID: 33, Name: "lint", Status: "failed"},
+			})
+		case r.Method == http.MethodGet && r.URL.Path == base+"/pipelines/7":
+			writeTestJSON(t, w, Pipeline{ID: 7, Status: "running"})
+		case r.Method == http.MethodPost && r.URL.Path == base+"/pipelines/7/retry":
+			calls.pipelineRetries = append(calls.pipelineRetries, "7")
+			writeTestJSON(t, w, Pipeline{ID: 7, Status: "running"})
+		case r.Method == http.MethodPost && strings.HasPrefix(r.URL.Path, base+"/jobs/"):
+			calls.jobRetries = append(calls.jobRetries,
+				strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, base+"/jobs/"), "/retry"))
+			writeTestJSON(t, w, Job{ID: 99, Status: "pending"})
+		default:
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	return server, calls
+}
+
+// TestTriggerMRPipelineRetryFailed pins --retry-failed: a failed pipeline for
+// the head is retried in place — wholesale, or job by job with --retry-job —
+// and no new pipeline is created; a pipeline that did not fail is left alone.
+func TestTriggerMRPipelineRetryFailed(t *testing.T) {
+	const head = "headheadheadhead"
+
+	tests := []struct {
+		name         string
+		status       string
+		retryJobs    []string
+		wantPipeline []string
+		wantJobs     []string
+		wantOut      string
+	}{
+		{
+			name:         "whole pipeline",
+			status:       "failed",
+			wantPipeline: []string{"7"},
+			wantOut:      "Retrying the failed jobs of pipeline 7 for commit headhead",
+		},
+		{
+			name:      "matching jobs",
+			status:    "failed",
+			retryJobs: []string{"rspec *", "lint"},
+			wantJobs:  []string{"32", "33"},
+			wantOut:   "Retried failed jobs of pipeline 7: rspec 1/3, lint",
+		},
+		{
+			name:      "no job matches",
+			status:    "failed",
+			retryJobs: []string{"deploy*"},
+			wantOut:   "none of its failed jobs match --retry-job",
+		},
+		{
+			name:    "not failed",
+			status:  "running",
+			wantOut: "Merge request pipeline already exists for commit headhead",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, calls := retryServer(t, head, tt.status)
+			config := &Config{
+				GitLabURL: server.URL, ProjectID: 123, PrivateToken: "test-token", PollInterval: time.Millisecond,
+				TriggerPipeline: true, RetryFailed: true, RetryJobs: tt.retryJobs,
+			}
+
+			var pipeline *Pipeline
+			var err error
+			out := captureOutput(t, func() {
+				pipeline, err = triggerMRPipeline(context.Background(), &http.Client{}, config, &MergeRequest{IID: 42, SHA: head})
+			})
+			if err != nil {
+				t.Fatalf("triggerMRPipeline() error = %v", err)
+			}
+
+			if pipeline == nil || pipeline.ID != 7 {
+				t.Errorf("pipeline = %+v, want the existing pipeline 7", pipeline)
+			}
+			if calls.created != 0 {
+				t.Errorf("created %d pipelines, want the existing one reused", calls.created)
+			}
+			if !slices.Equal(calls.pipelineRetries, tt.wantPipeline) || !slices.Equal(calls.jobRetries, tt.wantJobs) {
+				t.Errorf("retried pipelines %v and jobs %v, want %v and %v",
+					calls.pipelineRetries, calls.jobRetries, tt.wantPipeline, tt.wantJobs)
+			}
+			if !strings.Contains(out, tt.wantOut) {
+				t.Errorf("output %q does not contain %q", out, tt.wantOut)
+			}
+		})
+	}
+}
+
+// TestGetFailedJobsPages pins that a failed job past the first page of a large
+// pipeline's failed jobs is listed, and so retried, too.
+func TestGetFailedJobsPages(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v4/projects/123/pipelines/7/jobs" || r.URL.Query().Get("scope[]") != "failed" {
+			t.Errorf("unexpected request %s %s", r.Method, r.URL)
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		var page []Job
+		switch r.URL.Query().Get("page") {
+		case "1":
+			for i := range listPageSize {
+				page = append(page, Job{ID: i + 1, Name: fmt.Sprintf("rspec %d/%d", i+1, listPageSize), Status: "failed"})
+			}
+		case "2":
+			page = append(page, Job{ID: 500, Name: "lint", Status: "failed"})
+		}
+		writeTestJSON(t, w, page)
+	}))
+	defer server.Close()
+
+	config := &Config{GitLabURL: server.URL, ProjectID: 123, PrivateToken: "test-token"}
+	jobs, err := getFailedJobs(context.Background(), &http.Client{}, config, 7)
+	if err != nil {
+		t.Fatalf("getFailedJobs() error = %v", err)
+	}
+	if len(jobs) != listPageSize+1 || jobs[listPageSize].Name != "lint" {
+		t.Errorf("getFailedJobs() returned %d jobs, want the %d on both pages", len(jobs), listPageSize+1)
+	}
+}
+
+func TestMatchesAnyPattern(t *testing.T) {
+	tests := []struct {
+		patterns []string
+		name     string
+		want     bool
+	}{
+		{patterns: []string{"unit"}, name: "unit", want: true},
+		{patterns: []string{"unit"}, name: "unit-slow"},
+		{patterns: []string{"rspec*"}, name: "rspec 2/3", want: true},
+		{patterns: []string{"*:lint"}, name: "go:lint", want: true},
+		{patterns: []string{"a.b"}, name: "axb"},
+		{patterns: []string{"deploy", "test*"}, name: "test integration", want: true},
+		{patterns: nil, name: "unit"},
+	}
+
+	for _, tt := range tests {
+		if got := matchesAnyPattern(tt.patterns, tt.name); got != tt.want {
+			t.Errorf("matchesAnyPattern(%q, %q) = %v, want %v", tt.patterns, tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestValidateRetryFlags(t *testing.T) {
+	tests := []struct {
+		name      string
+		config    Config
+		errSubstr string
+	}{
+		{name: "retry", config: Config{TriggerPipeline: true, RetryFailed: true, RetryJobs: []string{"unit"}}},
+		{
+			name:      "without trigger",
+			config:    Config{RetryFailed: true},
+			errSubstr: "--retry-failed has no effect without --trigger-pipeline",
+		},
+		{
+			name:      "with force",
+			config:    Config{TriggerPipeline: true, ForcePipeline: true, RetryFailed: true},
+			errSubstr: "--retry-failed cannot be used with --force-pipeline",
+		},
+		{
+			name:      "jobs without retry",
+			config:    Config{TriggerPipeline: true, RetryJobs: []string{"unit"}},
+			errSubstr: "--retry-job has no effect without --retry-failed",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateConfig(&tt.config)
+			if tt.errSubstr == "" {
+				if err != nil {
+					t.Errorf("validateConfig() error = %v, want nil", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.errSubstr) {
+				t.Errorf("validateConfig() error = %v, want it to contain %q", err, tt.errSubstr)
+			}
+		})
+	}
+}
+
+func TestParseBranchPolicy(t *testing.T) {
+	got, err := parseBranchPolicy([]string{`^(feature|fix)/[a-z0-9-]+$ = feature/ or fix/ then a kebab-case summary`})
+	if err != nil {
+		t.Fatalf("parseBranchPolicy() error = %v", err)
+	}
+	if len(got) != 1 || got[0].Pattern.String() != `^(feature|fix)/[a-z0-9-]+$` ||
+		got[0].Message != "feature/ or fix/ then a kebab-case summary" {
+		t.Errorf("parseBranchPolicy() = %+v", got)
+	}
+
+	for _, bad := range []string{"^feature/", "=message", "^feature/=", "^(feature=unclosed group"} {
+		if _, err := parseBranchPolicy([]string{bad}); err == nil || !strings.Contains(err.Error(), "invalid --branch-policy") {
+			t.Errorf("parseBranchPolicy(%q) error = %v, want it rejected", bad, err)
+		}
+	}
+}
+
+func TestValidateBranchPolicy(t *testing.T) {
+	policy := []BranchRule{{Pattern: regexp.MustCompile(`^feature/`), Message: "feature/<summary>"}}
+
+	tests := []struct {
+		config    Config
+		errSubstr string
+	}{
+		{config: Config{BranchPolicy: policy, BranchPolicyMode: branchPolicyComment}},
+		{config: Config{BranchPolicy: policy, MRExists: true}},
+		{config: Config{BranchPolicyMode: "ignore"}, errSubstr: `unknown --branch-policy-mode "ignore"`},
+		{
+			config:    Config{BranchPolicyMode: branchPolicyComment},
+			errSubstr: "--branch-policy-mode has no effect without --branch-policy",
+		},
+		{
+			config:    Config{Command: commandStatus, BranchPolicy: policy},
+			errSubstr: "--branch-policy cannot be used with the status command",
+		},
+		{
+			config:    Config{BranchPolicy: policy, BranchPolicyMode: branchPolicyComment, MRExists: true},
+			errSubstr: "--branch-policy-mode comment cannot be used with --mr-exists",
+		},
+	}
+
+	for _, tt := range tests {
+		err := validateConfig(&tt.config)
+		if tt.errSubstr == "" {
+			if err != nil {
+				t.Errorf("validateConfig(%+v) error = %v, want nil", tt.config, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tt.errSubstr) {
+			t.Errorf("validateConfig(%+v) error = %v, want it to contain %q", tt.config, err, tt.errSubstr)
+		}
+	}
+}
+
+// TestRunBranchPolicy pins what a branch outside --branch-policy does: a new MR
+// is refused in either mode, while an open one gets a single comment in
+// comment mode and is left alone in fail mode.
+func TestRunBranchPolicy(t *testing.T) {
+	violation := "branch test123 does not follow the branch naming policy, use one of:\n" +
+		"- feature/<summary>\n- fix/<summary>"
+
+	tests := []struct {
+		name        string
+		branch      string
+		mode        string
+		existingMR  bool
+		notes       string
+		errSubstr   string
+		wantPosted  bool
+		wantUpdated bool
+	}{
+		{name: "conforming branch", branch: "feature/login", mode: branchPolicyFail, existingMR: true, wantUpdated: true},
+		{name: "fail mode", branch: "test123", mode: branchPolicyFail, existingMR: true, errSubstr: violation},
+		{name: "comment mode without an MR", branch: "test123", mode: branchPolicyComment, errSubstr: violation},
+		{
+			name: "comment mode comments", branch: "test123", mode: branchPolicyComment, existingMR: true,
+			notes: `[]`, wantPosted: true, wantUpdated: true,
+		},
+		{
+			name: "comment mode does not repeat itself", branch: "test123", mode: branchPolicyComment, existingMR: true,
+			notes: fmt.Sprintf(`[{"id":7,"body":%q}]`,
+				"The source branch does not follow the branch naming policy.\n\n```\n"+violation+"\n```"),
+			wantUpdated: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var posted NoteRequest
+			var updated bool
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				switch {
+				case r.URL.Path == "/api/v4/projects/123" && r.Method == http.MethodGet:
+					writeTestJSON(t, w, Project{ID: 123, DefaultBranch: "main"})
+				case r.URL.Path == "/api/v4/projects/123/merge_requests" && r.Method == http.MethodGet:
+					if tt.existingMR {
+						_, _ = w.Write([]byte(`[{"id":1,"iid":42,"title":"Old"}]`))
+					} else {
+						_, _ = w.Write([]byte(`[]`))
+					}
+				case r.URL.Path == "/api/v4/projects/123/merge_requests/42/notes" && r.Method == http.MethodGet:
+					_, _ = w.Write([]byte(tt.notes))
+				case r.URL.Path == "/api/v4/projects/123/merge_requests/42/notes" && r.Method == http.MethodPost:
+					if err := json.NewDecoder(r.Body).Decode(&posted); err != nil {
+						t.Errorf("decode note: %v", err)
+					}
+					_, _ = w.Write([]byte(`{"id":8}`))
+				case r.URL.Path == "/api/v4/projects/123/merge_requests/42" && r.Method == http.MethodPut:
+					updated = true
+					_, _ = w.Write([]byte(`{"id":1,"iid":42}`))
+				default:
+					t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+					w.WriteHeader(http.StatusNotFound)
+				}
+			}))
+			defer server.Close()
+
+			config := &Config{
+				PrivateToken: "test-token", SourceBranch: tt.branch, ProjectID: 123, GitLabURL: server.URL,
+				UserIDs: []int{1}, TargetBranch: "main", UpdateMR: true,
+				BranchPolicy: []BranchRule{
+					{Pattern: regexp.MustCompile(`^feature/`), Message: "feature/<summary>"},
+					{Pattern: regexp.MustCompile(`^fix/`), Message: "fix/<summary>"},
+				},
+				BranchPolicyMode: tt.mode,
+			}
+
+			var err error
+			captureStderr(t, func() {
+				captureOutput(t, func() { err = run(context.Background(), config) })
+			})
+
+			if tt.errSubstr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.errSubstr) {
+					t.Fatalf("run() error = %v, want it to contain %q", err, tt.errSubstr)
+				}
+			} else if err != nil {
+				t.Fatalf("run() error = %v", err)
+			}
+
+			if got := posted.Body != ""; got != tt.wantPosted {
+				t.Errorf("posted a note = %v, want %v (body %q)", got, tt.wantPosted, posted.Body)
+			}
+			if tt.wantPosted && !strings.Contains(posted.Body, "- feature/<summary>") {
+				t.Errorf("note %q does not spell out the policy", posted.Body)
+			}
+			if updated != tt.wantUpdated {
+				t.Errorf("updated the MR = %v, want %v", updated, tt.wantUpdated)
+			}
+		})
+	}
+}
+
+func TestCheckTitle(t *testing.T) {
+	types := strings.Split(defaultTitleTypes, ",")
+
+	tests := []struct {
+		name      string
+		mode      string
+		branch    string
+		title     string
+		want      string
+		errSubstr string
+	}{
+		{name: "off", title: "Add login", want: "Add login"},
+		{name: "valid", mode: titleLintFail, title: "feat(auth)!: drop sessions", want: "feat(auth)!: drop sessions"},
+		{name: "draft marker ignored", mode: titleLintFail, title: "Draft: fix: typo", want: "Draft: fix: typo"},
+		{
+			name: "no type", mode: titleLintFail, title: "Add login",
+			errSubstr: `title "Add login" does not follow Conventional Commits`,
+		},
+		{
+			name: "unknown type", mode: titleLintFail, title: "feature: add login",
+			errSubstr: "has type feature, want one of feat, fix",
+		},
+		{name: "warn keeps it", mode: titleLintWarn, title: "Add login", want: "Add login"},
+		{name: "fix spelling", mode: titleLintFix, title: "Draft: Feat (auth) : add login", want: "Draft: feat(auth): add login"},
+		{
+			name: "fix from branch", mode: titleLintFix, branch: "feature/auth-add-login", title: "Add login",
+			want: "feat(auth): Add login",
+		},
+		{
+			name: "fix branch-name title", mode: titleLintFix, branch: "fix/parser-nil-deref",
+			title: "Draft: fix/parser-nil-deref", want: "Draft: fix(parser): nil deref",
+		},
+		{
+			name: "cannot fix", mode: titleLintFix, branch: "test123", title: "Add login",
+			errSubstr: "cannot be fixed without a type",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := &Config{TitleLint: tt.mode, TitleTypes: types, SourceBranch: tt.branch}
+
+			var got string
+			var err error
+			captureStderr(t, func() {
+				captureOutput(t, func() { got, err = checkTitle(config, tt.title) })
+			})
+
+			if tt.errSubstr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.errSubstr) {
+					t.Errorf("checkTitle(%q) error = %v, want it to contain %q", tt.title, err, tt.errSubstr)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Errorf("checkTitle(%q) = %q, %v, want %q", tt.title, got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestTitleFromBranch(t *testing.T) {
+	types := strings.Split(defaultTitleTypes, ",")
+
+	tests := []struct {
+		branch string
+		want   string
+		ok     bool
+	}{
+		{"feat/auth-add-login-page", "feat(auth): add login page", true},
+		{"feature/api-v2_endpoints", "feat(api): v2 endpoints", true},
+		{"hotfix/typo", "fix: typo", true},
+		{"docs/readme-fix_links", "docs(readme): fix links", true},
+		{"test123", "", false},
+		{"wip/auth-login", "", false},
+		{"feat/auth-", "", false},
+	}
+
+	for _, tt := range tests {
+		got, ok := titleFromBranch(tt.branch, types)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("titleFromBranch(%q) = %q, %v, want %q, %v", tt.branch, got, ok, tt.want, tt.ok)
+		}
+	}
+
+	config := &Config{SourceBranch: "feat/auth-add-login", TitleFromBranch: true, TitleTypes: types, Draft: true}
+	if got := mrTitle(config, nil); got != "Draft: feat(auth): add login" {
+		t.Errorf("mrTitle() = %q, want the title from the branch", got)
+	}
+}
+
+func TestValidateTitleFlags(t *testing.T) {
+	tests := []struct {
+		config    Config
+		errSubstr string
+	}{
+		{config: Config{TitleLint: titleLintFix, TitleFromBranch: true, TitleTypes: []string{"feat"}}},
+		{config: Config{Command: commandRevert, TitleLint: titleLintFail}},
+		{config: Config{TitleLint: "strict"}, errSubstr: `unknown --title-lint "strict"`},
+		{config: Config{TitleTypes: []string{"Feat"}}, errSubstr: `invalid --title-types entry "Feat"`},
+		{
+			config:    Config{Command: commandStatus, TitleLint: titleLintWarn},
+			errSubstr: "--title-lint cannot be used with the status command",
+		},
+		{
+			config:    Config{Command: commandRevert, TitleFromBranch: true},
+			errSubstr: "--title-from-branch cannot be used with the revert command",
+		},
+		{
+			config:    Config{Title: "feat: x", TitleFromBranch: true},
+			errSubstr: "--title-from-branch cannot be used with --title",
+		},
+	}
+
+	for _, tt := range tests {
+		err := validateConfig(&tt.config)
+		if tt.errSubstr == "" {
+			if err != nil {
+				t.Errorf("validateConfig(%+v) error = %v, want nil", tt.config, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tt.errSubstr) {
+			t.Errorf("validateConfig(%+v) error = %v, want it to contain %q", tt.config, err, tt.errSubstr)
+		}
+	}
+}
+
+// TestRunRevertTitleLint pins that --title-lint fix turns the revert command's
+// "Revert: " title into a Conventional Commits revert.
+func TestRunRevertTitleLint(t *testing.T) {
+	original := MergeRequest{
+		IID: 42, Title: "Add caching", State: "merged", TargetBranch: "main",
+		MergeCommitSHA: "abc123def4567890", Author: User{ID: 77},
+	}
+	server, calls := revertServer(t, original, 0)
+
+	config := &Config{
+		Command: commandRevert, MRIID: 42, GitLabURL: server.URL, ProjectID: 123,
+		PrivateToken: "test-token", CommitPrefix: "Draft",
+		TitleLint: titleLintFix, TitleTypes: strings.Split(defaultTitleTypes, ","),
+	}
+
+	var err error
+	captureOutput(t, func() { err = run(context.Background(), config) })
+	if err != nil {
+		t.Fatalf("run() error = %v", err)
+	}
+	if calls.created.Title != "Draft: revert: Add caching" {
+		t.Errorf("Title = %q, want %q", calls.created.Title, "Draft: revert: Add caching")
+	}
+}
+
+// TestCountUnresolvedThreadsPages pins that threads past the first page count:
+// an MR with over a hundred threads is not passed on its first hundred.
+func TestCountUnresolvedThreadsPages(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v4/projects/123/merge_requests/42/discussions" {
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		var page []map[string]any
+		switch r.URL.Query().Get("page") {
+		case "1":
+			for i := range listPageSize {
+				page = append(page, map[string]any{
+					"id": fmt.Sprint(i), "notes": []map[string]bool{{"resolvable": true, "resolved": true}},
+				})
+			}
+		case "2":
+			page = append(page, map[string]any{
+				"id": "last", "notes": []map[string]bool{{"resolvable": true, "resolved": false}},
+			})
+		}
+		writeTestJSON(t, w, page)
+	}))
+	defer server.Close()
+
+	config := &Config{GitLabURL: server.URL, ProjectID: 123, PrivateToken: "test-token"}
+	got, err := countUnresolvedThreads(context.Background(), &http.Client{}, config, 42)
+	if err != nil || got != 1 {
+		t.Errorf("countUnresolvedThreads() = %d, %v, want the 1 on page 2", got, err)
+	}
+}
+
+// TestMRChangedPathsWaitsForDiff pins that the paths come from a diff GitLab
+// has worked out for the head the run holds, not from one left over from an
+// earlier push.
+func TestMRChangedPathsWaitsForDiff(t *testing.T) {
+	gets := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		switch r.URL.Path {
+		case "/api/v4/projects/123/merge_requests/42":
+			gets++
+			mr := MergeRequest{IID: 42, SHA: "new", ChangesCount: "1", DiffRefs: DiffRefs{HeadSHA: "old"}}
+			if gets > 1 {
+				mr.DiffRefs.HeadSHA = "new"
+			}
+			writeTestJSON(t, w, mr)
+		case "/api/v4/projects/123/merge_requests/42/diffs":
+			if gets < 2 {
+				t.Error("the diff was read before GitLab had worked it out for the head")
+			}
+			_, _ = w.Write([]byte(`[{"old_path":"a.go","new_path":"a.go"}]`))
+		default:
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	config := &Config{GitLabURL: server.URL, ProjectID: 123, PrivateToken: "test-token", PollInterval: time.Millisecond}
+	mr := &MergeRequest{IID: 42, SHA: "new", ChangesCount: "1", DiffRefs: DiffRefs{HeadSHA: "old"}}
+
+	paths, err := mrChangedPaths(context.Background(), &http.Client{}, config, mr)
+	if err != nil {
+		t.Fatalf("mrChangedPaths() error = %v", err)
+	}
+	if !slices.Equal(paths, []string{"a.go"}) {
+		t.Errorf("paths = %v, want [a.go]", paths)
+	}
+}